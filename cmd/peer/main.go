@@ -21,45 +21,124 @@ import (
 )
 
 func main() {
+	var configPath string
 	var trackerURL string
+	var token string
 	var name string
 	var dataPath string
 	var logPath string
+	var backend string
+	var applyStrategy string
+	var changeThreshold float64
 	var autoconf bool
+	var resume bool
+	var runID string
+	var tuning structs.Tuning
+	flag.StringVar(&configPath, "config", os.Getenv("BTML_PEER_CONFIG"), "Path of the peer config file. Its values are overridden by the environment, flags and the tracker.")
 	flag.StringVar(&trackerURL, "tracker", "http://127.0.0.1:8080", "The URL of the tracker.")
+	flag.StringVar(&token, "token", os.Getenv("BTML_SWARM_TOKEN"), "Pre-shared token required by the tracker to join the swarm.")
 	flag.StringVar(&name, "name", "", "Name of the peer. Default is a random int(0,100).")
 	flag.StringVar(&dataPath, "datapath", "model/data/prepared/", "Base path for the training and testing data. Relative to the model path.")
 	flag.StringVar(&logPath, "logpath", "model/logs/model.log", "Path for the python log file. Relative to the model path.")
+	flag.StringVar(&backend, "backend", "", "The model backend, either 'python' or 'go'. Default is $MODEL_BACKEND or 'python'.")
+	flag.StringVar(&applyStrategy, "apply-strategy", "", "The apply strategy, either 'simple', 'naive' or 'buffered'. Default is $MODEL_APPLY_STRATEGY or 'simple'.")
+	flag.Float64Var(&changeThreshold, "change-threshold", 0, "Minimum change in loss that changes the score of the source. Default is $MODEL_CHANGE_THRESHOLD.")
+	flag.BoolVar(&resume, "resume", false, "Continue from the latest checkpoint of this peer.")
+	flag.StringVar(&runID, "run-id", "", "Identifies the checkpoints of this run. Default is $MODEL_RUN_ID or the name of the peer.")
 	flag.BoolVar(&autoconf, "autoconf", false, "Automatically configure this peer using the provided tracker.")
+	peer.TuningFlags(flag.CommandLine, &tuning)
 	flag.Parse()
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
 
 	logging.FromEnv()
 	var err error
 
-	mc := model.FromEnv()
+	// Defaults < config file < environment < flags < tracker
+	mc := model.DefaultConfig()
 	mc.DataPath = dataPath
 	mc.LogPath = logPath
 	c := &peer.Config{
 		TrackerURL: trackerURL,
+		SwarmToken: token,
+		Addr:       "127.0.0.1",
+		UpdateFreq: time.Second * 10,
 		ModelConf:  mc,
 	}
+	if configPath != "" {
+		f, err := peer.LoadConfigFile(configPath)
+		if err != nil {
+			slog.Error("Failed to load peer config", "path", configPath, "error", err)
+			os.Exit(1)
+		}
+		f.Apply(c)
+		if !given["autoconf"] {
+			autoconf = f.Autoconf
+		}
+	}
+	if err = mc.ApplyEnv(); err != nil {
+		slog.Error("Invalid model config in environment", "error", err)
+		os.Exit(1)
+	}
+	envTuning, err := peer.TuningFromEnv()
+	if err != nil {
+		slog.Error("Invalid peer tuning in environment", "error", err)
+		os.Exit(1)
+	}
+	c.Tuning = c.Tuning.Override(envTuning).Override(tuning)
+	if given["tracker"] {
+		c.TrackerURL = trackerURL
+	}
+	if given["name"] {
+		c.Name = name
+	}
+	if given["datapath"] {
+		mc.DataPath = dataPath
+	}
+	if given["logpath"] {
+		mc.LogPath = logPath
+	}
+	mc.Resume = resume
+	if given["run-id"] {
+		mc.RunID = runID
+	}
+	// Names from the tracker or chosen at random may belong to another run
+	stableName := c.Name != "" && !autoconf
+	if backend != "" {
+		mc.Backend = backend
+	}
+	if given["apply-strategy"] {
+		mc.Apply.Strategy = applyStrategy
+	}
+	if given["change-threshold"] {
+		mc.Apply.ChangeThreshold = float32(changeThreshold)
+	}
 	if autoconf {
-		slog.Info("Using peer autoconfiguration", "tracker", trackerURL)
+		slog.Info("Using peer autoconfiguration", "tracker", c.TrackerURL)
 		err = peer.Autoconf(c)
 		if err != nil {
 			slog.Error("Autoconfiguration failed", "error", err)
 			os.Exit(1)
 		}
 	} else {
-		if name == "" {
+		if c.Name == "" {
 			i, _ := rand.Int(rand.Reader, big.NewInt(100))
-			name = strconv.Itoa(int(i.Int64()))
+			c.Name = strconv.Itoa(int(i.Int64()))
 		}
-		c.Name = name
-		c.Addr = "127.0.0.1"
-		c.UpdateFreq = time.Second * 10
-		c.ModelConf.Name = name
+		mc.Name = c.Name
+	}
+	if mc.RunID == "" && !stableName {
+		if resume {
+			slog.Error("Resuming needs a run ID or a configured name without autoconf")
+			os.Exit(1)
+		}
+		mc.RunID = fmt.Sprintf("%s-%d", c.Name, time.Now().Unix())
+	}
+	if err = c.Validate(); err != nil {
+		slog.Error("Invalid peer config", "error", err)
+		os.Exit(1)
 	}
+	slog.Info("Effective peer config", "config", c)
 	logging.SetID(c.Name)
 
 	var tc *telemetry.Client = nil
@@ -97,20 +176,25 @@ func run(c *peer.Config, t *telemetry.Client) int {
 	defer me.Shutdown()
 
 	var strategy model.ApplyStrategy
-	strategy = model.NewSimpleActionStrategy(m, 0.005)
+	if c.ModelConf.SecureAggregation.Enabled {
+		strategy = model.NewMaskedStrategy(m, c.ModelConf.SecureAggregation, me.SeedSource(), c.ModelConf.Apply.ChangeThreshold)
+	} else {
+		strategy, err = model.NewApplyStrategy(m, c.ModelConf.Apply)
+	}
+	if err != nil {
+		fmt.Printf("Failed to create apply strategy: %v\n", err)
+		os.Exit(1)
+	}
 	ch, _ := me.ListenForWeights()
-	strategy.Start(ch)
+	if err = strategy.Start(me.Ctx, ch); err != nil {
+		fmt.Printf("Failed to start apply strategy: %v\n", err)
+		os.Exit(1)
+	}
 
-	m.SetCallback(func(weights *structs.Weights) {
-		i, _ := rand.Int(rand.Reader, big.NewInt(100))
-		if i.Cmp(big.NewInt(80)) < 0 {
-			return
-		}
-		me.Send(weights)
-	})
+	m.SetCallback(me.ModelChanged)
 
 	if t != nil {
-		go m.EvalLoop()
+		go m.EvalLoop(me.Ctx)
 	}
 
 	go localPlay(m, me)
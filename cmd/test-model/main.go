@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 
@@ -32,34 +33,35 @@ func main() {
 	}
 	// Ensure cleanup on exit
 	defer m.Shutdown()
+	ctx := context.Background()
 
 	// Train the model
-	if _, err := m.Train(); err != nil {
+	if _, err := m.Train(ctx); err != nil {
 		slog.Error("Failed to train model", "error", err)
 		os.Exit(1)
 	}
 
 	// Get initial weights
-	weights, err := m.GetWeights()
+	weights, err := m.GetWeights(ctx)
 	if err != nil {
 		slog.Error("Failed to get weights", "error", err)
 		os.Exit(1)
 	}
 
 	// Evaluate the model
-	if _, err := m.Eval(); err != nil {
+	if _, err := m.Eval(ctx); err != nil {
 		slog.Error("Failed to evaluate model", "error", err)
 		os.Exit(1)
 	}
 
 	// Apply weights back
-	if _, err := m.Apply(weights); err != nil {
+	if _, err := m.Apply(ctx, weights); err != nil {
 		slog.Error("Failed to apply weights", "error", err)
 		os.Exit(1)
 	}
 
 	// Evaluate the model
-	if _, err := m.Eval(); err != nil {
+	if _, err := m.Eval(ctx); err != nil {
 		slog.Error("Failed to evaluate model", "error", err)
 		os.Exit(1)
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"flag"
 	"fmt"
@@ -61,7 +62,7 @@ func run(c *peer.Config, ps *peer.PeerSet) int {
 
 	var strategy model.ApplyStrategy = &DummyStrategy{}
 	ch, _ := me.ListenForWeights()
-	strategy.Start(ch)
+	strategy.Start(me.Ctx, ch)
 	me.ManualPeerSet(ps)
 
 	go dummySend(me)
@@ -77,8 +78,10 @@ func run(c *peer.Config, ps *peer.PeerSet) int {
 
 func dummySend(p *peer.Me) {
 	for i := range 100 {
-		w := &structs.Weights{}
-		w.SetAge(i)
+		// Receivers reject weights that are not a valid tensor map
+		w, _ := structs.NewTensorWeights(&structs.TensorMap{Tensors: []*structs.Tensor{
+			structs.NewFloat32Tensor("weight", []int64{1}, []float32{float32(i)}),
+		}}, i)
 		p.Send(w)
 		time.Sleep(time.Second * 10)
 	}
@@ -105,7 +108,7 @@ func manualPeerSet(list string) *peer.PeerSet {
 type DummyStrategy struct{}
 
 func (d *DummyStrategy) SetModel(m *model.Model) {}
-func (d *DummyStrategy) Start(wc <-chan *model.WeightsWithCallback) error {
+func (d *DummyStrategy) Start(_ context.Context, wc <-chan *model.WeightsWithCallback) error {
 	go func() {
 		for w := range wc {
 			slog.Info("Received message", "age", w.GetAge())
@@ -1,11 +1,21 @@
 package model
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"math"
+	"time"
 
 	"github.com/vs-ude/btml/internal/structs"
 )
 
+const (
+	ApplySimple   = "simple"
+	ApplyNaive    = "naive"
+	ApplyBuffered = "buffered"
+)
+
 type WeightsWithCallback struct {
 	callback func(int)
 	*structs.Weights
@@ -25,10 +35,44 @@ func (wwc *WeightsWithCallback) ToWeights() *structs.Weights {
 // Type checks
 var _ ApplyStrategy = &NaiveStrategy{}
 var _ ApplyStrategy = &SimpleActionStrategy{}
+var _ ApplyStrategy = &BufferedStrategy{}
 
 type ApplyStrategy interface {
 	SetModel(model *Model)
-	Start(<-chan *WeightsWithCallback) error
+	// Start applies incoming weights until the channel is closed. Running
+	// applies are cancelled once ctx is done.
+	Start(context.Context, <-chan *WeightsWithCallback) error
+}
+
+// NewApplyStrategy returns the strategy selected in the config. An empty
+// strategy selects ApplySimple.
+func NewApplyStrategy(model *Model, c ApplyConfig) (ApplyStrategy, error) {
+	switch c.Strategy {
+	case ApplySimple, "":
+		return NewSimpleActionStrategy(model, c.ChangeThreshold), nil
+	case ApplyNaive:
+		return NewNaiveStrategy(model), nil
+	case ApplyBuffered:
+		if c.BufferSize < 1 {
+			return nil, fmt.Errorf("buffer size must be positive, got %d", c.BufferSize)
+		}
+		return NewBufferedStrategy(model, c.BufferSize, c.BufferTimeout, c.ChangeThreshold), nil
+	default:
+		return nil, fmt.Errorf("unknown apply strategy %q", c.Strategy)
+	}
+}
+
+// scoreChange converts a change in loss into a score update.
+func scoreChange(change, threshold float32) int {
+	// This assumes that change is a difference in loss, i.e. >0 = bad and <0 = good
+	switch {
+	case change > threshold:
+		return -1
+	case change < -threshold:
+		return 1
+	default:
+		return 0
+	}
 }
 
 // Applies all updates it gets and does nothing else.
@@ -44,14 +88,17 @@ func (ns *NaiveStrategy) SetModel(model *Model) {
 	ns.model = model
 }
 
-func (ns *NaiveStrategy) Start(weightsChan <-chan *WeightsWithCallback) error {
+func (ns *NaiveStrategy) Start(ctx context.Context, weightsChan <-chan *WeightsWithCallback) error {
 	go func() {
 		for weights := range weightsChan {
-			_, err := ns.model.Apply(weights.ToWeights())
+			_, err := ns.model.Apply(ctx, weights.ToWeights())
 			if err != nil {
 				slog.Error("Failed applying weights", "error", err)
 				continue
 			}
+			// The score is left unchanged, but the update counts as received
+			// for the ledger of the source
+			weights.callback(0)
 		}
 	}()
 	return nil
@@ -75,27 +122,132 @@ func (sas *SimpleActionStrategy) SetModel(model *Model) {
 	sas.model = model
 }
 
-func (sas *SimpleActionStrategy) Start(weightsChan <-chan *WeightsWithCallback) error {
+func (sas *SimpleActionStrategy) Start(ctx context.Context, weightsChan <-chan *WeightsWithCallback) error {
 	go func() {
 		for weights := range weightsChan {
-			change, err := sas.model.Apply(weights.ToWeights())
+			change, err := sas.model.Apply(ctx, weights.ToWeights())
 			if err != nil {
 				slog.Error("Failed applying weights", "error", err)
 				continue
 			}
-			var score int
-			// This assumes that change is a difference in loss, i.e. >0 = bad and <0 = good
-			// It also assumes that
-			switch {
-			case change > sas.changeThreshold:
-				score = -1
-			case change < -sas.changeThreshold:
-				score = 1
-			default:
-				return
-			}
-			weights.callback(score)
+			weights.callback(scoreChange(change, sas.changeThreshold))
 		}
 	}()
 	return nil
 }
+
+// Collects updates and applies them together once it holds size updates or
+// timeout passed since the first update arrived, similar to FedBuff. Each
+// update is discounted by its staleness, i.e. the number of ages it is behind
+// the model, and the model is only trained once per batch. Updates keep being
+// collected while a batch is applied, up to size updates.
+type BufferedStrategy struct {
+	model           *Model
+	size            int
+	timeout         time.Duration // Any value < 1 means wait for size updates
+	changeThreshold float32
+}
+
+func NewBufferedStrategy(model *Model, size int, timeout time.Duration, changeThreshold float32) *BufferedStrategy {
+	return &BufferedStrategy{
+		model:           model,
+		size:            size,
+		timeout:         timeout,
+		changeThreshold: changeThreshold,
+	}
+}
+
+func (bs *BufferedStrategy) SetModel(model *Model) {
+	bs.model = model
+}
+
+func (bs *BufferedStrategy) Start(ctx context.Context, weightsChan <-chan *WeightsWithCallback) error {
+	batches := make(chan []*WeightsWithCallback)
+	go func() {
+		for batch := range batches {
+			bs.apply(ctx, batch)
+		}
+	}()
+	go bs.collect(ctx, weightsChan, batches)
+	return nil
+}
+
+// collect buffers incoming updates and passes them on in batches. It closes
+// batches once weightsChan is closed or ctx is done.
+func (bs *BufferedStrategy) collect(ctx context.Context, weightsChan <-chan *WeightsWithCallback, batches chan<- []*WeightsWithCallback) {
+	defer close(batches)
+	var buffer []*WeightsWithCallback
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	ready := false
+	for {
+		incoming, out := weightsChan, batches
+		if len(buffer) >= bs.size {
+			// Let the channel back up until the current batch is applied
+			incoming = nil
+		}
+		if !ready {
+			out = nil
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case weights, ok := <-incoming:
+			if !ok {
+				if len(buffer) > 0 {
+					slog.Debug("Applying remaining buffered updates", "updates", len(buffer))
+					select {
+					case batches <- buffer:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+			buffer = append(buffer, weights)
+			if len(buffer) == 1 && bs.timeout > 0 {
+				timer = time.NewTimer(bs.timeout)
+				timeout = timer.C
+			}
+			if len(buffer) >= bs.size {
+				ready = true
+			}
+		case <-timeout:
+			timeout = nil
+			ready = true
+		case out <- buffer:
+			buffer = nil
+			ready = false
+			if timer != nil {
+				timer.Stop()
+				timeout = nil
+			}
+		}
+	}
+}
+
+func (bs *BufferedStrategy) apply(ctx context.Context, batch []*WeightsWithCallback) {
+	weights := make([]*structs.Weights, len(batch))
+	for i, w := range batch {
+		weights[i] = w.ToWeights()
+	}
+	var staleness []int
+	changes, err := bs.model.ApplyAll(ctx, weights, func(s int) float32 {
+		staleness = append(staleness, s)
+		return stalenessDiscount(s)
+	})
+	if bs.model.telemetry != nil && len(staleness) > 0 {
+		go bs.model.telemetry.RecordApplyBuffer(len(batch), staleness, err == nil)
+	}
+	if err != nil {
+		slog.Error("Failed applying buffered weights", "updates", len(batch), "error", err)
+		return
+	}
+	for i, w := range batch {
+		w.callback(scoreChange(changes[i], bs.changeThreshold))
+	}
+}
+
+// stalenessDiscount is the polynomial discount of FedBuff.
+func stalenessDiscount(staleness int) float32 {
+	return float32(1 / math.Sqrt(1+float64(staleness)))
+}
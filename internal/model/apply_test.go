@@ -0,0 +1,65 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferedStrategyAppliesBatch(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	other := newTestModel(t, Timeouts{})
+	w, err := other.GetWeights(context.Background())
+	require.NoError(t, err)
+	bs := NewBufferedStrategy(m, 3, 0, 0)
+	ch := make(chan *WeightsWithCallback)
+	done := make(chan int, 3)
+	require.NoError(t, bs.Start(context.Background(), ch))
+
+	// run
+	for range 3 {
+		ch <- NewWeightsWithCallback(w, func(score int) { done <- score })
+	}
+	for range 3 {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("buffered updates were not applied")
+		}
+	}
+	close(ch)
+
+	// verify
+	assert.Equal(t, 2, m.GetAge(), "the batch should be applied in a single step")
+}
+
+func TestBufferedStrategyTimeout(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	w, err := m.GetWeights(context.Background())
+	require.NoError(t, err)
+	bs := NewBufferedStrategy(m, 10, 10*time.Millisecond, 0)
+	ch := make(chan *WeightsWithCallback)
+	done := make(chan int, 1)
+	require.NoError(t, bs.Start(context.Background(), ch))
+
+	// run
+	ch <- NewWeightsWithCallback(w, func(score int) { done <- score })
+
+	// verify
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("buffered update was not applied after the timeout")
+	}
+	close(ch)
+}
+
+func TestStalenessDiscount(t *testing.T) {
+	assert.Equal(t, float32(1), stalenessDiscount(0))
+	assert.InDelta(t, 0.5, stalenessDiscount(3), 1e-6)
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"context"
+
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+const (
+	BackendPython = "python"
+	BackendGo     = "go"
+)
+
+// Architecture IDs. Peers only exchange weights with peers of the same
+// architecture. The Python model registers its architectures in
+// model/training.py.
+const (
+	ArchitectureCNN     = "fmnist_cnn" // Default of the Python backend
+	ArchitectureMLP     = "fmnist_mlp"
+	ArchitectureSoftmax = "softmax" // The only architecture of the Go backend
+)
+
+// Backend is the implementation of the actual machine learning model. Model
+// serializes all calls, so backends do not need to be safe for concurrent use.
+// Backends should stop an operation as soon as possible once its context is
+// done.
+type Backend interface {
+	// Start prepares the backend. It is called once before any other method.
+	Start() error
+	// Train trains the model with the given hyperparameters. Zero values
+	// select the backend defaults.
+	Train(ctx context.Context, hp structs.Hyperparams) (*metrics, error)
+	// Eval evaluates the model and stores a checkpoint at the given path
+	// unless the path is empty.
+	Eval(ctx context.Context, checkpointPath string) (*metrics, error)
+	// Import mixes the given weights into the model, where ratio is the share
+	// of the imported weights. Layers overrides the share of single tensors,
+	// tensors missing from the weights keep their values. The weights may be
+	// flat, then layers is nil.
+	Import(ctx context.Context, weights *structs.Weights, ratio float32, layers map[string]float32) error
+	// Export returns the current weights of the model without an age. They
+	// are flat if secure aggregation is enabled.
+	Export(ctx context.Context) (*structs.Weights, error)
+	// ExportPrivate returns the weights of the last private export plus the
+	// change since then, clipped to clipNorm and with Gaussian noise of
+	// standard deviation noiseMultiplier * clipNorm, and the norm of the
+	// change before clipping. The first private export starts from the
+	// initial weights.
+	ExportPrivate(ctx context.Context, clipNorm, noiseMultiplier float32) (weights *structs.Weights, norm float32, err error)
+	Close() error
+}
@@ -0,0 +1,167 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+// checkpointExt is the extension of checkpoints, which contain a
+// serialized structs.TensorMap with both backends.
+const checkpointExt = ".tensors"
+
+// checkpointMeta is stored as JSON sidecar next to every checkpoint.
+type checkpointMeta struct {
+	Age       int                   `json:"age"`
+	Loss      float32               `json:"loss"`
+	Accuracy  float32               `json:"accuracy"`
+	Timestamp time.Time             `json:"timestamp"`
+	Sources   map[string]int        `json:"sources"` // Applied updates per source
+	Versions  structs.VersionVector `json:"versions"`
+	Path      string                `json:"-"`
+}
+
+// checkpointManager keeps the latest checkpoints and the best checkpoint by
+// evaluation loss and removes all others.
+type checkpointManager struct {
+	base        string
+	ext         string    // File extension of the backend checkpoints
+	keep        int       // Any value < 1 means keep all
+	since       time.Time // Older checkpoints are kept but never restored
+	checkpoints []*checkpointMeta
+	sync.Mutex
+}
+
+func newCheckpointManager(base, ext string, keep int) *checkpointManager {
+	return &checkpointManager{
+		base: base,
+		ext:  ext,
+		keep: keep,
+	}
+}
+
+// path returns the path of the checkpoint for the given age without the
+// extension, as expected by Backend.Eval.
+func (cm *checkpointManager) path(age int) string {
+	return filepath.Join(cm.base, strconv.Itoa(age))
+}
+
+// load reads the sidecars of existing checkpoints.
+func (cm *checkpointManager) load() error {
+	cm.Lock()
+	defer cm.Unlock()
+	files, err := filepath.Glob(filepath.Join(cm.base, "*.json"))
+	if err != nil {
+		return err
+	}
+	cm.checkpoints = nil
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("unable to read checkpoint metadata: %w", err)
+		}
+		meta := new(checkpointMeta)
+		if err = json.Unmarshal(data, meta); err != nil {
+			slog.Warn("Ignoring invalid checkpoint metadata", "path", f, "error", err)
+			continue
+		}
+		meta.Path = strings.TrimSuffix(f, ".json") + cm.ext
+		if _, err = os.Stat(meta.Path); err != nil {
+			slog.Warn("Ignoring checkpoint metadata without checkpoint", "path", f)
+			continue
+		}
+		cm.checkpoints = append(cm.checkpoints, meta)
+	}
+	slices.SortFunc(cm.checkpoints, func(a, b *checkpointMeta) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	return nil
+}
+
+// add writes the sidecar for a checkpoint the backend just stored and
+// removes checkpoints that are neither among the latest nor the best.
+func (cm *checkpointManager) add(met *metrics, age int, sources map[string]int, versions structs.VersionVector) error {
+	meta := &checkpointMeta{
+		Age:       age,
+		Loss:      met.loss,
+		Accuracy:  met.acc,
+		Timestamp: time.Now(),
+		Sources:   maps.Clone(sources),
+		Versions:  maps.Clone(versions),
+		Path:      cm.path(age) + cm.ext,
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(cm.path(age)+".json", data, 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint metadata: %w", err)
+	}
+
+	cm.Lock()
+	defer cm.Unlock()
+	// A repeated evaluation overwrites the checkpoint of the same age
+	cm.checkpoints = slices.DeleteFunc(cm.checkpoints, func(c *checkpointMeta) bool {
+		return c.Age == age
+	})
+	cm.checkpoints = append(cm.checkpoints, meta)
+	cm.prune()
+	return nil
+}
+
+// prune assumes that the manager is locked.
+func (cm *checkpointManager) prune() {
+	if cm.keep < 1 || len(cm.checkpoints) <= cm.keep {
+		return
+	}
+	best := cm.best()
+	removed := cm.checkpoints[:len(cm.checkpoints)-cm.keep]
+	cm.checkpoints = slices.Clone(cm.checkpoints[len(cm.checkpoints)-cm.keep:])
+	for _, c := range removed {
+		if c == best {
+			cm.checkpoints = slices.Insert(cm.checkpoints, 0, c)
+			continue
+		}
+		for _, p := range []string{c.Path, cm.path(c.Age) + ".json"} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				slog.Warn("Failed to remove old checkpoint", "path", p, "error", err)
+			}
+		}
+		slog.Debug("Removed old checkpoint", "age", c.Age)
+	}
+}
+
+// best assumes that the manager is locked.
+func (cm *checkpointManager) best() *checkpointMeta {
+	var best *checkpointMeta
+	for _, c := range cm.checkpoints {
+		if best == nil || c.Loss < best.Loss {
+			best = c
+		}
+	}
+	return best
+}
+
+// latest returns the most recent checkpoint that may be restored, if any.
+func (cm *checkpointManager) latest() (*checkpointMeta, bool) {
+	cm.Lock()
+	defer cm.Unlock()
+	if len(cm.checkpoints) == 0 {
+		return nil, false
+	}
+	c := cm.checkpoints[len(cm.checkpoints)-1]
+	if c.Timestamp.Before(cm.since) {
+		return nil, false
+	}
+	return c, true
+}
@@ -0,0 +1,114 @@
+package model
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func addTestCheckpoint(t *testing.T, cm *checkpointManager, age int, loss float32) {
+	require.NoError(t, os.MkdirAll(cm.base, 0755))
+	require.NoError(t, os.WriteFile(cm.path(age)+cm.ext, []byte("weights"), 0644))
+	require.NoError(t, cm.add(&metrics{acc: 0.5, loss: loss}, age, map[string]int{"a": age}, structs.VersionVector{"a": age}))
+}
+
+func TestCheckpointRetention(t *testing.T) {
+	// prepare
+	cm := newCheckpointManager(t.TempDir(), ".gob", 2)
+
+	// run
+	for age, loss := range []float32{3, 1, 2, 4, 5} {
+		addTestCheckpoint(t, cm, age+1, loss)
+	}
+
+	// verify
+	var ages []int
+	for _, c := range cm.checkpoints {
+		ages = append(ages, c.Age)
+	}
+	assert.Equal(t, []int{2, 4, 5}, ages, "the best and the two latest checkpoints should be kept")
+	assert.NoFileExists(t, cm.path(1)+".gob")
+	assert.NoFileExists(t, cm.path(3)+".json")
+	assert.FileExists(t, cm.path(2)+".gob")
+	assert.FileExists(t, cm.path(2)+".json")
+}
+
+func TestCheckpointLoad(t *testing.T) {
+	// prepare
+	dir := t.TempDir()
+	cm := newCheckpointManager(dir, ".gob", 0)
+	addTestCheckpoint(t, cm, 4, 1)
+	addTestCheckpoint(t, cm, 7, 2)
+
+	// run
+	loaded := newCheckpointManager(dir, ".gob", 0)
+	err := loaded.load()
+
+	// verify
+	require.NoError(t, err)
+	latest, ok := loaded.latest()
+	require.True(t, ok)
+	assert.Equal(t, 7, latest.Age)
+	assert.Equal(t, map[string]int{"a": 7}, latest.Sources)
+	assert.Equal(t, cm.path(7)+".gob", latest.Path)
+}
+
+func TestModelResume(t *testing.T) {
+	// prepare
+	c := &Config{Name: "1", Backend: BackendGo, Dataset: SyntheticDataset, DataPath: t.TempDir()}
+	m, err := NewModel(c, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Start())
+	_, err = m.Train(context.Background())
+	require.NoError(t, err)
+	_, err = m.Eval(context.Background())
+	require.NoError(t, err)
+	expected, _ := m.GetWeights(context.Background())
+
+	// run
+	c.Resume = true
+	resumed, err := NewModel(c, nil)
+	require.NoError(t, err)
+	require.NoError(t, resumed.Start())
+
+	// verify
+	assert.Equal(t, m.GetAge(), resumed.GetAge())
+	assert.Equal(t, structs.VersionVector{"1": 1}, resumed.versions)
+	actual, _ := resumed.GetWeights(context.Background())
+	assert.Equal(t, expected.Get(), actual.Get())
+}
+
+func TestModelIgnoresOldCheckpoints(t *testing.T) {
+	// prepare
+	c := &Config{Name: "1", Backend: BackendGo, Dataset: SyntheticDataset, DataPath: t.TempDir()}
+	m, err := NewModel(c, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Start())
+	_, err = m.Train(context.Background())
+	require.NoError(t, err)
+	_, err = m.Eval(context.Background())
+	require.NoError(t, err)
+	old, ok := m.checkpoints.latest()
+	require.True(t, ok)
+
+	// run
+	fresh, err := NewModel(c, nil)
+	require.NoError(t, err)
+
+	// verify
+	_, ok = fresh.checkpoints.latest()
+	assert.False(t, ok, "a new run should not use checkpoints of a previous run")
+	assert.FileExists(t, old.Path, "checkpoints of a previous run should only be removed by the retention")
+}
+
+func TestCheckpointPathUsesRunID(t *testing.T) {
+	c := &Config{Name: "1", Dataset: SyntheticDataset, DataPath: "data"}
+	assert.Equal(t, "data/checkpoints/synthetic_1", c.GetCheckpointPath())
+
+	c.RunID = "run"
+	assert.Equal(t, "data/checkpoints/synthetic_run", c.GetCheckpointPath(), "the run ID should replace the name")
+}
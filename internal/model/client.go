@@ -1,77 +1,445 @@
 package model
 
 import (
+	"bufio"
 	context "context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/vs-ude/btml/internal/structs"
+	"github.com/vs-ude/btml/internal/telemetry"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
-// ModelClient implements the Model interface by communicating with a Python process
+// Type checks
+var _ Backend = &ModelClient{}
+
+// ModelClient implements the Backend interface by communicating with a Python
+// process. The process is supervised and restarted if it exits or stops
+// answering health checks.
 type ModelClient struct {
+	conf                *Config
 	socketPath          string
 	conn                *grpc.ClientConn
 	trainClient         TrainClient
 	evalClient          EvalClient
 	importWeightsClient ImportWeightsClient
 	exportWeightsClient ExportWeightsClient
-	cmd                 *exec.Cmd
+	controlClient       ControlClient
+	healthClient        healthpb.HealthClient
+	proc                *process
+	closing             chan struct{}
+	closeOnce           sync.Once
+	largeWeights        atomic.Bool                            // Export weights via stream
+	checkpoint          func() (path string, age int, ok bool) // Latest checkpoint including the extension
+	restored            func(age int)
+	telemetry           *telemetry.Client
+	sync.RWMutex
 }
 
-func (c *ModelClient) Close() error {
+// process is a running Python process. Its exit is broadcast by closing done,
+// after which err holds the result of waiting for it.
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+// startProcess starts the command and waits for it in the background. The
+// output of the process is logged until it exits.
+func startProcess(cmd *exec.Cmd) (*process, error) {
+	r, w := io.Pipe()
+	// The same writer for both makes exec share a single pipe
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go logModelOutput(r)
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		p.err = cmd.Wait()
+		w.Close()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// kill kills the process and waits until it exited.
+func (p *process) kill() {
+	p.cmd.Process.Kill()
+	<-p.done
+}
+
+// NewModelClient prepares the Python process for the given config. The
+// process is only started by Start.
+func NewModelClient(c *Config, telemetry *telemetry.Client) *ModelClient {
+	return &ModelClient{
+		conf: c,
+		// Create a random socket path in /tmp
+		socketPath: filepath.Join(os.TempDir(), fmt.Sprintf("btml-model-%d.sock", time.Now().Unix())),
+		closing:    make(chan struct{}),
+		telemetry:  telemetry,
+	}
+}
+
+// Start starts the Python process, connects to it and starts supervising it.
+func (c *ModelClient) Start() error {
+	if err := c.start(""); err != nil {
+		return err
+	}
+	go c.supervise()
+	return nil
+}
+
+// start starts a new Python process, optionally loading the given weights,
+// and waits until it is healthy.
+func (c *ModelClient) start(weights string) error {
+	cmd := c.newCmd(weights)
+	slog.Info("Starting Python process", "command", cmd.String(), "cwd", cmd.Dir)
+	proc, err := startProcess(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to start Python process: %w", err)
+	}
+
+	conn, err := grpc.NewClient("unix://"+c.socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		proc.kill()
+		return fmt.Errorf("failed to create gRPC client: %w", err)
+	}
+	if err = waitHealthy(conn, proc); err != nil {
+		conn.Close()
+		proc.kill()
+		os.Remove(c.socketPath)
+		return err
+	}
+
+	c.Lock()
 	if c.conn != nil {
 		c.conn.Close()
 	}
-	if c.cmd != nil {
-		c.cmd.Process.Signal(syscall.SIGTERM)
-		c.cmd.Wait()
+	c.proc = proc
+	c.conn = conn
+	c.trainClient = NewTrainClient(conn)
+	c.evalClient = NewEvalClient(conn)
+	c.exportWeightsClient = NewExportWeightsClient(conn)
+	c.importWeightsClient = NewImportWeightsClient(conn)
+	c.controlClient = NewControlClient(conn)
+	c.healthClient = healthpb.NewHealthClient(conn)
+	c.Unlock()
+
+	slog.Info("Model process is set up and running")
+	return nil
+}
+
+func (c *ModelClient) newCmd(weights string) *exec.Cmd {
+	args := append(c.conf.ModelArgs,
+		"--train-data", c.conf.GetTrainDataPath(),
+		"--test-data", c.conf.GetTestDataPath(),
+		"--socket", c.socketPath,
+		"--architecture", c.conf.GetArchitecture(),
+	)
+	if c.conf.DatasetFormat != "" {
+		args = append(args, "--dataset-format", c.conf.DatasetFormat)
+	}
+	if c.conf.LogPath != "" {
+		if p, err := resolveLogPath(c.conf); err == nil {
+			args = append(args, "--log-file", p)
+		} else {
+			slog.Warn("Invalid log path configuration. Log path should be either a nonexistent *.log file or a directory.", "error", err)
+		}
+	}
+	if weights != "" {
+		args = append(args, "--weights", weights)
+	}
+	return exec.Command(c.conf.PythonRuntime, args...)
+}
+
+// waitHealthy polls the health service until the process is serving. It
+// gives up early if the process exits in the meantime.
+func waitHealthy(conn *grpc.ClientConn, proc *process) error {
+	client := healthpb.NewHealthClient(conn)
+	maxAttempts := 10
+	for i := range maxAttempts {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+		cancel()
+		if err == nil && res.Status == healthpb.HealthCheckResponse_SERVING {
+			return nil
+		}
+		if i > 3 {
+			slog.Debug("No response from model (yet)", "attempt", i+1, "max_attempts", maxAttempts)
+		}
+		select {
+		case <-proc.done:
+			return fmt.Errorf("model process exited during startup: %w", proc.err)
+		case <-time.After(time.Second):
+		}
+	}
+	return errors.New("failed to connect to model process")
+}
+
+const (
+	healthInterval    = time.Second * 10
+	healthTimeout     = time.Second * 5
+	maxHealthFailures = 3
+	maxRestartBackoff = time.Minute
+	cancelTimeout     = time.Second * 5
+	cancelPoll        = time.Millisecond * 100
+)
+
+// supervise watches the Python process and restarts it if it exits or fails
+// too many consecutive health checks.
+func (c *ModelClient) supervise() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	failures := 0
+	reason := ""
+	for {
+		c.RLock()
+		proc := c.proc
+		c.RUnlock()
+		select {
+		case <-c.closing:
+			return
+		case <-proc.done:
+			select {
+			case <-c.closing:
+				return
+			default:
+			}
+			if reason == "" {
+				reason = fmt.Sprintf("process exited: %v", proc.err)
+			}
+			slog.Error("Model process stopped", "reason", reason)
+			if !c.restart(reason) {
+				return
+			}
+			failures = 0
+			reason = ""
+		case <-ticker.C:
+			if err := c.checkHealth(); err != nil {
+				failures++
+				slog.Warn("Model health check failed", "failures", failures, "error", err)
+				if failures >= maxHealthFailures && reason == "" {
+					reason = fmt.Sprintf("%d failed health checks", failures)
+					proc.cmd.Process.Kill()
+				}
+			} else {
+				failures = 0
+			}
+		}
+	}
+}
+
+func (c *ModelClient) checkHealth() error {
+	c.RLock()
+	client := c.healthClient
+	c.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	res, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("model is %s", res.Status.String())
 	}
 	return nil
 }
 
-func (c *ModelClient) Train() (*metrics, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+// restart starts a new Python process with exponential backoff and restores
+// the latest checkpoint. It returns false if the client was closed before
+// the restart succeeded.
+func (c *ModelClient) restart(reason string) bool {
+	for attempt := 1; ; attempt++ {
+		backoff := min(time.Second<<(attempt-1), maxRestartBackoff)
+		select {
+		case <-c.closing:
+			return false
+		case <-time.After(backoff):
+		}
+		path, age, ok := "", 0, false
+		if c.checkpoint != nil {
+			path, age, ok = c.checkpoint()
+		}
+		if err := c.start(path); err != nil {
+			slog.Warn("Failed restarting model process", "attempt", attempt, "error", err)
+			continue
+		}
+		if ok && c.restored != nil {
+			c.restored(age)
+		}
+		slog.Info("Restarted model process", "attempt", attempt, "checkpoint", path, "age", age)
+		if c.telemetry != nil {
+			go c.telemetry.RecordModelRestart(reason, attempt, age)
+		}
+		return true
+	}
+}
+
+func (c *ModelClient) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+	c.RLock()
+	conn, proc := c.conn, c.proc
+	c.RUnlock()
+	if conn != nil {
+		// Otherwise the process only exits after the current epoch
+		if _, err := c.cancelTraining(); err != nil {
+			slog.Warn("Failed to cancel training", "error", err)
+		}
+		conn.Close()
+	}
+	if proc != nil {
+		proc.cmd.Process.Signal(syscall.SIGTERM)
+		<-proc.done
+	}
+	return nil
+}
+
+// cancelTraining stops a training run that is still running in the Python
+// process, e.g. because the peer is shutting down. It returns whether a
+// training run was running.
+func (c *ModelClient) cancelTraining() (bool, error) {
+	c.RLock()
+	client := c.controlClient
+	c.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
 	defer cancel()
-	res, err := c.trainClient.Train(ctx, &TrainRequest{})
+	res, err := client.Cancel(ctx, &CancelRequest{})
 	if err != nil {
+		return false, err
+	}
+	return res.Cancelled, nil
+}
+
+// stopTraining cancels a timed out training run and blocks until the Python
+// process confirmed that it stopped, so no later operation runs alongside it.
+// If the process does not confirm within cancelTimeout, it is killed and the
+// call blocks until the supervisor started a new process.
+func (c *ModelClient) stopTraining() {
+	deadline := time.Now().Add(cancelTimeout)
+	for time.Now().Before(deadline) {
+		running, err := c.cancelTraining()
+		if err == nil && !running {
+			slog.Info("Cancelled running training")
+			return
+		}
+		if err != nil {
+			slog.Warn("Failed to cancel training", "error", err)
+		}
+		time.Sleep(cancelPoll)
+	}
+	slog.Warn("Training did not stop, killing the model process")
+	c.RLock()
+	proc := c.proc
+	c.RUnlock()
+	proc.kill()
+	for {
+		select {
+		case <-c.closing:
+			return
+		case <-time.After(cancelPoll):
+		}
+		c.RLock()
+		restarted := c.proc != proc
+		c.RUnlock()
+		if restarted {
+			return
+		}
+	}
+}
+
+func (c *ModelClient) Train(ctx context.Context, hp structs.Hyperparams) (*metrics, error) {
+	req := &TrainRequest{
+		Epochs:       int32(hp.Epochs),
+		Steps:        int32(hp.Steps),
+		LearningRate: hp.LearningRate,
+		BatchSize:    int32(hp.BatchSize),
+		Optimizer:    hp.Optimizer,
+		Momentum:     hp.Momentum,
+		WeightDecay:  hp.WeightDecay,
+	}
+
+	c.RLock()
+	client := c.trainClient
+	c.RUnlock()
+	res, err := client.Train(ctx, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			c.stopTraining()
+		}
 		return nil, fmt.Errorf("train request failed: %w", err)
 	}
 	if !res.Success {
 		return nil, fmt.Errorf("train request failed: %s", res.ErrorMessage)
 	}
-	return newMetrics(-1, res.Loss, nil)
+	met, err := newMetrics(-1, res.Loss)
+	if err != nil {
+		return nil, err
+	}
+	met.samples = int(res.NumSamples)
+	return met, nil
 }
 
-func (c *ModelClient) Eval(checkpointPath string) (*metrics, error) {
+func (c *ModelClient) Eval(ctx context.Context, checkpointPath string) (*metrics, error) {
 	req := &EvalRequest{
 		Path: checkpointPath,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	res, err := c.evalClient.Eval(ctx, req)
+	c.RLock()
+	client := c.evalClient
+	c.RUnlock()
+	res, err := client.Eval(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("eval request failed: %w", err)
 	}
 	if !res.Success {
 		return nil, fmt.Errorf("eval request failed: %s", res.ErrorMessage)
 	}
-	return newMetrics(res.Accuracy, res.Loss, res.Guesses)
+	met, err := newMetrics(res.Accuracy, res.Loss)
+	if err != nil {
+		return nil, err
+	}
+	if met.eval, err = evaluationFromResponse(res); err != nil {
+		return nil, fmt.Errorf("eval request failed: %w", err)
+	}
+	return met, nil
 }
 
-func (c *ModelClient) Apply(weights *structs.Weights, ratio float32) error {
+// Import sends the weights to the model. Large weights are streamed.
+func (c *ModelClient) Import(ctx context.Context, weights *structs.Weights, ratio float32, layers map[string]float32) error {
+	c.RLock()
+	client := c.importWeightsClient
+	c.RUnlock()
+	if len(weights.Get()) > streamThreshold {
+		if err := importStream(ctx, client, weights.Get(), ratio, layers, weights.IsFlat()); err != nil {
+			return fmt.Errorf("import weights stream failed: %w", err)
+		}
+		return nil
+	}
+
 	req := &ImportRequest{
 		Weights:     weights.Get(),
 		WeightRatio: ratio,
+		Flat:        weights.IsFlat(),
+		LayerRatios: layers,
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	res, err := c.importWeightsClient.ImportWeights(ctx, req)
+	res, err := client.ImportWeights(ctx, req)
 	if err != nil {
 		return fmt.Errorf("import weights request failed: %w", err)
 	}
@@ -81,15 +449,75 @@ func (c *ModelClient) Apply(weights *structs.Weights, ratio float32) error {
 	return nil
 }
 
-func (c *ModelClient) GetWeights() (*structs.Weights, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	res, err := c.exportWeightsClient.ExportWeights(ctx, &ExportRequest{})
+// Export fetches the weights from the model. Once the weights exceeded the
+// stream threshold, they are always streamed.
+func (c *ModelClient) Export(ctx context.Context) (*structs.Weights, error) {
+	w, _, err := c.export(ctx, nil)
+	return w, err
+}
+
+func (c *ModelClient) ExportPrivate(ctx context.Context, clipNorm, noiseMultiplier float32) (*structs.Weights, float32, error) {
+	return c.export(ctx, &PrivacyParams{ClipNorm: clipNorm, NoiseMultiplier: noiseMultiplier})
+}
+
+// export fetches the weights, streamed if they are too large for a single
+// message. The model only privatizes weights it actually returns, so a
+// private export that switches to the stream is released once.
+func (c *ModelClient) export(ctx context.Context, privacy *PrivacyParams) (*structs.Weights, float32, error) {
+	c.RLock()
+	client := c.exportWeightsClient
+	c.RUnlock()
+	flat := c.conf.SecureAggregation.Enabled
+	newWeights := structs.NewWeights
+	if flat {
+		newWeights = structs.NewRawFlatWeights
+	}
+	if !c.largeWeights.Load() {
+		res, err := client.ExportWeights(ctx, &ExportRequest{MaxSize: streamThreshold, Privacy: privacy, Flat: flat})
+		if err != nil {
+			return nil, 0, fmt.Errorf("export weights request failed: %w", err)
+		}
+		if !res.Success {
+			return nil, 0, fmt.Errorf("export weights request failed: %s", res.ErrorMessage)
+		}
+		if !res.TooLarge {
+			return newWeights(res.Weights, -1), res.UpdateNorm, nil
+		}
+		slog.Info("Switching to streamed weight transfer", "size", res.Size)
+		c.largeWeights.Store(true)
+	}
+	data, norm, err := exportStream(ctx, client, privacy, flat)
 	if err != nil {
-		return nil, fmt.Errorf("export weights request failed: %w", err)
+		return nil, 0, fmt.Errorf("export weights stream failed: %w", err)
 	}
-	if !res.Success {
-		return nil, fmt.Errorf("export weights request failed: %s", res.ErrorMessage)
+	return newWeights(data, -1), norm, nil
+}
+
+// logModelOutput forwards the stdout and stderr output of the Python process
+// to the log.
+// Lines written by the Python logging module keep their level, tracebacks are
+// logged as errors and everything else as warnings.
+func logModelOutput(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	inTraceback := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "Traceback"):
+			inTraceback = true
+			slog.Error("Model error", "text", line)
+		case inTraceback:
+			// The traceback ends with the unindented exception line
+			inTraceback = strings.HasPrefix(line, " ")
+			slog.Error("Model error", "text", line)
+		case strings.Contains(line, " - ERROR - "), strings.Contains(line, " - CRITICAL - "):
+			slog.Error("Model error", "text", line)
+		case strings.Contains(line, " - INFO - "):
+			slog.Info("Model output", "text", line)
+		case strings.Contains(line, " - DEBUG - "):
+			slog.Debug("Model output", "text", line)
+		default:
+			slog.Warn("Model warning", "text", line)
+		}
 	}
-	return structs.NewWeights(res.Weights, -1), nil
 }
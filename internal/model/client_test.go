@@ -0,0 +1,35 @@
+package model
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessExitIsBroadcast(t *testing.T) {
+	// prepare
+	proc, err := startProcess(exec.Command("sh", "-c", "echo out; echo err >&2; exit 3"))
+	require.NoError(t, err)
+
+	// run
+	waiters := make(chan error, 2)
+	for range 2 {
+		go func() {
+			<-proc.done
+			waiters <- proc.err
+		}()
+	}
+
+	// verify
+	for range 2 {
+		select {
+		case err := <-waiters:
+			assert.Error(t, err, "every waiter should see the exit status")
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiter did not see the process exit")
+		}
+	}
+}
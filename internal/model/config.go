@@ -1,20 +1,72 @@
 package model
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"time"
 
 	"github.com/google/shlex"
+	"github.com/vs-ude/btml/internal/privacy"
+	"github.com/vs-ude/btml/internal/secagg"
+	"github.com/vs-ude/btml/internal/structs"
 )
 
 type Config struct {
 	Name          string
+	Backend       string // BackendPython or BackendGo
 	PythonRuntime string
 	ModelArgs     []string
 	DataPath      string
 	LogPath       string
 	Dataset       string
+	DatasetFormat string              // Loader of the Python model, empty selects its default
+	Architecture  string              // Empty selects the default of the backend
+	Training      structs.Hyperparams // Defaults for every training run
+	MergePolicy   string              // Name of the MergePolicy, empty selects MergeAge
+	Apply         ApplyConfig
+	Privacy       privacy.Config // Differential privacy of sent weights
+	Sharing       structs.SharingPolicy
+	// Weights are exported as flat vectors, so they can be masked
+	SecureAggregation secagg.Config
+	Timeouts          Timeouts
+	// Number of latest checkpoints to keep in addition to the best one, any
+	// value < 1 means keep all
+	KeepCheckpoints int
+	Resume          bool   // Continue from the latest checkpoint
+	RunID           string // Identifies the run of the checkpoints, empty uses the name
+}
+
+// Timeouts limit the duration of single model operations. Any value < 1
+// means no timeout.
+type Timeouts struct {
+	Train  time.Duration
+	Eval   time.Duration
+	Import time.Duration
+	Export time.Duration
+}
+
+// ApplyConfig selects and configures the ApplyStrategy.
+type ApplyConfig struct {
+	Strategy        string  // ApplySimple, ApplyNaive or ApplyBuffered
+	ChangeThreshold float32 // Minimum change in loss that changes the score of the source
+	BufferSize      int     // Updates per batch of ApplyBuffered
+	BufferTimeout   time.Duration
+}
+
+// GetArchitecture returns the configured architecture ID or the default of
+// the backend.
+func (c *Config) GetArchitecture() string {
+	if c.Architecture != "" {
+		return c.Architecture
+	}
+	if c.Backend == BackendGo {
+		return ArchitectureSoftmax
+	}
+	return ArchitectureCNN
 }
 
 func (c *Config) GetTrainDataPath() string {
@@ -26,29 +78,107 @@ func (c *Config) GetTestDataPath() string {
 }
 
 func (c *Config) GetCheckpointPath() string {
-	return path.Clean(fmt.Sprintf("%s/checkpoints/%s_%s", c.DataPath, c.Dataset, c.Name))
+	return path.Clean(fmt.Sprintf("%s/checkpoints/%s_%s", c.DataPath, c.Dataset, cmp.Or(c.RunID, c.Name)))
+}
+
+// FromEnv returns the default config with the overrides of the environment.
+func FromEnv() (*Config, error) {
+	c := DefaultConfig()
+	return c, c.ApplyEnv()
+}
+
+// DefaultConfig returns the config used if nothing else is configured.
+func DefaultConfig() *Config {
+	return &Config{
+		Name:            "0",
+		Backend:         BackendPython,
+		PythonRuntime:   ".venv/bin/python3",
+		ModelArgs:       []string{"model/main.py"},
+		DataPath:        "model/data",
+		LogPath:         "logs",
+		Dataset:         "fMNIST",
+		KeepCheckpoints: 5,
+		Apply: ApplyConfig{
+			Strategy:        ApplySimple,
+			ChangeThreshold: 0.005,
+			BufferSize:      5,
+			BufferTimeout:   time.Second * 30,
+		},
+		Timeouts: Timeouts{
+			Train:  time.Minute * 10,
+			Eval:   time.Minute * 2,
+			Import: time.Minute,
+			Export: time.Minute,
+		},
+	}
 }
 
-func FromEnv() *Config {
-	line := os.Getenv("PYTHON_MODEL_LINE")
-	c := &Config{
-		Name:          "0",
-		PythonRuntime: ".venv/bin/python3",
-		ModelArgs:     []string{"model/main.py"},
-		DataPath:      "model/data",
-		LogPath:       "logs",
-		Dataset:       "fMNIST",
+// ApplyEnv overrides the config with the MODEL_* and PYTHON_MODEL_LINE
+// environment variables that are set. Values that cannot be parsed are
+// returned as errors and keep the config unchanged.
+func (c *Config) ApplyEnv() error {
+	var errs []error
+	if b := os.Getenv("MODEL_BACKEND"); b != "" {
+		c.Backend = b
+	}
+	if p := os.Getenv("MODEL_MERGE_POLICY"); p != "" {
+		c.MergePolicy = p
+	}
+	if r := os.Getenv("MODEL_RUN_ID"); r != "" {
+		c.RunID = r
+	}
+	if s := os.Getenv("MODEL_APPLY_STRATEGY"); s != "" {
+		c.Apply.Strategy = s
+	}
+	for env, n := range map[string]*int{
+		"MODEL_BUFFER_SIZE":      &c.Apply.BufferSize,
+		"MODEL_KEEP_CHECKPOINTS": &c.KeepCheckpoints,
+	} {
+		if v := os.Getenv(env); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error parsing %s: %w", env, err))
+				continue
+			}
+			*n = i
+		}
 	}
-	if line != "" {
+	if t := os.Getenv("MODEL_CHANGE_THRESHOLD"); t != "" {
+		if f, err := strconv.ParseFloat(t, 32); err == nil {
+			c.Apply.ChangeThreshold = float32(f)
+		} else {
+			errs = append(errs, fmt.Errorf("error parsing MODEL_CHANGE_THRESHOLD: %w", err))
+		}
+	}
+	for env, timeout := range map[string]*time.Duration{
+		"MODEL_TRAIN_TIMEOUT":  &c.Timeouts.Train,
+		"MODEL_EVAL_TIMEOUT":   &c.Timeouts.Eval,
+		"MODEL_IMPORT_TIMEOUT": &c.Timeouts.Import,
+		"MODEL_EXPORT_TIMEOUT": &c.Timeouts.Export,
+		"MODEL_BUFFER_TIMEOUT": &c.Apply.BufferTimeout,
+	} {
+		if v := os.Getenv(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error parsing %s: %w", env, err))
+				continue
+			}
+			*timeout = d
+		}
+	}
+	if line := os.Getenv("PYTHON_MODEL_LINE"); line != "" {
 		f, err := shlex.Split(line)
-		if err != nil {
-			fmt.Printf("Error splitting PYTHON_MODEL_LINE: %v\n", err)
-			return c
+		if err == nil && len(f) == 0 {
+			err = errors.New("no command")
 		}
-		c.PythonRuntime = f[0]
-		if len(f) > 1 {
-			c.ModelArgs = f[1:]
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error splitting PYTHON_MODEL_LINE: %w", err))
+		} else {
+			c.PythonRuntime = f[0]
+			if len(f) > 1 {
+				c.ModelArgs = f[1:]
+			}
 		}
 	}
-	return c
+	return errors.Join(errs...)
 }
@@ -2,19 +2,22 @@ package model
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/vs-ude/btml/internal/telemetry"
 )
 
 type metrics struct {
 	acc, loss float32
 	age       int
-	guesses   map[int32]float32
+	samples   int         // Size of the training set, only set by training
+	eval      *evaluation // Only set by evaluations
 }
 
-func newMetrics(acc, loss float32, guesses map[int32]float32) (*metrics, error) {
+func newMetrics(acc, loss float32) (*metrics, error) {
 	return &metrics{
-		acc:     acc,
-		loss:    loss,
-		guesses: guesses,
+		acc:  acc,
+		loss: loss,
 	}, nil
 }
 
@@ -35,3 +38,139 @@ func (m *metrics) getLoss() (float32, error) {
 func (m *metrics) getAge() int {
 	return m.age
 }
+
+// evaluation holds the per class results of an evaluation.
+type evaluation struct {
+	confusion        [][]int // Rows are true labels, columns predictions
+	precision        []float32
+	recall           []float32
+	f1               []float32
+	calibrationError float32
+}
+
+// newEvaluation derives precision, recall and F1 of every class from the
+// confusion matrix. Classes without samples or predictions score 0.
+func newEvaluation(confusion [][]int, calibrationError float32) *evaluation {
+	n := len(confusion)
+	e := &evaluation{
+		confusion:        confusion,
+		precision:        make([]float32, n),
+		recall:           make([]float32, n),
+		f1:               make([]float32, n),
+		calibrationError: calibrationError,
+	}
+	for k := range n {
+		tp := confusion[k][k]
+		support, predicted := e.support(k), e.predicted(k)
+		if predicted > 0 {
+			e.precision[k] = float32(tp) / float32(predicted)
+		}
+		if support > 0 {
+			e.recall[k] = float32(tp) / float32(support)
+		}
+		if e.precision[k]+e.recall[k] > 0 {
+			e.f1[k] = 2 * e.precision[k] * e.recall[k] / (e.precision[k] + e.recall[k])
+		}
+	}
+	return e
+}
+
+// evaluationFromResponse checks and converts the flat confusion matrix and
+// the per class scores of an EvalResponse.
+func evaluationFromResponse(res *EvalResponse) (*evaluation, error) {
+	n := int(res.NumClasses)
+	if n == 0 {
+		return nil, nil
+	}
+	if len(res.Confusion) != n*n || len(res.Precision) != n || len(res.Recall) != n || len(res.F1) != n {
+		return nil, fmt.Errorf("evaluation results do not match %d classes", n)
+	}
+	confusion := make([][]int, n)
+	for k := range confusion {
+		confusion[k] = make([]int, n)
+		for j, v := range res.Confusion[k*n : (k+1)*n] {
+			confusion[k][j] = int(v)
+		}
+	}
+	return &evaluation{
+		confusion:        confusion,
+		precision:        res.Precision,
+		recall:           res.Recall,
+		f1:               res.F1,
+		calibrationError: res.CalibrationError,
+	}, nil
+}
+
+// support returns the number of samples labeled as class k.
+func (e *evaluation) support(k int) int {
+	sum := 0
+	for _, v := range e.confusion[k] {
+		sum += v
+	}
+	return sum
+}
+
+// predicted returns the number of samples predicted as class k.
+func (e *evaluation) predicted(k int) int {
+	sum := 0
+	for _, row := range e.confusion {
+		sum += row[k]
+	}
+	return sum
+}
+
+// macroF1 returns the unweighted mean of the per class F1 scores.
+func (e *evaluation) macroF1() float32 {
+	if len(e.f1) == 0 {
+		return 0
+	}
+	var sum float32
+	for _, f := range e.f1 {
+		sum += f
+	}
+	return sum / float32(len(e.f1))
+}
+
+func (e *evaluation) classes() []telemetry.ClassEvaluation {
+	classes := make([]telemetry.ClassEvaluation, len(e.confusion))
+	for k := range classes {
+		classes[k] = telemetry.ClassEvaluation{
+			Precision: e.precision[k],
+			Recall:    e.recall[k],
+			F1:        e.f1[k],
+			Support:   e.support(k),
+			Predicted: e.predicted(k),
+			Confusion: e.confusion[k],
+		}
+	}
+	return classes
+}
+
+// calibrationError computes the expected calibration error, i.e. the mean
+// difference between confidence and accuracy over equally wide confidence
+// bins, weighted by the number of predictions in each bin.
+func calibrationError(confidence []float32, correct []bool, bins int) float32 {
+	if len(confidence) == 0 {
+		return 0
+	}
+	count := make([]int, bins)
+	conf := make([]float64, bins)
+	hits := make([]int, bins)
+	for i, c := range confidence {
+		b := min(int(c*float32(bins)), bins-1)
+		count[b]++
+		conf[b] += float64(c)
+		if correct[i] {
+			hits[b]++
+		}
+	}
+	var ece float64
+	for b := range bins {
+		if count[b] == 0 {
+			continue
+		}
+		gap := conf[b]/float64(count[b]) - float64(hits[b])/float64(count[b])
+		ece += float64(count[b]) / float64(len(confidence)) * max(gap, -gap)
+	}
+	return float32(ece)
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEvaluation(t *testing.T) {
+	// prepare
+	confusion := [][]int{
+		{3, 1, 0},
+		{0, 2, 2},
+		{0, 0, 0},
+	}
+
+	// run
+	e := newEvaluation(confusion, 0)
+
+	// verify
+	assert.Equal(t, []float32{1, 2.0 / 3, 0}, e.precision)
+	assert.Equal(t, []float32{0.75, 0.5, 0}, e.recall)
+	assert.InDelta(t, 2*0.75/1.75, e.f1[0], 1e-6)
+	assert.Equal(t, float32(0), e.f1[2], "classes without samples should score 0")
+	assert.Equal(t, 4, e.support(1))
+	assert.Equal(t, 2, e.predicted(2))
+}
+
+func TestCalibrationError(t *testing.T) {
+	// prepare
+	confidence := []float32{0.95, 0.95, 0.55, 0.55}
+	correct := []bool{true, true, true, false}
+
+	// run
+	ece := calibrationError(confidence, correct, 10)
+
+	// verify
+	// Both bins are off by 0.05 and contain half of the predictions
+	assert.InDelta(t, 0.05, ece, 1e-6)
+	assert.Zero(t, calibrationError(nil, nil, 10))
+}
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+)
+
+// SyntheticDataset is the dataset name that makes the Go backend generate
+// its data instead of reading IDX files.
+const SyntheticDataset = "synthetic"
+
+const (
+	syntheticFeatures = 32
+	syntheticClasses  = 10
+	syntheticTrain    = 2000
+	syntheticTest     = 500
+	syntheticSeed     = 42 // Shared by all peers so they learn the same task
+	idxMaxTrain       = 6000
+	idxMaxTest        = 1000
+)
+
+type dataset struct {
+	x        [][]float32
+	y        []int
+	features int
+	classes  int
+}
+
+// syntheticData generates gaussian clusters around class centers. The centers
+// are the same for all peers, the samples depend on the given seed.
+func syntheticData(seed uint64) (train, test *dataset) {
+	centers := make([][]float32, syntheticClasses)
+	crng := rand.New(rand.NewPCG(syntheticSeed, 0))
+	for k := range centers {
+		centers[k] = make([]float32, syntheticFeatures)
+		for j := range centers[k] {
+			centers[k][j] = float32(crng.NormFloat64())
+		}
+	}
+	rng := rand.New(rand.NewPCG(seed, 2))
+	generate := func(n int) *dataset {
+		d := &dataset{features: syntheticFeatures, classes: syntheticClasses}
+		for range n {
+			y := rng.IntN(syntheticClasses)
+			x := make([]float32, syntheticFeatures)
+			for j := range x {
+				x[j] = centers[y][j] + float32(rng.NormFloat64())
+			}
+			d.x = append(d.x, x)
+			d.y = append(d.y, y)
+		}
+		return d
+	}
+	return generate(syntheticTrain), generate(syntheticTest)
+}
+
+// idxData reads the (fashion) MNIST IDX files from dir. Every peer uses a
+// random subset of the samples, based on the given seed.
+func idxData(dir string, seed uint64) (train, test *dataset, err error) {
+	rng := rand.New(rand.NewPCG(seed, 3))
+	train, err = readIDXPair(
+		filepath.Join(dir, "train-images-idx3-ubyte"),
+		filepath.Join(dir, "train-labels-idx1-ubyte"),
+		idxMaxTrain, rng)
+	if err != nil {
+		return nil, nil, err
+	}
+	test, err = readIDXPair(
+		filepath.Join(dir, "t10k-images-idx3-ubyte"),
+		filepath.Join(dir, "t10k-labels-idx1-ubyte"),
+		idxMaxTest, rng)
+	if err != nil {
+		return nil, nil, err
+	}
+	return train, test, nil
+}
+
+func readIDXPair(imagePath, labelPath string, limit int, rng *rand.Rand) (*dataset, error) {
+	images, dims, err := readIDX(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	labels, _, err := readIDX(labelPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(dims) < 2 || int(dims[0]) != len(labels) {
+		return nil, fmt.Errorf("%s and %s do not match", imagePath, labelPath)
+	}
+	features := len(images) / len(labels)
+	d := &dataset{features: features}
+	for _, i := range rng.Perm(len(labels))[:min(limit, len(labels))] {
+		x := make([]float32, features)
+		for j, v := range images[i*features : (i+1)*features] {
+			x[j] = float32(v) / 255
+		}
+		d.x = append(d.x, x)
+		d.y = append(d.y, int(labels[i]))
+		d.classes = max(d.classes, int(labels[i])+1)
+	}
+	return d, nil
+}
+
+// readIDX reads an unsigned byte IDX file and returns the raw data and the
+// dimensions.
+func readIDX(p string) ([]byte, []uint32, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return nil, nil, fmt.Errorf("unable to read IDX header of %s: %w", p, err)
+	}
+	if header[0] != 0 || header[1] != 0 || header[2] != 0x08 {
+		return nil, nil, errors.New("only unsigned byte IDX files are supported")
+	}
+	dims := make([]uint32, header[3])
+	if err = binary.Read(f, binary.BigEndian, dims); err != nil {
+		return nil, nil, fmt.Errorf("unable to read IDX dimensions of %s: %w", p, err)
+	}
+	size := 1
+	for _, d := range dims {
+		size *= int(d)
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(f, data); err != nil {
+		return nil, nil, fmt.Errorf("unable to read IDX data of %s: %w", p, err)
+	}
+	return data, dims, nil
+}
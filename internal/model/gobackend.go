@@ -0,0 +1,392 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+// Type checks
+var _ Backend = &GoBackend{}
+
+const (
+	goLearningRate = 0.05
+	goBatchSize    = 32
+	// Number of confidence bins for the calibration error, matches the
+	// Python model
+	calibrationBins = 10
+)
+
+// GoBackend is a softmax regression model implemented in pure Go. It trains on
+// synthetic data or IDX files (as used by (fashion) MNIST) and does not need
+// Python, which makes it useful to simulate whole swarms.
+type GoBackend struct {
+	conf     *Config
+	features int
+	classes  int
+	weights  []float32 // classes x features, row major
+	bias     []float32
+	velocity []float32 // Momentum buffer for weights followed by bias
+	released []float32 // Weights followed by bias of the last private export
+	train    *dataset
+	test     *dataset
+	rng      *rand.Rand
+}
+
+func NewGoBackend(c *Config) *GoBackend {
+	return &GoBackend{
+		conf: c,
+		rng:  rand.New(rand.NewPCG(nameSeed(c.Name), 1)),
+	}
+}
+
+func (g *GoBackend) Start() error {
+	if a := g.conf.GetArchitecture(); a != ArchitectureSoftmax {
+		return fmt.Errorf("architecture %q is not supported by the go backend", a)
+	}
+	var err error
+	if g.conf.Dataset == SyntheticDataset {
+		g.train, g.test = syntheticData(nameSeed(g.conf.Name))
+	} else {
+		g.train, g.test, err = idxData(filepath.Join(g.conf.DataPath, g.conf.Dataset), nameSeed(g.conf.Name))
+		if err != nil {
+			return fmt.Errorf("failed to load IDX data: %w", err)
+		}
+	}
+	g.features = g.train.features
+	g.classes = max(g.train.classes, g.test.classes)
+	g.weights = make([]float32, g.features*g.classes)
+	g.bias = make([]float32, g.classes)
+	slog.Info("Go model is set up", "dataset", g.conf.Dataset, "train_samples", len(g.train.y), "test_samples", len(g.test.y), "features", g.features, "classes", g.classes)
+	return nil
+}
+
+func (g *GoBackend) Close() error {
+	return nil
+}
+
+// Train runs mini-batch SGD, by default for one epoch. Only the "sgd"
+// optimizer is supported.
+func (g *GoBackend) Train(ctx context.Context, hp structs.Hyperparams) (*metrics, error) {
+	if g.train == nil || len(g.train.y) == 0 {
+		return nil, errors.New("no training data")
+	}
+	hp = structs.Hyperparams{
+		Epochs:       1,
+		LearningRate: goLearningRate,
+		BatchSize:    goBatchSize,
+		Optimizer:    "sgd",
+	}.Merge(hp)
+	if hp.Optimizer != "sgd" {
+		return nil, fmt.Errorf("optimizer %q is not supported by the go backend", hp.Optimizer)
+	}
+	if hp.Epochs < 0 || hp.Steps < 0 || hp.BatchSize < 0 || hp.LearningRate < 0 {
+		return nil, errors.New("hyperparameters must not be negative")
+	}
+	if hp.Momentum != 0 && g.velocity == nil {
+		g.velocity = make([]float32, len(g.weights)+len(g.bias))
+	}
+	gradW := make([]float32, len(g.weights))
+	gradB := make([]float32, len(g.bias))
+	probs := make([]float32, g.classes)
+	var total float64
+	samples, steps := 0, 0
+	for range hp.Epochs {
+		order := g.rng.Perm(len(g.train.y))
+		for start := 0; start < len(order); start += hp.BatchSize {
+			if hp.Steps > 0 && steps >= hp.Steps {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			end := min(start+hp.BatchSize, len(order))
+			clear(gradW)
+			clear(gradB)
+			for _, i := range order[start:end] {
+				x, y := g.train.x[i], g.train.y[i]
+				total += g.forward(x, y, probs)
+				for k := range g.classes {
+					d := probs[k]
+					if k == y {
+						d -= 1
+					}
+					gradB[k] += d
+					row := gradW[k*g.features : (k+1)*g.features]
+					for j, v := range x {
+						row[j] += d * v
+					}
+				}
+			}
+			g.step(hp, gradW, gradB, float32(end-start))
+			samples += end - start
+			steps++
+		}
+	}
+	if samples == 0 {
+		return nil, errors.New("no training steps were run")
+	}
+	met, err := newMetrics(-1, float32(total/float64(samples)))
+	if err != nil {
+		return nil, err
+	}
+	met.samples = len(g.train.y)
+	return met, nil
+}
+
+// step applies the summed gradients of a batch of the given size.
+func (g *GoBackend) step(hp structs.Hyperparams, gradW, gradB []float32, size float32) {
+	update := func(params, grads, velocity []float32) {
+		for i := range params {
+			d := grads[i]/size + hp.WeightDecay*params[i]
+			if velocity != nil {
+				velocity[i] = hp.Momentum*velocity[i] + d
+				d = velocity[i]
+			}
+			params[i] -= hp.LearningRate * d
+		}
+	}
+	if hp.Momentum != 0 {
+		update(g.weights, gradW, g.velocity[:len(g.weights)])
+		update(g.bias, gradB, g.velocity[len(g.weights):])
+	} else {
+		update(g.weights, gradW, nil)
+		update(g.bias, gradB, nil)
+	}
+}
+
+// Eval evaluates the model on the test data and stores a checkpoint at
+// `<checkpointPath>.tensors` unless the path is empty.
+func (g *GoBackend) Eval(ctx context.Context, checkpointPath string) (*metrics, error) {
+	if g.test == nil || len(g.test.y) == 0 {
+		return nil, errors.New("no test data")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	probs := make([]float32, g.classes)
+	confusion := make([][]int, g.classes)
+	for k := range confusion {
+		confusion[k] = make([]int, g.classes)
+	}
+	confidence := make([]float32, len(g.test.y))
+	hits := make([]bool, len(g.test.y))
+	var total float64
+	correct := 0
+	for i, x := range g.test.x {
+		total += g.forward(x, g.test.y[i], probs)
+		pred := argmax(probs)
+		confusion[g.test.y[i]][pred]++
+		confidence[i] = probs[pred]
+		hits[i] = pred == g.test.y[i]
+		if hits[i] {
+			correct++
+		}
+	}
+	size := float32(len(g.test.y))
+	if checkpointPath != "" {
+		if err := g.checkpoint(checkpointPath + checkpointExt); err != nil {
+			return nil, err
+		}
+	}
+	met, err := newMetrics(float32(correct)/size, float32(total/float64(size)))
+	if err != nil {
+		return nil, err
+	}
+	met.eval = newEvaluation(confusion, calibrationError(confidence, hits, calibrationBins))
+	return met, nil
+}
+
+func (g *GoBackend) Import(ctx context.Context, weights *structs.Weights, ratio float32, layers map[string]float32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ratio < 0 || ratio > 1 {
+		return errors.New("weight ratio must be between 0 and 1")
+	}
+	for name, r := range layers {
+		if r < 0 || r > 1 {
+			return fmt.Errorf("weight ratio of %q must be between 0 and 1", name)
+		}
+	}
+	in, err := g.decode(weights)
+	if err != nil {
+		return err
+	}
+	for name, params := range g.params() {
+		values, ok := in[name]
+		if !ok {
+			continue
+		}
+		r := ratio
+		if lr, ok := layers[name]; ok {
+			r = lr
+		}
+		for i := range params {
+			params[i] = (1-r)*params[i] + r*values[i]
+		}
+	}
+	return nil
+}
+
+// params returns the parameters of the model by tensor name.
+func (g *GoBackend) params() map[string][]float32 {
+	return map[string][]float32{"weight": g.weights, "bias": g.bias}
+}
+
+// decode returns the values of flat or serialized weights by tensor name.
+// Serialized weights may lack tensors.
+func (g *GoBackend) decode(weights *structs.Weights) (map[string][]float32, error) {
+	if weights.IsFlat() {
+		v, err := weights.Floats()
+		if err != nil {
+			return nil, err
+		}
+		if len(v) != len(g.weights)+len(g.bias) {
+			return nil, fmt.Errorf("flat weights have %d values, expected %d", len(v), len(g.weights)+len(g.bias))
+		}
+		return map[string][]float32{"weight": v[:len(g.weights)], "bias": v[len(g.weights):]}, nil
+	}
+	tm, err := weights.Tensors()
+	if err != nil {
+		return nil, err
+	}
+	if err = tm.CheckPartialLayout(g.layout()); err != nil {
+		return nil, fmt.Errorf("weights do not match the model: %w", err)
+	}
+	v, err := structs.NewTensorView(tm)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]float32, len(v.Layers()))
+	for _, l := range v.Layers() {
+		values[l.Name] = l.Values
+	}
+	return values, nil
+}
+
+// layout returns the tensors of the model without data. The names match a
+// torch linear layer.
+func (g *GoBackend) layout() *structs.TensorMap {
+	return &structs.TensorMap{Tensors: []*structs.Tensor{
+		{Name: "weight", Dtype: structs.DType_FLOAT32, Shape: []int64{int64(g.classes), int64(g.features)}},
+		{Name: "bias", Dtype: structs.DType_FLOAT32, Shape: []int64{int64(g.classes)}},
+	}}
+}
+
+func (g *GoBackend) Export(ctx context.Context) (*structs.Weights, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return g.encode(g.weights, g.bias)
+}
+
+func (g *GoBackend) ExportPrivate(ctx context.Context, clipNorm, noiseMultiplier float32) (*structs.Weights, float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	params := slices.Concat(g.weights, g.bias)
+	if g.released == nil {
+		// The weights are initialized with zeros
+		g.released = make([]float32, len(params))
+	}
+	var sum float64
+	for i := range params {
+		params[i] -= g.released[i]
+		sum += float64(params[i]) * float64(params[i])
+	}
+	norm := float32(math.Sqrt(sum))
+	scale := float32(1)
+	if norm > clipNorm {
+		scale = clipNorm / norm
+	}
+	sigma := float64(noiseMultiplier * clipNorm)
+	for i, d := range params {
+		// Not seeded, unlike the training, the noise must not be predictable
+		g.released[i] += d*scale + float32(rand.NormFloat64()*sigma)
+	}
+	w, err := g.encode(g.released[:len(g.weights)], g.released[len(g.weights):])
+	return w, norm, err
+}
+
+// encode serializes the weights, or returns them flat with secure
+// aggregation.
+func (g *GoBackend) encode(weights, bias []float32) (*structs.Weights, error) {
+	if g.conf.SecureAggregation.Enabled {
+		return structs.NewFlatWeights(slices.Concat(weights, bias), -1), nil
+	}
+	return g.serialize(weights, bias)
+}
+
+func (g *GoBackend) serialize(weights, bias []float32) (*structs.Weights, error) {
+	tm := g.layout()
+	tm.Tensors[0] = structs.NewFloat32Tensor("weight", tm.Tensors[0].Shape, weights)
+	tm.Tensors[1] = structs.NewFloat32Tensor("bias", tm.Tensors[1].Shape, bias)
+	return structs.NewTensorWeights(tm, -1)
+}
+
+func (g *GoBackend) checkpoint(p string) error {
+	w, err := g.serialize(g.weights, g.bias)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	if err = os.WriteFile(p, w.Get(), 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	slog.Debug("Saved model checkpoint", "path", p)
+	return nil
+}
+
+// forward computes the class probabilities for x into probs and returns the
+// cross entropy loss for the label y.
+func (g *GoBackend) forward(x []float32, y int, probs []float32) float64 {
+	maxLogit := float32(math.Inf(-1))
+	for k := range g.classes {
+		row := g.weights[k*g.features : (k+1)*g.features]
+		z := g.bias[k]
+		for j, v := range x {
+			z += row[j] * v
+		}
+		probs[k] = z
+		maxLogit = max(maxLogit, z)
+	}
+	var sum float64
+	for k := range probs {
+		e := math.Exp(float64(probs[k] - maxLogit))
+		probs[k] = float32(e)
+		sum += e
+	}
+	for k := range probs {
+		probs[k] = float32(float64(probs[k]) / sum)
+	}
+	return -math.Log(max(float64(probs[y]), 1e-12))
+}
+
+func argmax(v []float32) int {
+	best := 0
+	for i := range v {
+		if v[i] > v[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// nameSeed derives a stable random seed from the peer name.
+func nameSeed(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
@@ -0,0 +1,136 @@
+package model
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func newTestGoBackend(t *testing.T, name string) *GoBackend {
+	g := NewGoBackend(&Config{Name: name, Backend: BackendGo, Dataset: SyntheticDataset})
+	require.NoError(t, g.Start())
+	return g
+}
+
+func TestGoBackendLearns(t *testing.T) {
+	// prepare
+	ctx := context.Background()
+	g := newTestGoBackend(t, "1")
+	before, err := g.Eval(ctx, "")
+	require.NoError(t, err)
+
+	// run
+	for range 3 {
+		_, err = g.Train(ctx, structs.Hyperparams{})
+		require.NoError(t, err)
+	}
+	after, err := g.Eval(ctx, filepath.Join(t.TempDir(), "1"))
+
+	// verify
+	require.NoError(t, err)
+	assert.Less(t, after.loss, before.loss, "training should reduce the loss")
+	assert.Greater(t, after.acc, float32(0.8), "synthetic data should be easy to learn")
+}
+
+func TestGoBackendImportExport(t *testing.T) {
+	// prepare
+	ctx := context.Background()
+	a := newTestGoBackend(t, "a")
+	b := newTestGoBackend(t, "b")
+	a.Train(ctx, structs.Hyperparams{})
+	w, err := a.Export(ctx)
+	require.NoError(t, err)
+
+	// run
+	err = b.Import(ctx, w, 1, nil)
+
+	// verify
+	require.NoError(t, err)
+	assert.Equal(t, a.weights, b.weights, "ratio 1 should copy the weights")
+	assert.Error(t, b.Import(ctx, w, 2, nil), "ratios above 1 should be rejected")
+}
+
+func TestGoBackendImportMixes(t *testing.T) {
+	// prepare
+	ctx := context.Background()
+	a := newTestGoBackend(t, "a")
+	b := newTestGoBackend(t, "b")
+	a.bias[0] = 2
+	w, _ := a.Export(ctx)
+
+	// run
+	err := b.Import(ctx, w, 0.25, nil)
+
+	// verify
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, b.bias[0], 1e-6)
+}
+
+func TestGoBackendHyperparams(t *testing.T) {
+	// prepare
+	ctx := context.Background()
+	a := newTestGoBackend(t, "a")
+	b := newTestGoBackend(t, "a")
+
+	// run
+	_, err := a.Train(ctx, structs.Hyperparams{Steps: 1, BatchSize: 8, Momentum: 0.9})
+	require.NoError(t, err)
+	_, err = b.Train(ctx, structs.Hyperparams{Optimizer: "adam"})
+
+	// verify
+	assert.Error(t, err, "the go backend only supports sgd")
+	assert.Equal(t, b.weights, make([]float32, len(b.weights)), "failed training should not modify the weights")
+	assert.NotEqual(t, a.weights, b.weights, "a single step should modify the weights")
+}
+
+func TestGoBackendTrainCancelled(t *testing.T) {
+	// prepare
+	g := newTestGoBackend(t, "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// run
+	_, err := g.Train(ctx, structs.Hyperparams{})
+
+	// verify
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, g.weights, make([]float32, len(g.weights)), "cancelled training should not modify the weights")
+}
+
+func TestGoBackendArchitecture(t *testing.T) {
+	// prepare
+	g := NewGoBackend(&Config{Name: "a", Backend: BackendGo, Dataset: SyntheticDataset, Architecture: ArchitectureCNN})
+
+	// run
+	err := g.Start()
+
+	// verify
+	assert.ErrorContains(t, err, ArchitectureCNN)
+}
+
+func TestGoBackendExportPrivateClips(t *testing.T) {
+	// prepare
+	ctx := context.Background()
+	g := newTestGoBackend(t, "a")
+	_, err := g.Train(ctx, structs.Hyperparams{})
+	require.NoError(t, err)
+
+	// run
+	_, norm, err := g.ExportPrivate(ctx, 0.1, 0)
+
+	// verify
+	require.NoError(t, err)
+	assert.Greater(t, norm, float32(0.1), "training should change the weights by more than the bound")
+	var sum float64
+	for _, v := range g.released {
+		sum += float64(v) * float64(v)
+	}
+	assert.InDelta(t, 0.1, math.Sqrt(sum), 1e-4, "the released change should be clipped")
+	assert.NotEqual(t, g.released, slices.Concat(g.weights, g.bias), "the model itself should not be clipped")
+}
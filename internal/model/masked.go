@@ -0,0 +1,191 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/vs-ude/btml/internal/secagg"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+var _ ApplyStrategy = &MaskedStrategy{}
+
+// SeedSource provides the seeds of masks that do not cancel in the sum of
+// the updates of a round.
+type SeedSource interface {
+	// Name returns the name of this peer.
+	Name() string
+	// Seed returns the seed of a pair that includes this peer.
+	Seed(pair secagg.Pair, round int64) (secagg.Seed, error)
+	// Recover reconstructs the seed of a residual mask of other peers from
+	// the shares of the holders.
+	Recover(ctx context.Context, r secagg.Residual, round int64, holders []string, threshold int) (secagg.Seed, error)
+	// RecoverSelf reconstructs the seed of the self mask of the source from
+	// the shares of the holders.
+	RecoverSelf(ctx context.Context, source string, round int64, holders []string, threshold int) (secagg.Seed, error)
+}
+
+// Collects the masked updates of every secure aggregation round and applies
+// their average once the round is over. The masks of peers that did not send
+// an update and the self masks of the peers that did are removed with the
+// seeds recovered from their shares. Rounds with too few updates are
+// discarded, so no single update is revealed.
+type MaskedStrategy struct {
+	model           *Model
+	conf            secagg.Config
+	seeds           SeedSource
+	changeThreshold float32
+}
+
+func NewMaskedStrategy(model *Model, conf secagg.Config, seeds SeedSource, changeThreshold float32) *MaskedStrategy {
+	return &MaskedStrategy{
+		model:           model,
+		conf:            conf,
+		seeds:           seeds,
+		changeThreshold: changeThreshold,
+	}
+}
+
+func (ms *MaskedStrategy) SetModel(model *Model) {
+	ms.model = model
+}
+
+func (ms *MaskedStrategy) Start(ctx context.Context, weightsChan <-chan *WeightsWithCallback) error {
+	if ms.conf.Round <= 0 {
+		return fmt.Errorf("invalid secure aggregation round %s", ms.conf.Round)
+	}
+	go func() {
+		rounds := make(map[int64]map[string]*WeightsWithCallback)
+		ticker := time.NewTicker(ms.conf.Round / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case weights, ok := <-weightsChan:
+				if !ok {
+					return
+				}
+				u := weights.GetMasked()
+				if u == nil {
+					slog.Warn("Ignoring update without mask", "source", weights.GetSource())
+					continue
+				}
+				if ms.conf.Closed(u.Round, time.Now()) {
+					slog.Info("Ignoring masked update of a past round", "source", u.Source, "round", u.Round)
+					continue
+				}
+				if rounds[u.Round] == nil {
+					rounds[u.Round] = make(map[string]*WeightsWithCallback)
+				}
+				// The masks of two updates of a source would not cancel
+				rounds[u.Round][u.Source] = weights
+			case now := <-ticker.C:
+				for _, round := range slices.Sorted(maps.Keys(rounds)) {
+					if !ms.conf.Closed(round, now) {
+						break
+					}
+					ms.aggregate(ctx, round, slices.Collect(maps.Values(rounds[round])))
+					delete(rounds, round)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (ms *MaskedStrategy) aggregate(ctx context.Context, round int64, batch []*WeightsWithCallback) {
+	if len(batch) < max(ms.conf.MinUpdates, 2) {
+		slog.Info("Discarding secure aggregation round with too few updates", "round", round, "updates", len(batch))
+		return
+	}
+	updates := make([]*secagg.Update, len(batch))
+	var age, samples int
+	var trust float32
+	lineage := &structs.Lineage{}
+	for i, w := range batch {
+		updates[i] = w.GetMasked()
+		age += w.GetAge()
+		samples += w.GetSamples()
+		trust += w.GetTrust()
+		if l := w.GetLineage(); l != nil {
+			lineage.Parents = append(lineage.Parents, l.Hash)
+			lineage.Versions = lineage.Versions.Merge(l.Versions)
+		}
+	}
+	residuals := secagg.Residuals(updates)
+	seeds, err := ms.residualSeeds(ctx, round, updates, residuals)
+	var selfSeeds map[string]secagg.Seed
+	if err == nil {
+		selfSeeds, err = ms.selfSeeds(ctx, round, updates)
+	}
+	if err == nil {
+		var sum []uint32
+		if sum, err = secagg.Sum(updates, seeds, selfSeeds); err == nil {
+			avg := structs.NewFlatWeights(secagg.Dequantize(sum, len(updates)), age/len(batch))
+			avg.SetSamples(samples)
+			avg.SetTrust(trust / float32(len(batch)))
+			avg.SetLineage(lineage)
+			var change float32
+			if change, err = ms.model.Apply(ctx, avg); err == nil {
+				for _, w := range batch {
+					w.callback(scoreChange(change, ms.changeThreshold))
+				}
+			}
+		}
+	}
+	if ms.model.telemetry != nil {
+		go ms.model.telemetry.RecordSecureAggregation(round, len(batch), len(residuals), err == nil)
+	}
+	if err != nil {
+		slog.Error("Failed secure aggregation", "round", round, "updates", len(batch), "error", err)
+		return
+	}
+	slog.Info("Applied secure aggregation round", "round", round, "updates", len(batch), "residual_masks", len(residuals))
+}
+
+// residualSeeds derives the seeds of masks with this peer and recovers the
+// seeds of the other residual masks.
+func (ms *MaskedStrategy) residualSeeds(ctx context.Context, round int64, updates []*secagg.Update, residuals []secagg.Residual) (map[secagg.Pair]secagg.Seed, error) {
+	sources := make(map[string]*secagg.Update, len(updates))
+	for _, u := range updates {
+		sources[u.Source] = u
+	}
+	self := ms.seeds.Name()
+	seeds := make(map[secagg.Pair]secagg.Seed, len(residuals))
+	for _, r := range residuals {
+		if _, ok := seeds[r.Pair]; ok {
+			continue
+		}
+		var seed secagg.Seed
+		var err error
+		if r.Pair.A == self || r.Pair.B == self {
+			seed, err = ms.seeds.Seed(r.Pair, round)
+		} else {
+			u := sources[r.Source]
+			seed, err = ms.seeds.Recover(ctx, r, round, u.Group, u.Threshold)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no seed for the mask of %s and %s: %w", r.Pair.A, r.Pair.B, err)
+		}
+		seeds[r.Pair] = seed
+	}
+	return seeds, nil
+}
+
+// selfSeeds recovers the seeds of the self masks of all updates.
+func (ms *MaskedStrategy) selfSeeds(ctx context.Context, round int64, updates []*secagg.Update) (map[string]secagg.Seed, error) {
+	seeds := make(map[string]secagg.Seed, len(updates))
+	for _, u := range updates {
+		seed, err := ms.seeds.RecoverSelf(ctx, u.Source, round, u.Group, u.Threshold)
+		if err != nil {
+			return nil, fmt.Errorf("no seed for the self mask of %s: %w", u.Source, err)
+		}
+		seeds[u.Source] = seed
+	}
+	return seeds, nil
+}
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/secagg"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+type fakeSeedSource struct {
+	seeds     map[secagg.Pair]secagg.Seed
+	selves    map[string]secagg.Seed
+	recovered []secagg.Residual
+}
+
+func newFakeSeedSource() *fakeSeedSource {
+	return &fakeSeedSource{seeds: map[secagg.Pair]secagg.Seed{}, selves: map[string]secagg.Seed{}}
+}
+
+func (f *fakeSeedSource) Name() string {
+	return "m"
+}
+
+func (f *fakeSeedSource) Seed(pair secagg.Pair, _ int64) (secagg.Seed, error) {
+	return f.seeds[pair], nil
+}
+
+func (f *fakeSeedSource) Recover(_ context.Context, r secagg.Residual, _ int64, _ []string, _ int) (secagg.Seed, error) {
+	f.recovered = append(f.recovered, r)
+	return f.seeds[r.Pair], nil
+}
+
+func (f *fakeSeedSource) RecoverSelf(_ context.Context, source string, _ int64, _ []string, _ int) (secagg.Seed, error) {
+	seed, ok := f.selves[source]
+	if !ok {
+		return secagg.Seed{}, errors.New("no self mask seed")
+	}
+	return seed, nil
+}
+
+// maskedWeights masks v of source for the group like a peer would.
+func maskedWeights(v []float32, source string, group []string, seeds *fakeSeedSource, done chan int) *WeightsWithCallback {
+	u := &secagg.Update{Source: source, Round: 1, Group: group, Threshold: secagg.Threshold(len(group)), Vector: secagg.Quantize(v)}
+	for _, other := range group {
+		pair := secagg.NewPair(source, other)
+		secagg.AddMask(u.Vector, seeds.seeds[pair], pair, source, false)
+	}
+	seeds.selves[source] = secagg.Seed{byte(len(seeds.selves) + 10)}
+	secagg.AddSelfMask(u.Vector, seeds.selves[source], false)
+	w := structs.NewWeights(nil, 1)
+	w.SetSource(source)
+	w.SetMasked(u)
+	return NewWeightsWithCallback(w, func(score int) { done <- score })
+}
+
+func TestMaskedStrategyAggregatesRound(t *testing.T) {
+	// prepare
+	conf := secagg.Config{Enabled: true, Round: time.Second, MinUpdates: 2}
+	m, err := NewModel(&Config{
+		Name:              "m",
+		Backend:           BackendGo,
+		Dataset:           SyntheticDataset,
+		DataPath:          t.TempDir(),
+		SecureAggregation: conf,
+	}, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Start())
+	w, err := m.GetWeights(context.Background())
+	require.NoError(t, err)
+	v, err := w.Floats()
+	require.NoError(t, err)
+	seeds := newFakeSeedSource()
+	for i, pair := range []secagg.Pair{secagg.NewPair("a", "b"), secagg.NewPair("a", "m"), secagg.NewPair("b", "m"), secagg.NewPair("a", "c"), secagg.NewPair("b", "c")} {
+		seeds.seeds[pair] = secagg.Seed{byte(i + 1)}
+	}
+	done := make(chan int, 2)
+	batch := []*WeightsWithCallback{
+		maskedWeights(v, "a", []string{"b", "c", "m"}, seeds, done), // c dropped out
+		maskedWeights(v, "b", []string{"a", "c", "m"}, seeds, done),
+	}
+	ms := NewMaskedStrategy(m, conf, seeds, 0)
+
+	// run
+	ms.aggregate(context.Background(), 1, batch)
+
+	// verify
+	assert.Len(t, done, 2, "every update should be scored")
+	assert.ElementsMatch(t, []secagg.Residual{{Source: "a", Pair: secagg.NewPair("a", "c")}, {Source: "b", Pair: secagg.NewPair("b", "c")}}, seeds.recovered)
+	assert.Equal(t, 2, m.GetAge())
+}
+
+func TestMaskedStrategyDiscardsSmallRound(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	seeds := newFakeSeedSource()
+	done := make(chan int, 1)
+	ms := NewMaskedStrategy(m, secagg.Config{Enabled: true, Round: time.Second, MinUpdates: 3}, seeds, 0)
+
+	// run
+	ms.aggregate(context.Background(), 1, []*WeightsWithCallback{
+		maskedWeights([]float32{1}, "a", []string{"m"}, seeds, done),
+		maskedWeights([]float32{1}, "b", []string{"m"}, seeds, done),
+	})
+
+	// verify
+	assert.Empty(t, done)
+	assert.Equal(t, 1, m.GetAge())
+}
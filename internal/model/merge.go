@@ -0,0 +1,111 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+const (
+	MergeAge      = "age"
+	MergeSamples  = "samples"
+	MergeTrust    = "trust"
+	MergeCombined = "combined"
+)
+
+// minTrustFactor is the share an update of a source without any trust still
+// gets, so new peers can earn trust by contributing useful updates.
+const minTrustFactor = 0.2
+
+// maxMergeRatio keeps a share of the own model, so shares stay finite when
+// several updates are merged at once.
+const maxMergeRatio = 0.99
+
+// MergeState describes the local model when incoming weights are merged.
+type MergeState struct {
+	Age     int
+	Samples int // 0 if unknown
+}
+
+// MergePolicy decides how much of incoming weights is mixed into the model.
+type MergePolicy interface {
+	// Ratio returns the share of the incoming weights between 0 and 1.
+	Ratio(own MergeState, incoming *structs.Weights) float32
+}
+
+// Type checks
+var _ MergePolicy = AgeMergePolicy{}
+var _ MergePolicy = SampleMergePolicy{}
+var _ MergePolicy = TrustMergePolicy{}
+var _ MergePolicy = CombinedMergePolicy{}
+
+// NewMergePolicy returns the merge policy with the given name. An empty name
+// selects the age based policy.
+func NewMergePolicy(name string) (MergePolicy, error) {
+	switch name {
+	case MergeAge, "":
+		return AgeMergePolicy{}, nil
+	case MergeSamples:
+		return SampleMergePolicy{}, nil
+	case MergeTrust:
+		return TrustMergePolicy{}, nil
+	case MergeCombined:
+		return CombinedMergePolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown merge policy %q", name)
+	}
+}
+
+// AgeMergePolicy weights both models by their age, i.e. the number of
+// training runs that went into them.
+type AgeMergePolicy struct{}
+
+func (AgeMergePolicy) Ratio(own MergeState, incoming *structs.Weights) float32 {
+	return share(float32(own.Age), float32(incoming.GetAge()))
+}
+
+// SampleMergePolicy weights both models by the size of their training sets
+// like FedAvg. Unknown sizes count as equal.
+type SampleMergePolicy struct{}
+
+func (SampleMergePolicy) Ratio(own MergeState, incoming *structs.Weights) float32 {
+	if own.Samples < 1 || incoming.GetSamples() < 1 {
+		return 0.5
+	}
+	return share(float32(own.Samples), float32(incoming.GetSamples()))
+}
+
+// TrustMergePolicy mixes in updates of fully trusted sources as equals and
+// scales down updates of less trusted sources.
+type TrustMergePolicy struct{}
+
+func (TrustMergePolicy) Ratio(_ MergeState, incoming *structs.Weights) float32 {
+	return share(1, trustFactor(incoming.GetTrust()))
+}
+
+// CombinedMergePolicy weights both models by age times training set size and
+// scales the incoming weights by the trust in their source.
+type CombinedMergePolicy struct{}
+
+func (CombinedMergePolicy) Ratio(own MergeState, incoming *structs.Weights) float32 {
+	ownWeight, inWeight := float32(own.Age), float32(incoming.GetAge())
+	// Only weight by size if both sizes are known
+	if own.Samples > 0 && incoming.GetSamples() > 0 {
+		ownWeight *= float32(own.Samples)
+		inWeight *= float32(incoming.GetSamples())
+	}
+	return share(ownWeight, inWeight*trustFactor(incoming.GetTrust()))
+}
+
+// share returns the share of in in the sum of own and in.
+func share(own, in float32) float32 {
+	if own+in <= 0 {
+		return 0
+	}
+	return in / (own + in)
+}
+
+func trustFactor(trust float32) float32 {
+	trust = min(max(trust, 0), 1)
+	return minTrustFactor + (1-minTrustFactor)*trust
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func newMergeWeights(age, samples int, trust float32) *structs.Weights {
+	w := structs.NewWeights(nil, age)
+	w.SetSamples(samples)
+	w.SetTrust(trust)
+	return w
+}
+
+func TestMergePolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		own      MergeState
+		incoming *structs.Weights
+		ratio    float32
+	}{
+		{MergeAge, MergeState{Age: 3, Samples: 100}, newMergeWeights(1, 900, 1), 0.25},
+		{MergeSamples, MergeState{Age: 3, Samples: 100}, newMergeWeights(1, 900, 1), 0.9},
+		{MergeSamples, MergeState{Age: 3}, newMergeWeights(1, 900, 1), 0.5},
+		{MergeTrust, MergeState{Age: 3, Samples: 100}, newMergeWeights(1, 900, 1), 0.5},
+		{MergeTrust, MergeState{Age: 3, Samples: 100}, newMergeWeights(1, 900, 0), minTrustFactor / (1 + minTrustFactor)},
+		{MergeCombined, MergeState{Age: 1, Samples: 100}, newMergeWeights(1, 300, 1), 0.75},
+		{MergeCombined, MergeState{Age: 1}, newMergeWeights(3, 300, 1), 0.75},
+		{MergeCombined, MergeState{Age: 1, Samples: 100}, newMergeWeights(1, 100, 0), minTrustFactor / (1 + minTrustFactor)},
+	}
+	for _, tt := range tests {
+		// prepare
+		p, err := NewMergePolicy(tt.policy)
+		require.NoError(t, err)
+
+		// run
+		ratio := p.Ratio(tt.own, tt.incoming)
+
+		// verify
+		assert.InDelta(t, tt.ratio, ratio, 1e-6, tt.policy)
+	}
+}
+
+func TestMergePolicyUnknown(t *testing.T) {
+	// run
+	_, err := NewMergePolicy("median")
+
+	// verify
+	assert.Error(t, err)
+}
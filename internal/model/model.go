@@ -1,21 +1,22 @@
 package model
 
 import (
-	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/vs-ude/btml/internal/privacy"
 	"github.com/vs-ude/btml/internal/structs"
 	"github.com/vs-ude/btml/internal/telemetry"
-	grpc "google.golang.org/grpc"
-	"google.golang.org/grpc/connectivity"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 type lossHistoryItem struct {
@@ -23,223 +24,566 @@ type lossHistoryItem struct {
 	loss float32
 }
 
-// Model represents a model instance. All actions are executed in series.
+// Model represents a model instance. All actions are executed in series by
+// the scheduler, which runs them with the model locked.
 type Model struct {
-	checkpointBase        string
-	client                *ModelClient
-	age                   int
-	lastEval              int
+	name                  string
+	checkpoints           *checkpointManager
+	resume                bool
+	backend               Backend
+	age                   int            // Only changed by setAge
+	publishedAge          atomic.Int64   // Copy of age that is read without the lock
+	lastEval              atomic.Int64   // Age of the last evaluation, read by EvalLoop without the lock
+	sources               map[string]int // Applied updates per source
+	versions              structs.VersionVector
+	lastHash              []byte             // Hash of the last sent weights
+	parents               [][]byte           // Hashes of the weights applied since the last sent weights
+	samples               int                // Size of the training set, 0 until the first training
+	layout                *structs.TensorMap // Shared tensors of the model without data, set on the first import
+	sharing               structs.SharingPolicy
+	merge                 MergePolicy
+	privacy               *privacy.Accountant // Only set if sent weights use differential privacy
+	privacyExhausted      bool
+	hyperparams           structs.Hyperparams
+	timeouts              Timeouts
+	ctx                   context.Context // Cancelled on shutdown
+	stop                  context.CancelFunc
 	trainLossHistory      []lossHistoryItem
 	evalLossHistory       []lossHistoryItem
-	modelModifiedCallback func(*structs.Weights)
+	revision              int              // Incremented on every change of the weights
+	exported              *structs.Weights // Weights fetched for sending, valid for exportedRevision
+	exportedRevision      int
+	scheduler             *scheduler
+	modelModifiedCallback func(*PendingWeights)
 	telemetry             *telemetry.Client
 	sync.Mutex
 }
 
-// Shutdown closes the model client and logs a message. It ignores the lock.
+// Shutdown cancels running operations, closes the model backend and logs a
+// message. It ignores the lock.
 func (m *Model) Shutdown() {
-	m.client.Close()
+	m.stop()
+	m.backend.Close()
 	slog.Info("Model stopped")
 }
 
-// Eval evaluates the model and logs the results. It blocks until other
-// operations are completed.
+// operation derives the context for a single backend call from ctx. It is
+// cancelled after the timeout or when the model is shut down.
+func (m *Model) operation(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	stop := context.AfterFunc(m.ctx, cancel)
+	if m.ctx.Err() != nil {
+		// AfterFunc runs asynchronously, so make sure ctx is already done
+		cancel()
+	}
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// checkTimeout logs a warning if ctx failed because of its timeout, so slow
+// operations do not go unnoticed.
+func checkTimeout(ctx context.Context, op string, timeout time.Duration) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Warn("Model operation timed out, consider increasing its timeout", "operation", op, "timeout", timeout)
+	}
+}
+
+// Eval evaluates the model and logs the results. It runs after all other
+// queued operations.
 // Unless an error occurred, it returns the change in loss from the last
 // evaluation.
-func (m *Model) Eval() (change float32, err error) {
-	checkpointPath := fmt.Sprintf("%s/%d", m.checkpointBase, m.age)
-	m.Lock()
-	defer m.Unlock()
+func (m *Model) Eval(ctx context.Context) (change float32, err error) {
+	err = m.submit(ctx, priorityEval, func(ctx context.Context) error {
+		change, err = m.eval(ctx)
+		return err
+	})
+	return
+}
+
+// eval assumes that the model is locked.
+func (m *Model) eval(ctx context.Context) (change float32, err error) {
+	checkpointPath := m.checkpoints.path(m.age)
+	ctx, cancel := m.operation(ctx, m.timeouts.Eval)
+	defer cancel()
 	var met *metrics
-	met, err = m.client.Eval(checkpointPath)
+	met, err = m.backend.Eval(ctx, checkpointPath)
 	if err != nil {
+		checkTimeout(ctx, "eval", m.timeouts.Eval)
 		err = fmt.Errorf("failed to evaluate model: %w", err)
 		return
 	}
-	slog.Info("Evaluated model", "accuracy", met.acc, "loss", met.loss)
+	if met.eval != nil {
+		slog.Info("Evaluated model", "accuracy", met.acc, "loss", met.loss, "macro_f1", met.eval.macroF1(), "calibration_error", met.eval.calibrationError)
+	} else {
+		slog.Info("Evaluated model", "accuracy", met.acc, "loss", met.loss)
+	}
 	if m.telemetry != nil {
-		go m.telemetry.RecordEvaluation(met.acc, met.loss, met.guesses, m.age)
+		var macroF1, calibrationError float32
+		var classes []telemetry.ClassEvaluation
+		if met.eval != nil {
+			macroF1, calibrationError = met.eval.macroF1(), met.eval.calibrationError
+			classes = met.eval.classes()
+		}
+		go m.telemetry.RecordEvaluation(met.acc, met.loss, macroF1, calibrationError, classes, m.age)
 	}
 	if len(m.evalLossHistory) > 0 {
 		prev := m.evalLossHistory[len(m.evalLossHistory)-1]
 		change = met.loss - prev.loss // TODO should this be weighted and/or normalized?
 	}
 	m.evalLossHistory = append(m.evalLossHistory, lossHistoryItem{age: m.age, loss: met.loss})
-	m.lastEval = m.age
+	m.lastEval.Store(int64(m.age))
+	if err := m.checkpoints.add(met, m.age, m.sources, m.versions); err != nil {
+		slog.Warn("Failed to manage checkpoint", "age", m.age, "error", err)
+	}
 	return
 }
 
-// Train the model and logs the results. It blocks until other
-// operations are completed.
-// Unless an error occurred, it returns the change in loss from the last
-// training/apply action.
-func (m *Model) Train() (change float32, err error) {
+// latestCheckpoint returns the path and age of the latest checkpoint. It does
+// not wait for the model lock.
+func (m *Model) latestCheckpoint() (path string, age int, ok bool) {
+	c, ok := m.checkpoints.latest()
+	if !ok {
+		return "", 0, false
+	}
+	return c.Path, c.Age, true
+}
+
+// resumeCheckpoint loads the latest checkpoint into the backend and continues
+// with its age. It blocks until other operations are completed.
+func (m *Model) resumeCheckpoint(ctx context.Context) error {
 	m.Lock()
 	defer m.Unlock()
+	c, ok := m.checkpoints.latest()
+	if !ok {
+		slog.Info("No checkpoint to resume from, starting a new model")
+		return nil
+	}
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	ctx, cancel := m.operation(ctx, m.timeouts.Import)
+	defer cancel()
+	if err = m.backend.Import(ctx, structs.NewWeights(data, c.Age), 1, nil); err != nil {
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	m.setAge(c.Age)
+	m.lastEval.Store(int64(c.Age))
+	if c.Sources != nil {
+		m.sources = c.Sources
+	}
+	if c.Versions != nil {
+		m.versions = c.Versions
+	}
+	slog.Info("Resumed model from checkpoint", "path", c.Path, "age", c.Age, "loss", c.Loss, "accuracy", c.Accuracy)
+	return nil
+}
+
+// restoreAge resets the age after the backend restored a checkpoint. It
+// blocks until other operations are completed.
+func (m *Model) restoreAge(age int) {
+	m.Lock()
+	defer m.Unlock()
+	slog.Info("Restored model from checkpoint", "age", age, "previous_age", m.age)
+	m.setAge(age)
+	m.lastEval.Store(int64(age))
+}
+
+// Train the model with the configured hyperparameters and logs the results.
+// It waits until queued exports and applies are completed.
+// Unless an error occurred, it returns the change in loss from the last
+// training/apply action.
+func (m *Model) Train(ctx context.Context) (change float32, err error) {
+	return m.TrainWith(ctx, structs.Hyperparams{})
+}
+
+// TrainWith trains the model like Train, but the non-zero values of override
+// replace the configured hyperparameters for this run.
+func (m *Model) TrainWith(ctx context.Context, override structs.Hyperparams) (change float32, err error) {
+	err = m.submit(ctx, priorityTrain, func(ctx context.Context) error {
+		change, err = m.trainWith(ctx, override)
+		return err
+	})
+	return
+}
+
+// trainWith assumes that the model is locked.
+func (m *Model) trainWith(ctx context.Context, override structs.Hyperparams) (change float32, err error) {
 	var met *metrics
-	met, err = m.client.Train()
+	met, err = m.train(ctx, m.hyperparams.Merge(override))
 	if err != nil {
-		err = fmt.Errorf("failed to train model: %w", err)
+		return
 	}
-	m.age++
+	m.setAge(m.age + 1)
 	slog.Info("Trained model", "age", m.age, "loss", met.loss)
 	if m.telemetry != nil {
 		go m.telemetry.RecordTraining(met.loss, m.age)
 	}
 	m.trainLossHistory = append(m.trainLossHistory, lossHistoryItem{age: m.age, loss: met.loss})
-	m.executeCallback()
+	m.revision++
 	return
 }
 
+// train runs the backend training within the train timeout. The backend only
+// returns after a timed out training run stopped, so the lock is not released
+// while it still changes the weights. It assumes that the model is locked.
+func (m *Model) train(ctx context.Context, hp structs.Hyperparams) (*metrics, error) {
+	ctx, cancel := m.operation(ctx, m.timeouts.Train)
+	defer cancel()
+	met, err := m.backend.Train(ctx, hp)
+	if err != nil {
+		checkTimeout(ctx, "train", m.timeouts.Train)
+		return nil, fmt.Errorf("failed to train model: %w", err)
+	}
+	if met.samples > 0 {
+		m.samples = met.samples
+	}
+	m.versions = m.versions.Increment(m.name)
+	return met, nil
+}
+
 // Apply the given weights to the model. Does a short training run, and
-// logs the results. It blocks until other operations are completed.
+// logs the results. It waits until queued exports are completed.
 // Unless an error occurred, it returns the change in loss from the last
 // training/apply action weighted by the ratio of age between the existing
 // model and the incoming weights.
-func (m *Model) Apply(weights *structs.Weights) (change float32, err error) {
-	m.Lock()
-	defer m.Unlock()
-	ratio := getRatio(m, weights)
-	if err = m.client.Apply(weights, ratio); err != nil {
-		err = fmt.Errorf("failed to apply weights to model: %w", err)
-		return
+func (m *Model) Apply(ctx context.Context, weights *structs.Weights) (change float32, err error) {
+	changes, err := m.ApplyAll(ctx, []*structs.Weights{weights}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return changes[0], nil
+}
+
+// ApplyAll merges all given weights into the model in a single step and does
+// one short training run afterwards. The share of each weights given by the
+// merge policy is scaled by discount, which gets the number of ages the
+// weights are behind the model. A nil discount keeps the shares. It waits
+// until queued exports are completed. Applies that are queued at the same
+// time are merged in one step.
+// Unless an error occurred, it returns the change in loss from the last
+// training/apply action weighted by the final share of each weights.
+func (m *Model) ApplyAll(ctx context.Context, weights []*structs.Weights, discount func(staleness int) float32) (changes []float32, err error) {
+	return m.submitApply(ctx, weights, discount)
+}
+
+// applyAll is ApplyAll with a discount per weights, which gets the index of
+// the weights as well. It assumes that the model is locked.
+func (m *Model) applyAll(ctx context.Context, weights []*structs.Weights, discount func(i, staleness int) float32) (changes []float32, err error) {
+	// A batch is applied completely or not at all
+	if err = m.checkWeights(ctx, weights); err != nil {
+		return nil, err
+	}
+	var snapshot *structs.Weights
+	if len(weights) > 1 {
+		if snapshot, err = m.getWeights(ctx); err != nil {
+			return nil, err
+		}
+	}
+	// Relative to the own model with a share of 1. Importing them one after
+	// another with ratio share/total results in the weighted average.
+	own := MergeState{Age: m.age, Samples: m.samples}
+	shares := make([]float32, len(weights))
+	total := float32(1)
+	for i, w := range weights {
+		ratio := min(m.merge.Ratio(own, w), maxMergeRatio)
+		shares[i] = ratio / (1 - ratio)
+		shares[i] *= discount(i, max(m.age-w.GetAge(), 0))
+		total += shares[i]
+		if err = m.importWeights(ctx, w, shares[i]/total); err != nil {
+			if i > 0 {
+				m.restore(ctx, snapshot)
+			}
+			return nil, err
+		}
+	}
+	for _, w := range weights {
+		if l := w.GetLineage(); l != nil {
+			m.versions = m.versions.Merge(l.Versions)
+			if l.Hash != nil {
+				m.parents = append(m.parents, l.Hash)
+			} else {
+				// Weights without own hash, like aggregates, pass on their parents
+				m.parents = append(m.parents, l.Parents...)
+			}
+		}
 	}
 	var met *metrics
-	met, err = m.client.Train()
+	met, err = m.train(ctx, m.hyperparams)
 	if err != nil {
-		err = fmt.Errorf("failed to train model: %w", err)
-		return
+		return nil, err
 	}
 	old_age := m.age
-	m.age = max(m.age, weights.GetAge()) + 1
-	slog.Info("Applied weights to model", "age", m.age, "loss", met.loss)
-	m.executeCallback()
+	age := m.age
+	for _, w := range weights {
+		age = max(age, w.GetAge())
+		if src := w.GetSource(); src != "" {
+			m.sources[src]++
+		}
+	}
+	m.setAge(age + 1)
+	slog.Info("Applied weights to model", "age", m.age, "loss", met.loss, "updates", len(weights), "ratio", 1-1/total)
+	m.revision++
 
+	changes = make([]float32, len(weights))
 	if len(m.trainLossHistory) > 0 {
 		prev := m.trainLossHistory[len(m.trainLossHistory)-1]
-		change = ratio * (met.loss - prev.loss) // TODO should this be weighted differently and/or normalized?
+		for i := range weights {
+			changes[i] = shares[i] / total * (met.loss - prev.loss) // TODO should this be weighted differently and/or normalized?
+		}
 	}
 	m.trainLossHistory = append(m.trainLossHistory, lossHistoryItem{age: m.age, loss: met.loss})
 
 	if m.telemetry != nil {
-		go m.telemetry.RecordWeightApplication(old_age, weights.GetAge(), change)
+		for i, w := range weights {
+			go m.telemetry.RecordWeightApplication(old_age, w.GetAge(), changes[i])
+		}
 	}
 	return
 }
 
-// GetWeights fetches the weights from the model and returns them. It blocks
-// until other operations are completed.
-func (m *Model) GetWeights() (*structs.Weights, error) {
-	m.Lock()
-	defer m.Unlock()
-	return m.getWeights()
+// restore replaces the weights of the model with the snapshot taken before a
+// failed batch, even if ctx is already done. It assumes that the model is
+// locked.
+func (m *Model) restore(ctx context.Context, snapshot *structs.Weights) {
+	if err := m.importWeights(context.WithoutCancel(ctx), snapshot, 1); err != nil {
+		slog.Error("Failed to restore the model after a failed apply", "error", err)
+		return
+	}
+	slog.Warn("Restored the model after a failed apply")
+}
+
+// importWeights runs the backend import within the import timeout. It
+// assumes that the model is locked.
+func (m *Model) importWeights(ctx context.Context, weights *structs.Weights, ratio float32) error {
+	var layers map[string]float32
+	if !weights.IsFlat() {
+		tm, err := weights.Tensors()
+		if err == nil {
+			err = m.checkLayout(ctx, tm)
+		}
+		if err != nil {
+			return fmt.Errorf("rejected weights: %w", err)
+		}
+		layers = m.sharing.Ratios(tm, ratio)
+	}
+	ctx, cancel := m.operation(ctx, m.timeouts.Import)
+	defer cancel()
+	if err := m.backend.Import(ctx, weights, ratio, layers); err != nil {
+		checkTimeout(ctx, "import", m.timeouts.Import)
+		return fmt.Errorf("failed to apply weights to model: %w", err)
+	}
+	return nil
+}
+
+// checkLayout compares the shared tensors of incoming weights to the shared
+// tensors of the model, so weights of another model never reach the backend.
+// It assumes that the model is locked.
+func (m *Model) checkLayout(ctx context.Context, tm *structs.TensorMap) error {
+	tm, err := m.sharing.Filter(tm)
+	if err != nil {
+		return err
+	}
+	if m.layout == nil {
+		own, err := m.getWeights(ctx)
+		if err != nil {
+			return err
+		}
+		if own.IsFlat() {
+			return nil
+		}
+		ownTensors, err := own.Tensors()
+		if err != nil {
+			return fmt.Errorf("invalid weights of the model: %w", err)
+		}
+		if ownTensors, err = m.sharing.Filter(ownTensors); err != nil {
+			return err
+		}
+		m.layout = ownTensors.Layout()
+	}
+	return tm.CheckLayout(m.layout)
+}
+
+// GetWeights fetches the weights from the model and returns them. It runs
+// before all other queued operations.
+func (m *Model) GetWeights(ctx context.Context) (w *structs.Weights, err error) {
+	err = m.submit(ctx, priorityExport, func(ctx context.Context) error {
+		w, err = m.getWeights(ctx)
+		return err
+	})
+	return
 }
 
 // getWeights assumes that the model is locked.
-func (m *Model) getWeights() (*structs.Weights, error) {
-	w, err := m.client.GetWeights()
+func (m *Model) getWeights(ctx context.Context) (*structs.Weights, error) {
+	ctx, cancel := m.operation(ctx, m.timeouts.Export)
+	defer cancel()
+	w, err := m.backend.Export(ctx)
 	if err != nil {
+		checkTimeout(ctx, "export", m.timeouts.Export)
 		return nil, fmt.Errorf("failed to fetch weights from model: %w", err)
 	}
 	slog.Debug("Got weights from model")
 	w.SetAge(m.age)
+	w.SetSamples(m.samples)
 	return w, nil
 }
 
-// executeCallback runs the callback function if it is set. It uses getWeights
-// so it assumes that the model is locked.
-func (m *Model) executeCallback() {
-	if m.modelModifiedCallback != nil {
-		w, err := m.getWeights()
-		if err != nil {
-			slog.Error("Failed to get weights for callback", "error", err)
-			return
+// getPrivateWeights fetches the weights from the model with differential
+// privacy. It assumes that the model is locked.
+func (m *Model) getPrivateWeights(ctx context.Context) (*structs.Weights, error) {
+	if err := m.privacy.Check(); err != nil {
+		return nil, err
+	}
+	// Spend the budget first, a failed export might still have been released
+	epsilon := m.privacy.Spend()
+	ctx, cancel := m.operation(ctx, m.timeouts.Export)
+	defer cancel()
+	w, norm, err := m.backend.ExportPrivate(ctx, m.privacy.ClipNorm(), m.privacy.NoiseMultiplier())
+	if err != nil {
+		checkTimeout(ctx, "export", m.timeouts.Export)
+		return nil, fmt.Errorf("failed to fetch private weights from model: %w", err)
+	}
+	slog.Debug("Got private weights from model", "epsilon", epsilon, "norm", norm)
+	if m.telemetry != nil {
+		_, releases := m.privacy.Spent()
+		go m.telemetry.RecordPrivacy(epsilon, m.privacy.Delta(), norm, norm > m.privacy.ClipNorm(), releases, m.age)
+	}
+	w.SetAge(m.age)
+	w.SetSamples(m.samples)
+	return w, nil
+}
+
+// share removes the tensors that are kept local from weights that are sent.
+func (m *Model) share(w *structs.Weights) (*structs.Weights, error) {
+	if !m.sharing.Partial() || w.IsFlat() {
+		return w, nil
+	}
+	tm, err := w.Tensors()
+	if err != nil {
+		return nil, err
+	}
+	if tm, err = m.sharing.Filter(tm); err != nil {
+		return nil, err
+	}
+	shared, err := structs.NewTensorWeights(tm, w.GetAge())
+	if err != nil {
+		return nil, err
+	}
+	shared.SetSamples(w.GetSamples())
+	return shared, nil
+}
+
+// release adds the lineage to weights that are sent and records it as a node
+// of the provenance DAG. Its parents are the last sent weights and the
+// weights applied since. It assumes that the model is locked.
+func (m *Model) release(w *structs.Weights) {
+	l := &structs.Lineage{
+		Hash:     structs.HashWeights(w.Get()),
+		Versions: maps.Clone(m.versions),
+	}
+	if m.lastHash != nil {
+		l.Parents = append(l.Parents, m.lastHash)
+	}
+	l.Parents = append(l.Parents, m.parents...)
+	m.lastHash, m.parents = l.Hash, nil
+	w.SetLineage(l)
+	if m.telemetry != nil {
+		parents := make([]string, len(l.Parents))
+		for i, p := range l.Parents {
+			parents[i] = hex.EncodeToString(p)
 		}
-		m.modelModifiedCallback(w)
+		go m.telemetry.RecordLineage(hex.EncodeToString(l.Hash), parents, l.Versions, w.GetAge())
 	}
 }
 
-// NewModel creates a new Model instance by starting the Python process
-// and establishing a connection to it
+// NewModel creates a new Model instance with the backend selected in the
+// config. The backend is only started by Start.
 func NewModel(c *Config, telemetry *telemetry.Client) (*Model, error) {
-	// Create a random socket path in /tmp
-	socketPath := filepath.Join(os.TempDir(), fmt.Sprintf("btml-model-%d.sock", time.Now().Unix()))
-
-	args := append(c.ModelArgs,
-		"--train-data", c.GetTrainDataPath(),
-		"--test-data", c.GetTestDataPath(),
-		"--socket", socketPath,
-	)
-	if c.LogPath != "" {
-		if p, err := resolveLogPath(c); err == nil {
-			args = append(args, "--log-file", p)
-		} else {
-			slog.Warn("Invalid log path configuration. Log path should be either a nonexistent *.log file or a directory.", "error", err)
-		}
+	merge, err := NewMergePolicy(c.MergePolicy)
+	if err != nil {
+		return nil, err
 	}
-	cmd := exec.Command(c.PythonRuntime, args...)
-	stdout, _ := cmd.StderrPipe()
-	scanner := bufio.NewScanner(stdout)
-	go func() {
-		for scanner.Scan() {
-			slog.Error("Model error", "text", scanner.Text())
+	var accountant *privacy.Accountant
+	if c.Privacy.Enabled() {
+		if accountant, err = privacy.NewAccountant(c.Privacy); err != nil {
+			return nil, fmt.Errorf("invalid privacy config: %w", err)
 		}
-	}()
-	return &Model{
-		client: &ModelClient{
-			cmd:        cmd,
-			socketPath: socketPath,
-		},
-		age:                   1,
-		checkpointBase:        c.GetCheckpointPath(),
+		slog.Info("Sending weights with differential privacy", "epsilon", c.Privacy.Epsilon, "delta", c.Privacy.Delta, "noise_multiplier", accountant.NoiseMultiplier())
+	}
+	if err = c.Sharing.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid sharing policy: %w", err)
+	}
+	if c.Sharing.Partial() && c.SecureAggregation.Enabled {
+		return nil, errors.New("partial sharing cannot be combined with secure aggregation")
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	m := &Model{
+		name:                  c.Name,
+		resume:                c.Resume,
+		sources:               make(map[string]int),
+		merge:                 merge,
+		privacy:               accountant,
+		sharing:               c.Sharing,
+		hyperparams:           c.Training,
+		timeouts:              c.Timeouts,
+		ctx:                   ctx,
+		stop:                  stop,
+		scheduler:             newScheduler(),
 		modelModifiedCallback: nil,
 		telemetry:             telemetry,
-	}, nil
+	}
+	m.setAge(1)
+	switch c.Backend {
+	case BackendPython, "":
+		m.checkpoints = newCheckpointManager(c.GetCheckpointPath(), checkpointExt, c.KeepCheckpoints)
+		client := NewModelClient(c, telemetry)
+		client.checkpoint = m.latestCheckpoint
+		client.restored = m.restoreAge
+		m.backend = client
+	case BackendGo:
+		m.checkpoints = newCheckpointManager(c.GetCheckpointPath(), checkpointExt, c.KeepCheckpoints)
+		m.backend = NewGoBackend(c)
+	default:
+		stop()
+		return nil, fmt.Errorf("unknown model backend %q", c.Backend)
+	}
+	// Checkpoints of a previous run are only used to resume it, otherwise
+	// they are kept until the retention removes them
+	if !c.Resume {
+		m.checkpoints.since = time.Now()
+	}
+	if err := m.checkpoints.load(); err != nil {
+		stop()
+		return nil, fmt.Errorf("failed to load checkpoints: %w", err)
+	}
+	go m.schedule()
+	return m, nil
 }
 
-func (m *Model) SetCallback(callback func(*structs.Weights)) {
+// SetCallback sets the function that is called after every change of the
+// model. It runs on the scheduler, so it must not wait for the pending
+// weights.
+func (m *Model) SetCallback(callback func(*PendingWeights)) {
 	m.modelModifiedCallback = callback
 }
 
+// Start starts the backend and, if configured, resumes from the latest
+// checkpoint.
 func (m *Model) Start() error {
-	slog.Info("Starting Python process", "command", m.client.cmd.String(), "cwd", m.client.cmd.Dir)
-	if err := m.client.cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start Python process: %w", err)
+	if err := m.backend.Start(); err != nil {
+		return err
 	}
-
-	// Try to connect to the socket with retries
-	var conn *grpc.ClientConn
-	var err error
-	conn, err = grpc.NewClient("unix://"+m.client.socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return fmt.Errorf("failed to create gRPC client: %w", err)
-	}
-	maxAttempts := 10
-	for i := range maxAttempts {
-		conn.Connect()
-		state := conn.GetState()
-		if state == connectivity.Ready || state == connectivity.Idle {
-			break
-		}
-		if i == maxAttempts {
-			m.client.cmd.Process.Kill()
-			m.client.cmd.Wait()
-			os.Remove(m.client.socketPath)
-			return fmt.Errorf("failed to connect to socket: %w", err)
-		}
-		if i > 3 {
-			slog.Debug("No response from model (yet)", "attempt", i+1, "max_attempts", maxAttempts)
-		}
-		time.Sleep(time.Second * 2)
+	if m.resume {
+		return m.resumeCheckpoint(m.ctx)
 	}
-
-	m.client.trainClient = NewTrainClient(conn)
-	m.client.evalClient = NewEvalClient(conn)
-	m.client.exportWeightsClient = NewExportWeightsClient(conn)
-	m.client.importWeightsClient = NewImportWeightsClient(conn)
-
-	slog.Info("Model process is set up and running")
-
 	return nil
 }
 
@@ -255,25 +599,34 @@ func resolveLogPath(c *Config) (string, error) {
 	}
 }
 
-// getRatio calculates the ratio of the model's own age as used by the Python model.
-func getRatio(m *Model, weights *structs.Weights) float32 {
-	ratio := float32(weights.GetAge()) / (float32(m.age) + float32(weights.GetAge()))
-	return ratio
+// GetAge returns the age of the model without waiting for running
+// operations.
+func (m *Model) GetAge() int {
+	return int(m.publishedAge.Load())
 }
 
-func (m *Model) GetAge() int {
-	return m.age
+// setAge assumes that the model is locked.
+func (m *Model) setAge(age int) {
+	m.age = age
+	m.publishedAge.Store(int64(age))
 }
 
-func (m *Model) EvalLoop() {
+// EvalLoop periodically evaluates the model until ctx is done. Models that
+// did not change since the last evaluation are skipped.
+func (m *Model) EvalLoop(ctx context.Context) {
 	timer := time.NewTimer(time.Second * 5)
+	defer timer.Stop()
 	for {
-		<-timer.C
-		if m.age <= m.lastEval {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if m.GetAge() <= int(m.lastEval.Load()) {
 			timer.Reset(time.Second * 30)
 			continue
 		}
-		m.Eval()
+		m.Eval(ctx)
 		timer.Reset(time.Second * 30)
 	}
 }
@@ -0,0 +1,239 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/privacy"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func newTestModel(t *testing.T, timeouts Timeouts) *Model {
+	m, err := NewModel(&Config{Name: "1", Backend: BackendGo, Dataset: SyntheticDataset, DataPath: t.TempDir(), Timeouts: timeouts}, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Start())
+	return m
+}
+
+func TestModelTrainTimeout(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{Train: 1})
+
+	// run
+	_, err := m.Train(context.Background())
+
+	// verify
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, m.GetAge(), "failed training should not age the model")
+}
+
+func TestModelShutdownCancels(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+
+	// run
+	m.Shutdown()
+	_, err := m.Train(context.Background())
+
+	// verify
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestModelWeightsCarrySamples(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	w, err := m.GetWeights(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, w.GetSamples(), "the size is unknown before training")
+
+	// run
+	_, err = m.Train(context.Background())
+	require.NoError(t, err)
+	w, err = m.GetWeights(context.Background())
+
+	// verify
+	require.NoError(t, err)
+	assert.Positive(t, w.GetSamples())
+}
+
+func TestModelPrivacyBudget(t *testing.T) {
+	// prepare
+	m, err := NewModel(&Config{
+		Name:     "1",
+		Backend:  BackendGo,
+		Dataset:  SyntheticDataset,
+		DataPath: t.TempDir(),
+		Privacy:  privacy.Config{Epsilon: 10, Delta: 1e-5, ClipNorm: 1, Releases: 2},
+	}, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Start())
+	var pending *PendingWeights
+	m.SetCallback(func(p *PendingWeights) { pending = p })
+
+	// run
+	sent := 0
+	for range 3 {
+		_, err = m.Train(context.Background())
+		require.NoError(t, err)
+		if _, err = pending.Weights(context.Background()); err == nil {
+			sent++
+		} else {
+			assert.ErrorIs(t, err, privacy.ErrBudgetExhausted)
+		}
+	}
+
+	// verify
+	assert.Equal(t, 2, sent, "no weights should be sent once the budget is spent")
+	epsilon, releases := m.privacy.Spent()
+	assert.Equal(t, 2, releases)
+	assert.InDelta(t, 10, epsilon, 1e-6)
+}
+
+func TestModelRejectsForeignWeights(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	foreign, err := structs.NewTensorWeights(&structs.TensorMap{Tensors: []*structs.Tensor{
+		structs.NewFloat32Tensor("weight", []int64{2, 2}, []float32{1, 2, 3, 4}),
+	}}, 5)
+	require.NoError(t, err)
+
+	// run
+	_, err = m.Apply(context.Background(), foreign)
+	_, errPickle := m.Apply(context.Background(), structs.NewWeights([]byte("\x80\x04pickle"), 5))
+
+	// verify
+	assert.ErrorContains(t, err, "rejected weights")
+	assert.ErrorContains(t, errPickle, "rejected weights")
+	assert.Equal(t, 1, m.GetAge())
+}
+
+func TestModelLineage(t *testing.T) {
+	// prepare
+	a := newTestModel(t, Timeouts{})
+	b, err := NewModel(&Config{Name: "2", Backend: BackendGo, Dataset: SyntheticDataset, DataPath: t.TempDir()}, nil)
+	require.NoError(t, err)
+	require.NoError(t, b.Start())
+	var pendingA, pendingB *PendingWeights
+	a.SetCallback(func(p *PendingWeights) { pendingA = p })
+	b.SetCallback(func(p *PendingWeights) { pendingB = p })
+
+	// run
+	var sentA, sentB []*structs.Weights
+	for range 2 {
+		_, err = a.Train(context.Background())
+		require.NoError(t, err)
+		w, err := pendingA.Weights(context.Background())
+		require.NoError(t, err)
+		sentA = append(sentA, w)
+	}
+	_, err = b.Apply(context.Background(), sentA[1])
+	require.NoError(t, err)
+	w, err := pendingB.Weights(context.Background())
+	require.NoError(t, err)
+	sentB = append(sentB, w)
+
+	// verify
+	first, second := sentA[0].GetLineage(), sentA[1].GetLineage()
+	assert.Equal(t, structs.HashWeights(sentA[1].Get()), second.Hash)
+	assert.Equal(t, [][]byte{first.Hash}, second.Parents)
+	assert.Equal(t, structs.VersionVector{"1": 2}, second.Versions)
+	require.Len(t, sentB, 1)
+	assert.Equal(t, [][]byte{second.Hash}, sentB[0].GetLineage().Parents)
+	assert.Equal(t, structs.VersionVector{"1": 2, "2": 1}, sentB[0].GetLineage().Versions)
+}
+
+func TestModelPartialSharing(t *testing.T) {
+	// prepare
+	sharing := structs.SharingPolicy{Groups: []structs.LayerGroup{{Layers: []string{"bias"}, Local: true}}}
+	newModel := func(name string) *Model {
+		m, err := NewModel(&Config{Name: name, Backend: BackendGo, Dataset: SyntheticDataset, DataPath: t.TempDir(), Sharing: sharing}, nil)
+		require.NoError(t, err)
+		require.NoError(t, m.Start())
+		return m
+	}
+	a, b := newModel("1"), newModel("2")
+	var pending *PendingWeights
+	a.SetCallback(func(p *PendingWeights) { pending = p })
+	_, err := a.Train(context.Background())
+	require.NoError(t, err)
+	sent, err := pending.Weights(context.Background())
+	require.NoError(t, err)
+	full, err := a.GetWeights(context.Background())
+	require.NoError(t, err)
+	bias := slices.Clone(b.backend.(*GoBackend).bias)
+
+	// run
+	errSent := b.importWeights(context.Background(), sent, 1)
+	errFull := b.importWeights(context.Background(), full, 1)
+
+	// verify
+	require.NoError(t, errSent)
+	require.NoError(t, errFull, "local tensors of incoming weights should be ignored")
+	tm, err := sent.Tensors()
+	require.NoError(t, err)
+	require.Len(t, tm.Tensors, 1)
+	assert.Equal(t, "weight", tm.Tensors[0].Name, "local tensors should not be sent")
+	assert.Equal(t, a.backend.(*GoBackend).weights, b.backend.(*GoBackend).weights)
+	assert.Equal(t, bias, b.backend.(*GoBackend).bias, "local tensors should not be imported")
+}
+
+// failingImport fails the import after the first ok imports.
+type failingImport struct {
+	Backend
+	ok    int
+	calls int
+}
+
+func (f *failingImport) Import(ctx context.Context, weights *structs.Weights, ratio float32, layers map[string]float32) error {
+	f.calls++
+	if f.calls == f.ok+1 {
+		return errors.New("import failed")
+	}
+	return f.Backend.Import(ctx, weights, ratio, layers)
+}
+
+func TestModelApplyAllRestoresOnFailure(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	other := newTestModel(t, Timeouts{})
+	_, err := other.Train(context.Background())
+	require.NoError(t, err)
+	w, err := other.GetWeights(context.Background())
+	require.NoError(t, err)
+	before, err := m.GetWeights(context.Background())
+	require.NoError(t, err)
+	backend := m.backend
+	m.backend = &failingImport{Backend: backend, ok: 1}
+
+	// run
+	_, err = m.ApplyAll(context.Background(), []*structs.Weights{w, w}, nil)
+
+	// verify
+	assert.ErrorContains(t, err, "import failed")
+	m.backend = backend
+	after, err := m.GetWeights(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, before.Get(), after.Get(), "a failed batch should not leave earlier imports merged")
+	assert.Equal(t, 1, m.GetAge())
+}
+
+func TestConfigApplyEnvReportsInvalidValues(t *testing.T) {
+	// prepare
+	t.Setenv("MODEL_KEEP_CHECKPOINTS", "all")
+	t.Setenv("MODEL_CHANGE_THRESHOLD", "0.01")
+	t.Setenv("MODEL_EVAL_TIMEOUT", "soon")
+	c := DefaultConfig()
+
+	// run
+	err := c.ApplyEnv()
+
+	// verify
+	assert.ErrorContains(t, err, "MODEL_KEEP_CHECKPOINTS")
+	assert.ErrorContains(t, err, "MODEL_EVAL_TIMEOUT")
+	assert.Equal(t, DefaultConfig().KeepCheckpoints, c.KeepCheckpoints, "invalid values should keep the config")
+	assert.Equal(t, float32(0.01), c.Apply.ChangeThreshold, "valid values should still be applied")
+}
@@ -0,0 +1,382 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vs-ude/btml/internal/privacy"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+var errShutdown = fmt.Errorf("model is shut down: %w", context.Canceled)
+
+// priority orders the queues of the scheduler, jobs with a lower priority
+// run first.
+type priority int
+
+const (
+	priorityExport priority = iota
+	priorityApply
+	priorityTrain
+	priorityEval
+	priorities
+)
+
+func (p priority) String() string {
+	return [priorities]string{"export", "apply", "train", "eval"}[p]
+}
+
+// job is a single model operation waiting for the scheduler. Apply jobs carry
+// their weights instead of run, so pending applies can be merged.
+type job struct {
+	ctx    context.Context
+	queued time.Time
+	run    func(ctx context.Context) error
+	apply  *pendingApply
+	err    error
+	done   chan struct{}
+}
+
+type pendingApply struct {
+	weights  []*structs.Weights
+	discount func(staleness int) float32
+	changes  []float32
+}
+
+// scheduler holds a queue of jobs per priority. A single worker runs the jobs
+// of a model, so operations are executed in series.
+type scheduler struct {
+	queues [priorities][]*job
+	wake   chan struct{}
+	closed bool
+	sync.Mutex
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{wake: make(chan struct{}, 1)}
+}
+
+// add queues j, or fails it right away if the scheduler is closed.
+func (s *scheduler) add(prio priority, j *job) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		j.err = errShutdown
+		close(j.done)
+		return
+	}
+	s.queues[prio] = append(s.queues[prio], j)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next removes the jobs to run next from the queues. These are all pending
+// applies or a single other job. Jobs whose context is done are skipped.
+// It returns nil if no job is queued.
+func (s *scheduler) next() (priority, []*job) {
+	s.Lock()
+	defer s.Unlock()
+	for prio := range priorities {
+		queue := s.queues[prio][:0]
+		for _, j := range s.queues[prio] {
+			if err := j.ctx.Err(); err != nil {
+				j.err = err
+				close(j.done)
+				continue
+			}
+			queue = append(queue, j)
+		}
+		s.queues[prio] = queue
+		if len(queue) == 0 {
+			continue
+		}
+		if prio == priorityApply {
+			s.queues[prio] = nil
+			return prio, queue
+		}
+		s.queues[prio] = queue[1:]
+		return prio, queue[:1]
+	}
+	return 0, nil
+}
+
+// len returns the number of queued jobs.
+func (s *scheduler) len() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, queue := range s.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// close fails all queued jobs and every job added later.
+func (s *scheduler) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	for prio, queue := range s.queues {
+		for _, j := range queue {
+			j.err = errShutdown
+			close(j.done)
+		}
+		s.queues[prio] = nil
+	}
+}
+
+// submit queues run with the given priority and waits until it ran. It
+// returns the error of run, or the error of ctx if ctx was done before run
+// started.
+func (m *Model) submit(ctx context.Context, prio priority, run func(ctx context.Context) error) error {
+	j := &job{ctx: ctx, queued: time.Now(), run: run, done: make(chan struct{})}
+	m.scheduler.add(prio, j)
+	<-j.done
+	return j.err
+}
+
+// submitApply queues weights to be merged together with all other pending
+// applies and waits until they are applied.
+func (m *Model) submitApply(ctx context.Context, weights []*structs.Weights, discount func(staleness int) float32) ([]float32, error) {
+	j := &job{
+		ctx:    ctx,
+		queued: time.Now(),
+		apply:  &pendingApply{weights: weights, discount: discount},
+		done:   make(chan struct{}),
+	}
+	m.scheduler.add(priorityApply, j)
+	<-j.done
+	return j.apply.changes, j.err
+}
+
+// schedule is the worker of the scheduler. It runs the queued jobs with the
+// model locked until the model is shut down.
+func (m *Model) schedule() {
+	defer m.scheduler.close()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.scheduler.wake:
+		}
+		for m.ctx.Err() == nil {
+			prio, jobs := m.scheduler.next()
+			if jobs == nil {
+				break
+			}
+			m.runJobs(prio, jobs)
+		}
+	}
+}
+
+// runJobs runs the jobs taken from one queue and notifies the callback if
+// they changed the model.
+func (m *Model) runJobs(prio priority, jobs []*job) {
+	if m.telemetry != nil {
+		queued := m.scheduler.len()
+		for _, j := range jobs {
+			go m.telemetry.RecordQueueWait(prio.String(), time.Since(j.queued), queued)
+		}
+	}
+	m.Lock()
+	revision := m.revision
+	if prio == priorityApply {
+		m.applyPending(jobs)
+	} else {
+		jobs[0].err = jobs[0].run(jobs[0].ctx)
+	}
+	var pending *PendingWeights
+	if m.revision != revision {
+		pending = &PendingWeights{model: m, age: m.age}
+		if n := len(m.trainLossHistory); n > 0 {
+			pending.loss = m.trainLossHistory[n-1].loss
+		}
+	}
+	m.Unlock()
+	if pending != nil && m.modelModifiedCallback != nil {
+		m.modelModifiedCallback(pending)
+	}
+	for _, j := range jobs {
+		close(j.done)
+	}
+}
+
+// applyPending merges the weights of all pending applies in one step. Each
+// apply keeps its own discount. If several applies are merged, weights the
+// model rejects only fail their own apply. It assumes that the model is
+// locked.
+func (m *Model) applyPending(jobs []*job) {
+	if len(jobs) > 1 {
+		var valid []*job
+		for _, j := range jobs {
+			if j.err = m.checkWeights(j.ctx, j.apply.weights); j.err == nil {
+				valid = append(valid, j)
+			}
+		}
+		jobs = valid
+		if len(jobs) == 0 {
+			return
+		}
+	}
+	var weights []*structs.Weights
+	var owners []*pendingApply
+	for _, j := range jobs {
+		weights = append(weights, j.apply.weights...)
+		for range j.apply.weights {
+			owners = append(owners, j.apply)
+		}
+	}
+	ctx, cancel := m.anyActive(jobs)
+	defer cancel()
+	changes, err := m.applyAll(ctx, weights, func(i, staleness int) float32 {
+		if owners[i].discount == nil {
+			return 1
+		}
+		return owners[i].discount(staleness)
+	})
+	for _, j := range jobs {
+		j.err = err
+		if err == nil {
+			j.apply.changes, changes = changes[:len(j.apply.weights)], changes[len(j.apply.weights):]
+		}
+	}
+}
+
+// checkWeights rejects weights whose shared tensors do not match the model.
+// It assumes that the model is locked.
+func (m *Model) checkWeights(ctx context.Context, weights []*structs.Weights) error {
+	if len(weights) == 0 {
+		return errors.New("no weights to apply")
+	}
+	for _, w := range weights {
+		if w.IsFlat() {
+			continue
+		}
+		tm, err := w.Tensors()
+		if err == nil {
+			err = m.checkLayout(ctx, tm)
+		}
+		if err != nil {
+			return fmt.Errorf("rejected weights: %w", err)
+		}
+	}
+	return nil
+}
+
+// anyActive returns a context that is done once the contexts of all jobs are
+// done or the model is shut down.
+func (m *Model) anyActive(jobs []*job) (context.Context, context.CancelFunc) {
+	if len(jobs) == 1 {
+		return context.WithCancel(jobs[0].ctx)
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	var active atomic.Int32
+	active.Store(int32(len(jobs)))
+	stops := make([]func() bool, len(jobs))
+	for i, j := range jobs {
+		stops[i] = context.AfterFunc(j.ctx, func() {
+			if active.Add(-1) == 0 {
+				cancel()
+			}
+		})
+	}
+	return ctx, func() {
+		for _, stop := range stops {
+			stop()
+		}
+		cancel()
+	}
+}
+
+// PendingWeights are the weights of a changed model. They are only exported
+// from the model when they are fetched, so changes that are never sent do
+// not cost an export.
+type PendingWeights struct {
+	model *Model
+	age   int
+	loss  float32
+}
+
+// Age returns the age of the model after the change.
+func (p *PendingWeights) Age() int {
+	return p.age
+}
+
+// Loss returns the training loss of the change.
+func (p *PendingWeights) Loss() float32 {
+	return p.loss
+}
+
+// Weights exports the current weights of the model. Weights that are sent
+// carry their lineage, only hold the shared tensors and, with differential
+// privacy, spend the privacy budget. If the model changed since, the weights
+// of the newer version are returned, as queued applies often run before the
+// export. Every version is only exported once.
+func (p *PendingWeights) Weights(ctx context.Context) (w *structs.Weights, err error) {
+	m := p.model
+	err = m.submit(ctx, priorityExport, func(ctx context.Context) error {
+		if m.exported != nil && m.exportedRevision == m.revision {
+			w = m.exported
+			return nil
+		}
+		if w, err = m.export(ctx); err != nil {
+			return err
+		}
+		m.exported, m.exportedRevision = w, m.revision
+		return nil
+	})
+	return
+}
+
+// Local fetches the current weights of the model for local decisions, like
+// whether a change is worth sending. They only hold the shared tensors but
+// neither carry a lineage nor spend the privacy budget, so they must not be
+// sent. Without differential privacy they are the weights that are sent.
+func (p *PendingWeights) Local(ctx context.Context) (w *structs.Weights, err error) {
+	m := p.model
+	if m.privacy == nil {
+		return p.Weights(ctx)
+	}
+	err = m.submit(ctx, priorityExport, func(ctx context.Context) error {
+		if w, err = m.getWeights(ctx); err != nil {
+			return err
+		}
+		w, err = m.share(w)
+		return err
+	})
+	return
+}
+
+// export fetches the weights that are sent. With differential privacy they
+// are private, and none are exported once the budget is spent. It assumes
+// that the model is locked.
+func (m *Model) export(ctx context.Context) (*structs.Weights, error) {
+	var w *structs.Weights
+	var err error
+	if m.privacy != nil {
+		w, err = m.getPrivateWeights(ctx)
+	} else {
+		w, err = m.getWeights(ctx)
+	}
+	if errors.Is(err, privacy.ErrBudgetExhausted) {
+		if !m.privacyExhausted {
+			slog.Info("Privacy budget spent, no longer sending weights")
+			m.privacyExhausted = true
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	if w, err = m.share(w); err != nil {
+		return nil, fmt.Errorf("failed to select shared weights: %w", err)
+	}
+	m.release(w)
+	return w, nil
+}
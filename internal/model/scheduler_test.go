@@ -0,0 +1,106 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+// block occupies the scheduler of m until the returned function is called.
+func block(t *testing.T, m *Model) func() {
+	running, release := make(chan struct{}), make(chan struct{})
+	go m.submit(context.Background(), priorityTrain, func(context.Context) error {
+		close(running)
+		<-release
+		return nil
+	})
+	<-running
+	return func() { close(release) }
+}
+
+func TestSchedulerCoalescesApplies(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	other := newTestModel(t, Timeouts{})
+	w, err := other.GetWeights(context.Background())
+	require.NoError(t, err)
+	changes := 0
+	m.SetCallback(func(*PendingWeights) { changes++ })
+	release := block(t, m)
+
+	// run
+	wg := sync.WaitGroup{}
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = m.Apply(context.Background(), w)
+		}()
+	}
+	require.Eventually(t, func() bool { return m.scheduler.len() == 3 }, 5*time.Second, time.Millisecond)
+	release()
+	wg.Wait()
+
+	// verify
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, m.GetAge(), "pending applies should be merged in a single step")
+	assert.Equal(t, 1, changes)
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	release := block(t, m)
+	var order []priority
+	wg := sync.WaitGroup{}
+
+	// run
+	for i, prio := range []priority{priorityEval, priorityTrain, priorityExport} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.submit(context.Background(), prio, func(context.Context) error {
+				order = append(order, prio)
+				return nil
+			})
+		}()
+		require.Eventually(t, func() bool { return m.scheduler.len() == i+1 }, 5*time.Second, time.Millisecond)
+	}
+	release()
+	wg.Wait()
+
+	// verify
+	assert.Equal(t, []priority{priorityExport, priorityTrain, priorityEval}, order)
+}
+
+func TestPendingWeightsExportCurrentVersion(t *testing.T) {
+	// prepare
+	m := newTestModel(t, Timeouts{})
+	var pending []*PendingWeights
+	m.SetCallback(func(p *PendingWeights) { pending = append(pending, p) })
+
+	// run
+	for range 2 {
+		_, err := m.Train(context.Background())
+		require.NoError(t, err)
+	}
+	old, errOld := pending[0].Weights(context.Background())
+	first, errNew := pending[1].Weights(context.Background())
+	second, errAgain := pending[1].Weights(context.Background())
+
+	// verify
+	require.NoError(t, errOld, "a superseded version should export the current weights")
+	require.NoError(t, errNew)
+	require.NoError(t, errAgain)
+	assert.Same(t, old, first)
+	assert.Same(t, first, second, "a version should only be exported once")
+	assert.Equal(t, structs.HashWeights(first.Get()), first.GetLineage().Hash)
+}
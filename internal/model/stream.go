@@ -0,0 +1,82 @@
+package model
+
+import (
+	"bytes"
+	context "context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	streamThreshold = 3 << 20 // Weights above this size are streamed, below the 4MB gRPC message limit
+	streamChunkSize = 1 << 20
+)
+
+// importStream sends the weights in chunks, followed by their checksum.
+func importStream(ctx context.Context, client ImportWeightsClient, weights []byte, ratio float32, layers map[string]float32, flat bool) error {
+	stream, err := client.ImportWeightsStream(ctx)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(weights) || start == 0; start += streamChunkSize {
+		chunk := &WeightsChunk{Data: weights[start:min(start+streamChunkSize, len(weights))]}
+		if start == 0 {
+			chunk.WeightRatio = ratio
+			chunk.LayerRatios = layers
+			chunk.Flat = flat
+		}
+		if start+streamChunkSize >= len(weights) {
+			sum := sha256.Sum256(weights)
+			chunk.Sha256 = sum[:]
+		}
+		if err = stream.Send(chunk); err != nil {
+			// The actual error is returned by CloseAndRecv
+			break
+		}
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if !res.Success {
+		return errors.New(res.ErrorMessage)
+	}
+	return nil
+}
+
+// exportStream receives the weights in chunks and verifies their checksum.
+// For private exports it also returns the norm of the change.
+func exportStream(ctx context.Context, client ExportWeightsClient, privacy *PrivacyParams, flat bool) ([]byte, float32, error) {
+	stream, err := client.ExportWeightsStream(ctx, &ExportRequest{Privacy: privacy, Flat: flat})
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	var sum []byte
+	var norm float32
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if chunk.ErrorMessage != "" {
+			return nil, 0, errors.New(chunk.ErrorMessage)
+		}
+		buf.Write(chunk.Data)
+		if chunk.Sha256 != nil {
+			sum = chunk.Sha256
+			norm = chunk.UpdateNorm
+		}
+	}
+	if sum == nil {
+		return nil, 0, errors.New("stream ended without checksum")
+	}
+	if actual := sha256.Sum256(buf.Bytes()); !bytes.Equal(actual[:], sum) {
+		return nil, 0, fmt.Errorf("checksum mismatch after %d bytes", buf.Len())
+	}
+	return buf.Bytes(), norm, nil
+}
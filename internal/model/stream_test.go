@@ -0,0 +1,107 @@
+package model
+
+import (
+	"bytes"
+	context "context"
+	"crypto/sha256"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// fakeWeightsServer stores imported weights and exports them again.
+type fakeWeightsServer struct {
+	UnimplementedImportWeightsServer
+	UnimplementedExportWeightsServer
+	weights     []byte
+	ratio       float32
+	badChecksum bool
+}
+
+func (f *fakeWeightsServer) ImportWeightsStream(stream grpc.ClientStreamingServer[WeightsChunk, ImportResponse]) error {
+	var buf bytes.Buffer
+	var sum []byte
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if buf.Len() == 0 {
+			f.ratio = chunk.WeightRatio
+		}
+		buf.Write(chunk.Data)
+		sum = chunk.Sha256
+	}
+	if actual := sha256.Sum256(buf.Bytes()); !bytes.Equal(actual[:], sum) {
+		return stream.SendAndClose(&ImportResponse{ErrorMessage: "checksum mismatch"})
+	}
+	f.weights = buf.Bytes()
+	return stream.SendAndClose(&ImportResponse{Success: true})
+}
+
+func (f *fakeWeightsServer) ExportWeightsStream(_ *ExportRequest, stream grpc.ServerStreamingServer[WeightsChunk]) error {
+	sum := sha256.Sum256(f.weights)
+	if f.badChecksum {
+		sum[0]++
+	}
+	if err := stream.Send(&WeightsChunk{Data: f.weights}); err != nil {
+		return err
+	}
+	return stream.Send(&WeightsChunk{Sha256: sum[:]})
+}
+
+func newFakeWeightsConn(t *testing.T, f *fakeWeightsServer) *grpc.ClientConn {
+	socket := filepath.Join(t.TempDir(), "model.sock")
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	RegisterImportWeightsServer(server, f)
+	RegisterExportWeightsServer(server, f)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWeightsStreamRoundtrip(t *testing.T) {
+	// prepare
+	f := &fakeWeightsServer{}
+	conn := newFakeWeightsConn(t, f)
+	weights := make([]byte, streamChunkSize*5/2)
+	for i := range weights {
+		weights[i] = byte(i)
+	}
+
+	// run
+	err := importStream(context.Background(), NewImportWeightsClient(conn), weights, 0.5, nil, false)
+	require.NoError(t, err)
+	exported, _, err := exportStream(context.Background(), NewExportWeightsClient(conn), nil, false)
+
+	// verify
+	require.NoError(t, err)
+	assert.Equal(t, float32(0.5), f.ratio)
+	assert.Equal(t, weights, f.weights)
+	assert.Equal(t, weights, exported)
+}
+
+func TestExportStreamChecksumMismatch(t *testing.T) {
+	// prepare
+	f := &fakeWeightsServer{weights: []byte("weights"), badChecksum: true}
+	conn := newFakeWeightsConn(t, f)
+
+	// run
+	_, _, err := exportStream(context.Background(), NewExportWeightsClient(conn), nil, false)
+
+	// verify
+	assert.ErrorContains(t, err, "checksum")
+}
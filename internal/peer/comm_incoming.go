@@ -1,6 +1,7 @@
 package peer
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -12,9 +13,14 @@ import (
 	"github.com/quic-go/quic-go"
 	"github.com/vs-ude/btml/internal/model"
 	"github.com/vs-ude/btml/internal/structs"
+	"github.com/vs-ude/btml/internal/trust"
 	"google.golang.org/protobuf/proto"
 )
 
+// maxMessageSize limits the size of received messages, leaving room for the
+// fields of a model update besides the weights.
+const maxMessageSize = structs.MaxTensorMapSize + 1<<20
+
 func (me *Me) Listen() {
 	defer func() {
 		me.server.Close()
@@ -37,7 +43,13 @@ func (me *Me) Listen() {
 			slog.Warn("Failed accepting connection", "error", err)
 			continue
 		}
-		if me.peerset.Space() < 1 {
+		if me.tracker.isBannedAddr(conn.RemoteAddr()) {
+			conn.CloseWithError(quic.ApplicationErrorCode(CHOKED), "peer is banned")
+			continue
+		}
+		// Members of a secure aggregation group are accepted anyway, which is
+		// only known after the peer info
+		if me.secagg == nil && me.peerset.Space() < 1 {
 			conn.CloseWithError(quic.ApplicationErrorCode(CHOKED), "peer set full")
 			continue
 		}
@@ -55,7 +67,7 @@ func (me *Me) handleConnection(conn *quic.Conn) {
 		conn.CloseWithError(0, "closed")
 		return
 	}
-	err = me.handlePeerInfo(stream, conn.RemoteAddr().(*net.UDPAddr))
+	peer, err := me.handlePeerInfo(stream, conn.RemoteAddr().(*net.UDPAddr))
 	if err != nil {
 		slog.Warn("New connection but not an active peer", "error", err)
 		conn.CloseWithError(quic.ApplicationErrorCode(CHOKED), "closed")
@@ -77,37 +89,49 @@ func (me *Me) handleConnection(conn *quic.Conn) {
 			return
 		}
 
-		go me.handleStream(stream)
+		go me.handleStream(stream, peer)
 	}
 }
 
-func (me *Me) handlePeerInfo(stream *quic.Stream, addr *net.UDPAddr) error {
+// handlePeerInfo reads the PeerInfo of a new connection, adds the peer and
+// returns its name.
+func (me *Me) handlePeerInfo(stream *quic.Stream, addr *net.UDPAddr) (string, error) {
 	defer stream.Close()
-	msgLen, err := readLengthPrefix(stream)
-	if err != nil {
-		return fmt.Errorf("Unable to read PeerInfo length %w", err)
-	}
-	msgBuf := make([]byte, msgLen)
-	_, err = io.ReadFull(stream, msgBuf)
+	stream.SetDeadline(time.Now().Add(peerInfoTimeout))
+	msgBuf, err := readMessage(stream, maxControlMessageSize)
 	if err != nil {
-		return fmt.Errorf("Unable to read PeerInfo body %w", err)
+		return "", fmt.Errorf("Unable to read PeerInfo %w", err)
 	}
 	peerInfo := &PeerInfo{}
 	err = proto.Unmarshal(msgBuf, peerInfo)
 	if err != nil {
-		return fmt.Errorf("Unable to unmarshal PeerInfo %w", err)
+		return "", fmt.Errorf("Unable to unmarshal PeerInfo %w", err)
 	}
 
+	if me.tracker.IsBanned(peerInfo.Id) {
+		return "", fmt.Errorf("peer %s is banned", peerInfo.Id)
+	}
+	if peerInfo.Architecture != me.arch {
+		return "", fmt.Errorf("peer %s uses architecture %q instead of %q", peerInfo.Id, peerInfo.Architecture, me.arch)
+	}
 	p := &structs.Peer{
 		Name:        peerInfo.Id,
 		Fingerprint: peerInfo.Fingerprint,
 		Addr:        addr,
 		LastSeen:    time.Now(),
 	}
-	return me.peerset.Add(p)
+	member := me.secagg != nil && me.secagg.isMember(p.Name)
+	if me.secagg != nil && !member && me.peerset.Space() < 1 {
+		return "", errors.New("peer set full")
+	}
+	if err = me.peerset.Add(p); err != nil && !member {
+		return "", err
+	}
+	return p.Name, writeMessage(stream, myPeerInfo)
 }
 
-func (me *Me) handleStream(stream *quic.Stream) {
+// handleStream reads the messages of a stream of a connection with peer.
+func (me *Me) handleStream(stream *quic.Stream, peer string) {
 	defer stream.Close()
 
 	for {
@@ -119,6 +143,11 @@ func (me *Me) handleStream(stream *quic.Stream) {
 			return
 		}
 
+		if msgLen > maxMessageSize {
+			slog.Warn("Rejected too large message", "size", msgLen)
+			return
+		}
+
 		// Read the actual message
 		msgBuf := make([]byte, msgLen)
 		_, err = io.ReadFull(stream, msgBuf)
@@ -137,10 +166,162 @@ func (me *Me) handleStream(stream *quic.Stream) {
 			continue
 		}
 
-		w := structs.NewWeights(update.Weights, int(update.Age))
+		if update.ShareRequest != nil || update.KeyExchange != nil || update.GroupInvite != nil || update.GroupCommit != nil {
+			if me.secagg == nil {
+				slog.Warn("Ignoring secure aggregation message without secure aggregation", "source", update.Source)
+				return
+			}
+			// Shares, keys and groups are only ever bound to the peer of the
+			// connection
+			if err = me.secagg.handle(stream, peer, update); err != nil {
+				slog.Warn("Failed handling secure aggregation message", "peer", peer, "error", err)
+			}
+			return
+		}
+
+		if update.Architecture != me.arch {
+			slog.Warn("Rejected model update of another architecture", "source", update.Source, "architecture", update.Architecture)
+			continue
+		}
+		if (update.Masked != nil) != (me.secagg != nil) {
+			slog.Warn("Rejected model update with mismatching secure aggregation", "source", update.Source, "masked", update.Masked != nil)
+			continue
+		}
+		if update.Piece != nil || len(update.Have) > 0 {
+			if me.pieces == nil {
+				slog.Warn("Ignoring piece without piece distribution", "source", update.Source)
+				continue
+			}
+			if kp := me.peerset.Known(update.GetSource()); kp != nil {
+				kp.ledger.recordBytesReceived(len(msgBuf))
+			}
+			if update.Piece != nil {
+				me.receivePiece(update)
+			} else {
+				me.pieces.setHave(update.Source, update.Have)
+			}
+			continue
+		}
+
+		var w *structs.Weights
+		if update.Masked != nil {
+			if update.Source != peer {
+				slog.Warn("Rejected masked model update of another source", "source", update.Source, "peer", peer)
+				continue
+			}
+			u, err := me.secagg.unmask(update)
+			if err != nil {
+				slog.Warn("Rejected masked model update", "source", update.Source, "error", err)
+				continue
+			}
+			w = structs.NewWeights(nil, int(update.Age))
+			w.SetMasked(u)
+		} else {
+			// The tensors are checked here, so invalid weights never reach the model
+			if _, err = structs.DecodeTensorMap(update.Weights); err != nil {
+				slog.Warn("Rejected invalid model update", "source", update.Source, "error", err)
+				continue
+			}
+			if l := update.Lineage; l != nil && !bytes.Equal(l.Hash, structs.HashWeights(update.Weights)) {
+				slog.Warn("Rejected model update with wrong hash", "source", update.Source)
+				continue
+			}
+			w = structs.NewWeights(update.Weights, int(update.Age))
+		}
+		w.SetSource(update.GetSource())
+		w.SetSamples(int(update.Samples))
+		w.SetLineage(unmarshalLineage(update.Lineage))
+
+		if kp := me.peerset.Known(update.GetSource()); kp != nil {
+			kp.ledger.recordReceived(len(msgBuf))
+		}
+		me.receive(w)
+	}
+}
+
+// receive passes weights on to the model unless they are a duplicate.
+func (me *Me) receive(w *structs.Weights) {
+	source := w.GetSource()
+	if me.isDuplicate(w) {
+		total := me.duplicates.Add(1)
+		slog.Info("Dropped duplicate model update", "source", source, "age", w.GetAge(), "duplicates", total)
+		if me.telemetry != nil {
+			go me.telemetry.RecordDuplicate(source, w.GetAge(), total)
+		}
+		return
+	}
+
+	slog.Info("Received model update", "source", source, "age", w.GetAge(), "samples", w.GetSamples())
+	kp := me.peerset.Known(source)
+	if kp != nil {
+		w.SetTrust(float32(kp.GetScore()) / float32(trust.MaxScore))
+	}
+	dropped, replaced := me.incoming.push(me.Ctx, model.NewWeightsWithCallback(w, applyCallback(kp)))
+	if dropped == nil {
+		return
+	}
+	// Dropped updates never reached the model, so they are accepted again
+	me.forgetSeen(dropped.ToWeights())
+	if me.Ctx.Err() != nil {
+		return
+	}
+	depth, drops, replacements := me.incoming.counts()
+	if replaced {
+		slog.Info("Replaced queued model update", "source", source, "age", dropped.GetAge(), "replaced", replacements)
+	} else {
+		slog.Info("Dropped model update from full queue", "source", dropped.GetSource(), "age", dropped.GetAge(), "policy", me.incoming.policy, "dropped", drops)
+	}
+	if me.telemetry != nil {
+		go me.telemetry.RecordIncomingDrop(dropped.GetSource(), dropped.GetAge(), me.incoming.policy, replaced, depth, drops, replacements)
+	}
+}
+
+// applyCallback returns the callback for the outcome of applying an update
+// of the peer. Updates of peers that are not known, like versions assembled
+// from pieces of an origin that is not in the peer set, change no score.
+func applyCallback(kp *KnownPeer) func(int) {
+	if kp == nil {
+		return func(int) {}
+	}
+	return kp.ApplyResult
+}
+
+// Incoming passes the queued updates on to the listener of incoming weights
+// until the peer is shut down.
+func (me *Me) Incoming() {
+	defer me.Wg.Done()
+	defer close(me.data.incomingChan)
+
+	for {
+		w, ok := me.incoming.pop(me.Ctx)
+		if !ok {
+			return
+		}
+		select {
+		case me.data.incomingChan <- w:
+		case <-me.Ctx.Done():
+			return
+		}
+	}
+}
+
+// isDuplicate reports whether the weights were received before or are own
+// weights sent back, and otherwise remembers them in one step, so of
+// concurrent copies only the first one is passed on. Masked updates are
+// unique per recipient and round and are never duplicates.
+func (me *Me) isDuplicate(w *structs.Weights) bool {
+	if w.GetMasked() != nil {
+		return false
+	}
+	hash := w.Hash()
+	return me.pds.Lookup(hash) != nil || me.seen.Add(hash)
+}
 
-		slog.Info("Received model update", "source", update.Source, "age", update.Age)
-		me.data.incomingChan <- model.NewWeightsWithCallback(w, me.peerset.known[update.GetSource()].UpdateScore)
+// forgetSeen undoes isDuplicate for weights that were dropped or replaced
+// before they reached the model.
+func (me *Me) forgetSeen(w *structs.Weights) {
+	if w.GetMasked() == nil {
+		me.seen.Remove(w.Hash())
 	}
 }
 
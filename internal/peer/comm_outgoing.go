@@ -25,12 +25,26 @@ func (me *Me) Outgoing() {
 			if me.telemetry != nil {
 				me.telemetry.RecordOnline(data.GetAge())
 			}
-			bytes, err := marshalUpdate(data, me.config.Name)
+			if me.secagg != nil {
+				me.sendMasked(data, wg)
+				continue
+			}
+			if me.pieces != nil {
+				// The pieces are sent by PiecesLoop, so the rate limit holds
+				if err := me.pieces.addVersion(data, me.config.Name); err != nil {
+					slog.Warn("Failed splitting model update into pieces", "error", err)
+				}
+				continue
+			}
+			bytes, err := marshalUpdate(data, me.config.Name, me.arch)
 			if err != nil {
 				slog.Warn("Failed marshaling model update", "error", err)
 				continue
 			}
 			for _, peer := range me.peerset.GetUnchoked() {
+				if peer.IsFreeRider() {
+					continue
+				}
 				if distribute, _ := me.pds.Decide(peer, data); !distribute {
 					continue
 				}
@@ -49,19 +63,28 @@ func (me *Me) LaggingPeersLoop() {
 	var data *structs.Weights
 	var err error
 	timer := time.NewTimer(time.Second)
-	wait := time.Duration(time.Second * 5)
+	wait := me.config.Tuning.LaggingInterval
 	for {
 		select {
 		case <-me.Ctx.Done():
 			return
 		case <-timer.C:
 			wg.Wait() // We wait here so the application can be stopped at any time
+			if me.secagg != nil || me.pieces != nil {
+				// Masked updates of past rounds would not be aggregated
+				// anymore, pieces are sent to lagging peers by PiecesLoop
+				timer.Reset(wait)
+				continue
+			}
 			for _, peer := range me.peerset.GetUnchoked() {
+				if peer.IsFreeRider() {
+					continue
+				}
 				if data, err = me.pds.Retrieve(peer.LastSentUpdateAge); err != nil {
 					slog.Debug("Did not get data for peer", "peer", peer.Name, "error", err)
 					continue
 				}
-				bytes, err := marshalUpdate(data, me.config.Name)
+				bytes, err := marshalUpdate(data, me.config.Name, me.arch)
 				if err != nil {
 					slog.Warn("Failed marshaling model update", "error", err)
 					continue
@@ -76,17 +99,63 @@ func (me *Me) LaggingPeersLoop() {
 	}
 }
 
-func marshalUpdate(data *structs.Weights, source string) ([]byte, error) {
+// sendMasked sends the update masked for all other members of the group of
+// the current round. The masks only cancel if every member gets the update,
+// so neither choking nor the distribution strategy apply.
+func (me *Me) sendMasked(data *structs.Weights, wg *sync.WaitGroup) {
+	messages, err := me.secagg.mask(data)
+	if err != nil {
+		slog.Info("Not sending a masked update", "error", err)
+		return
+	}
+	for name, msg := range messages {
+		peer := me.peerset.Known(name)
+		if peer == nil {
+			slog.Warn("Member of the secure aggregation group is unknown", "peer", name)
+			continue
+		}
+		slog.Debug("Sending masked data to peer", "target", name, "age", data.GetAge())
+		wg.Add(1)
+		go peer.Send(msg, data.GetAge(), wg, me.Ctx, me.dialPeer)
+	}
+}
+
+func marshalUpdate(data *structs.Weights, source, arch string) ([]byte, error) {
 	// Create and marshal the model update
 	update := &ModelUpdate{
-		Source:  source,
-		Weights: data.Get(),
-		Age:     int64(data.GetAge()),
+		Source:       source,
+		Weights:      data.Get(),
+		Age:          int64(data.GetAge()),
+		Architecture: arch,
+		Samples:      int64(data.GetSamples()),
+		Lineage:      marshalLineage(data.GetLineage()),
 	}
 
 	return proto.Marshal(update)
 }
 
+func marshalLineage(l *structs.Lineage) *Lineage {
+	if l == nil {
+		return nil
+	}
+	versions := make(map[string]int64, len(l.Versions))
+	for peer, steps := range l.Versions {
+		versions[peer] = int64(steps)
+	}
+	return &Lineage{Hash: l.Hash, Parents: l.Parents, Versions: versions}
+}
+
+func unmarshalLineage(l *Lineage) *structs.Lineage {
+	if l == nil {
+		return nil
+	}
+	versions := make(structs.VersionVector, len(l.Versions))
+	for peer, steps := range l.Versions {
+		versions[peer] = int(steps)
+	}
+	return &structs.Lineage{Hash: l.Hash, Parents: l.Parents, Versions: versions}
+}
+
 func (me *Me) dialPeer(addr net.Addr) (*quic.Conn, error) {
 	return me.server.Dial(me.Ctx, addr, me.tlsConfig, me.quicConfig)
 }
@@ -25,11 +25,18 @@ import (
 type Config struct {
 	Name                string
 	TrackerURL          string
+	SwarmToken          string
 	UpdateFreq          time.Duration // Any value < 1 means off
 	ModelConf           *model.Config
 	Addr                string // Omitting ip means 'all interfaces' while omitting the port means 'random'
 	PeerSetSize         int
 	PeerSetArchiveAfter time.Duration // Time after last contact, when a peer should be considered gone
+	Reciprocity         ReciprocityPolicy
+	ReportAfter         int  // Consecutive harmful updates before a peer is reported, any value < 1 means off
+	Pieces              bool // Distribute versions in pieces, rarest first
+	Incoming            structs.QueueConfig
+	Send                structs.SendConfig
+	Tuning              structs.Tuning // Zero values select the defaults
 	TelConf             *telemetry.TelemetryConf
 }
 
@@ -37,11 +44,20 @@ func Autoconf(c *Config) error {
 	var resp *http.Response
 	var err error
 	for {
-		resp, err = http.Get(c.TrackerURL + "/whoami")
+		var req *http.Request
+		req, err = http.NewRequest("GET", c.TrackerURL+"/whoami", http.NoBody)
+		if err != nil {
+			return fmt.Errorf("unable to create autoconfiguration request: %w", err)
+		}
+		if err = admit(req, c.TrackerURL, c.SwarmToken); err == nil {
+			resp, err = http.DefaultClient.Do(req)
+		}
 		if err == nil && resp.StatusCode == http.StatusOK {
 			break
-		} else if (err != nil && !errors.Is(err, io.EOF)) || (resp != nil && resp.StatusCode != http.StatusServiceUnavailable) {
+		} else if err != nil && !errors.Is(err, io.EOF) {
 			return fmt.Errorf("unable to connect to tracker for autoconfiguration: %w", err)
+		} else if resp != nil && resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests {
+			return fmt.Errorf("tracker refused autoconfiguration: %s", resp.Status)
 		}
 		slog.Info("Waiting for tracker to be ready")
 		time.Sleep(time.Second * 5)
@@ -61,18 +77,43 @@ func Autoconf(c *Config) error {
 	c.Addr = whoami.ExtIp
 	c.UpdateFreq = whoami.UpdateFreq
 	c.ModelConf.Dataset = whoami.Dataset
+	if whoami.DatasetFormat != "" {
+		c.ModelConf.DatasetFormat = whoami.DatasetFormat
+	}
+	if whoami.Architecture != "" {
+		c.ModelConf.Architecture = whoami.Architecture
+	}
+	if whoami.MergePolicy != "" {
+		c.ModelConf.MergePolicy = whoami.MergePolicy
+	}
 	c.ModelConf.Name = c.Name
+	c.ModelConf.Training = whoami.Training
+	c.ModelConf.Privacy = whoami.Privacy
+	c.ModelConf.SecureAggregation = whoami.SecureAggregation
+	c.ModelConf.Sharing = whoami.Sharing
 	c.PeerSetSize = whoami.PeerSetSize
 	c.PeerSetArchiveAfter = whoami.PeerSetArchiveAfter
-	c.TelConf = &whoami.Telemetry
+	c.Reciprocity = ReciprocityPolicy{
+		MinRatio: whoami.FreeRiderRatio,
+		Rounds:   whoami.FreeRiderRounds,
+		MinTaken: whoami.FreeRiderMinTaken,
+	}
+	c.ReportAfter = whoami.ReportAfter
+	c.Pieces = whoami.Pieces
+	c.Incoming = c.Incoming.Override(whoami.Incoming)
+	c.Send = c.Send.Override(whoami.Send)
+	c.Tuning = c.Tuning.Override(whoami.Tuning)
+	if whoami.Telemetry.URL != "" {
+		c.TelConf = &whoami.Telemetry
+	}
 
 	return nil
 }
 
-func generateQUICConfig() *quic.Config {
+func generateQUICConfig(t structs.Tuning) *quic.Config {
 	return &quic.Config{
-		KeepAlivePeriod: time.Second * 15,
-		MaxIdleTimeout:  time.Second * 60,
+		KeepAlivePeriod: t.KeepAlive,
+		MaxIdleTimeout:  t.IdleTimeout,
 	}
 }
 
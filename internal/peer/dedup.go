@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"sync"
+)
+
+// recentHashesSize bounds the number of remembered update hashes.
+const recentHashesSize = 256
+
+// recentHashes remembers the content hashes of the latest received updates,
+// so duplicates are dropped before they are applied.
+type recentHashes struct {
+	order []string // Ring buffer of the hashes in the order they were added
+	next  int
+	set   map[string]bool
+	sync.Mutex
+}
+
+func newRecentHashes(size int) *recentHashes {
+	return &recentHashes{
+		order: make([]string, size),
+		set:   make(map[string]bool, size),
+	}
+}
+
+// Has reports whether the hash was seen before.
+func (r *recentHashes) Has(hash []byte) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.set[string(hash)]
+}
+
+// Add remembers the hash and reports whether it was seen before.
+func (r *recentHashes) Add(hash []byte) bool {
+	key := string(hash)
+	r.Lock()
+	defer r.Unlock()
+	if r.set[key] {
+		return true
+	}
+	delete(r.set, r.order[r.next])
+	r.order[r.next] = key
+	r.set[key] = true
+	r.next = (r.next + 1) % len(r.order)
+	return false
+}
+
+// Remove forgets the hash, so it is not seen anymore.
+func (r *recentHashes) Remove(hash []byte) {
+	key := string(hash)
+	r.Lock()
+	defer r.Unlock()
+	if !r.set[key] {
+		return
+	}
+	delete(r.set, key)
+	// Clear its slot, so it does not evict the hash if it is added again
+	for i, k := range r.order {
+		if k == key {
+			r.order[i] = ""
+		}
+	}
+}
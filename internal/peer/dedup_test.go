@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func TestRecentHashesForgetsOldest(t *testing.T) {
+	// prepare
+	r := newRecentHashes(2)
+
+	// run & verify
+	assert.False(t, r.Add([]byte("a")), "new hash should not be seen")
+	assert.True(t, r.Add([]byte("a")), "repeated hash should be seen")
+	assert.False(t, r.Add([]byte("b")))
+	assert.False(t, r.Add([]byte("c")), "adding a third hash should evict the oldest")
+	assert.False(t, r.Add([]byte("a")), "evicted hash should not be seen")
+	assert.True(t, r.Add([]byte("c")))
+}
+
+func TestRecentHashesHasDoesNotRemember(t *testing.T) {
+	// prepare
+	r := newRecentHashes(2)
+
+	// run & verify
+	assert.False(t, r.Has([]byte("a")), "new hash should not be seen")
+	assert.False(t, r.Has([]byte("a")), "checking a hash should not remember it")
+	r.Add([]byte("a"))
+	assert.True(t, r.Has([]byte("a")))
+}
+
+func TestRecentHashesRemove(t *testing.T) {
+	// prepare
+	r := newRecentHashes(2)
+	r.Add([]byte("a"))
+
+	// run
+	r.Remove([]byte("a"))
+	seen := r.Has([]byte("a"))
+	r.Add([]byte("a"))
+	r.Add([]byte("b"))
+
+	// verify
+	assert.False(t, seen, "removed hash should not be seen")
+	assert.True(t, r.Has([]byte("a")), "the old slot should not evict the hash added again")
+	assert.True(t, r.Has([]byte("b")))
+}
+
+func TestReceivePassesOnConcurrentDuplicatesOnce(t *testing.T) {
+	// prepare
+	// The full queue holds the first copy in push while the others arrive
+	queue, err := newIncomingQueue(structs.QueueConfig{Policy: structs.QueueBlock, Size: 1, Timeout: 200 * time.Millisecond}, nil)
+	require.NoError(t, err)
+	queue.push(context.Background(), queuedUpdate("b", 1, 0))
+	me := &Me{
+		Ctx:      context.Background(),
+		peerset:  NewPeerSet(1, time.Minute, nil),
+		pds:      NewDoubleAgeStorage(1, 0),
+		seen:     newRecentHashes(recentHashesSize),
+		incoming: queue,
+	}
+	const copies = 16
+
+	// run
+	var wg sync.WaitGroup
+	for range copies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := structs.NewWeights([]byte("weights"), 1)
+			w.SetSource("a")
+			me.receive(w)
+		}()
+	}
+	wg.Wait()
+
+	// verify
+	_, dropped, _ := queue.counts()
+	assert.Equal(t, int64(1), dropped, "only the first copy should wait for the queue")
+	assert.Equal(t, int64(copies-1), me.duplicates.Load())
+}
@@ -6,13 +6,18 @@ import (
 	"log/slog"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/quic-go/quic-go"
 	"github.com/vs-ude/btml/internal/structs"
 	"github.com/vs-ude/btml/internal/telemetry"
 	"github.com/vs-ude/btml/internal/trust"
+	"google.golang.org/protobuf/proto"
 )
 
+// peerInfoTimeout limits the time to wait for the PeerInfo reply of a peer.
+const peerInfoTimeout = 10 * time.Second
+
 type peerStatus int
 
 const (
@@ -25,11 +30,17 @@ const (
 
 type KnownPeer struct {
 	score                      trust.Score
+	ledger                     Ledger
+	lowRatioRounds             int
+	freeRider                  bool
+	harmfulStreak              int
+	reported                   bool
 	LastSentUpdateAge          int
 	State                      peerStatus
 	conn                       *quic.Conn
 	telemetry                  *telemetry.Client
 	updateScorePropagationFunc func(*KnownPeer) error
+	misbehaviorFunc            func(*KnownPeer)
 	structs.Peer
 	sync.Mutex
 }
@@ -69,6 +80,35 @@ func (kp *KnownPeer) GetScore() trust.Score {
 	return kp.score
 }
 
+// ApplyResult records the outcome of applying an update received from the
+// peer. Updates that did not make the model worse count as useful for the
+// ledger. A non-zero change is passed on to the score. Consecutive harmful
+// updates are treated as misbehavior.
+func (kp *KnownPeer) ApplyResult(change int) {
+	if change >= 0 {
+		kp.ledger.recordUseful()
+		kp.harmfulStreak = 0
+	} else {
+		kp.harmfulStreak++
+		if kp.misbehaviorFunc != nil {
+			kp.misbehaviorFunc(kp)
+		}
+	}
+	if change != 0 {
+		kp.UpdateScore(change)
+	}
+}
+
+// GetLedger returns a snapshot of the contribution ledger of the peer.
+func (kp *KnownPeer) GetLedger() Ledger {
+	return kp.ledger.Snapshot()
+}
+
+// IsFreeRider reports whether the peer was flagged by the ReciprocityPolicy.
+func (kp *KnownPeer) IsFreeRider() bool {
+	return kp.freeRider
+}
+
 func (kp *KnownPeer) closeConn(reason string) {
 	if kp.conn != nil {
 		kp.Lock()
@@ -92,17 +132,42 @@ func (kp *KnownPeer) choke() error {
 func (kp *KnownPeer) Send(data []byte, age int, wg *sync.WaitGroup, ctx context.Context, dial func(addr net.Addr) (*quic.Conn, error)) {
 	defer wg.Done()
 
-	conn := kp.getOrEstablishConnection(dial, ctx)
-	if conn == nil {
-		return
-	}
-	err := kp.send(conn, data, ctx)
-	if err == nil {
-		kp.LastSentUpdateAge = age
-		if kp.telemetry != nil {
-			kp.telemetry.RecordSend(age, kp.Name)
-		}
+	kp.SendUpdate(data, age, ctx, dial)
+}
+
+// SendUpdate sends an update and reports whether it was delivered.
+func (kp *KnownPeer) SendUpdate(data []byte, age int, ctx context.Context, dial func(addr net.Addr) (*quic.Conn, error)) bool {
+	if !kp.deliver(data, ctx, dial) {
+		return false
+	}
+	kp.LastSentUpdateAge = age
+	kp.ledger.recordSent(len(data))
+	if kp.telemetry != nil {
+		kp.telemetry.RecordSend(age, kp.Name)
 	}
+	return true
+}
+
+// SendPiece sends a further piece of a version, which only counts as sent
+// data in the ledger. It reports whether the piece was delivered.
+func (kp *KnownPeer) SendPiece(data []byte, ctx context.Context, dial func(addr net.Addr) (*quic.Conn, error)) bool {
+	if !kp.deliver(data, ctx, dial) {
+		return false
+	}
+	kp.ledger.recordBytesSent(len(data))
+	return true
+}
+
+// Notify sends a message without weights, like a piece announcement.
+func (kp *KnownPeer) Notify(data []byte, wg *sync.WaitGroup, ctx context.Context, dial func(addr net.Addr) (*quic.Conn, error)) {
+	defer wg.Done()
+
+	kp.deliver(data, ctx, dial)
+}
+
+func (kp *KnownPeer) deliver(data []byte, ctx context.Context, dial func(addr net.Addr) (*quic.Conn, error)) bool {
+	conn := kp.getOrEstablishConnection(dial, ctx)
+	return conn != nil && kp.send(conn, data, ctx) == nil
 }
 
 func (kp *KnownPeer) send(conn *quic.Conn, data []byte, ctx context.Context) error {
@@ -144,13 +209,37 @@ func (kp *KnownPeer) getOrEstablishConnection(dial func(addr net.Addr) (*quic.Co
 			return nil
 		}
 
-		kp.send(conn, myPeerInfo, ctx)
+		if err = kp.exchangePeerInfo(conn, ctx); err != nil {
+			kp.condLog("Failed to exchange peer info", err)
+			conn.CloseWithError(quic.ApplicationErrorCode(CHOKED), "no peer info")
+			return nil
+		}
 
 		kp.conn = conn
 	}
 	return kp.conn
 }
 
+// exchangePeerInfo sends our PeerInfo and reads the reply of the peer.
+func (kp *KnownPeer) exchangePeerInfo(conn *quic.Conn, ctx context.Context) error {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.CancelRead(0)
+	stream.SetDeadline(time.Now().Add(peerInfoTimeout))
+	if err = writeMessage(stream, myPeerInfo); err != nil {
+		return err
+	}
+	stream.Close()
+	data, err := readMessage(stream, maxControlMessageSize)
+	if err != nil {
+		return err
+	}
+	info := &PeerInfo{}
+	return proto.Unmarshal(data, info)
+}
+
 func (kp *KnownPeer) condLog(msg string, err error) {
 	if qerr, ok := err.(*quic.ApplicationError); !ok || qerr.ErrorCode != quic.ApplicationErrorCode(CHOKED) {
 		slog.Warn(msg, "peer", kp.Name, "error", err)
@@ -0,0 +1,117 @@
+package peer
+
+import (
+	"sync"
+)
+
+// Ledger keeps track of what a known peer gave to us and took from us.
+type Ledger struct {
+	UpdatesSent     int
+	UpdatesReceived int
+	UsefulReceived  int
+	BytesSent       int
+	BytesReceived   int
+	sync.Mutex
+}
+
+func (l *Ledger) recordSent(bytes int) {
+	l.Lock()
+	defer l.Unlock()
+	l.UpdatesSent++
+	l.BytesSent += bytes
+}
+
+func (l *Ledger) recordReceived(bytes int) {
+	l.Lock()
+	defer l.Unlock()
+	l.UpdatesReceived++
+	l.BytesReceived += bytes
+}
+
+// recordBytesSent records data that is not a whole update, like a piece.
+func (l *Ledger) recordBytesSent(bytes int) {
+	l.Lock()
+	defer l.Unlock()
+	l.BytesSent += bytes
+}
+
+func (l *Ledger) recordBytesReceived(bytes int) {
+	l.Lock()
+	defer l.Unlock()
+	l.BytesReceived += bytes
+}
+
+func (l *Ledger) recordUseful() {
+	l.Lock()
+	defer l.Unlock()
+	l.UsefulReceived++
+}
+
+// Ratio returns the give/take ratio of the peer, i.e. the amount of useful
+// updates it gave us per update it took from us. It returns -1 as long as
+// the peer did not take anything.
+func (l *Ledger) Ratio() float64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.ratio()
+}
+
+func (l *Ledger) ratio() float64 {
+	if l.UpdatesSent == 0 {
+		return -1
+	}
+	return float64(l.UsefulReceived) / float64(l.UpdatesSent)
+}
+
+// Snapshot returns a copy of the ledger that is safe to read without locking.
+func (l *Ledger) Snapshot() Ledger {
+	l.Lock()
+	defer l.Unlock()
+	return Ledger{
+		UpdatesSent:     l.UpdatesSent,
+		UpdatesReceived: l.UpdatesReceived,
+		UsefulReceived:  l.UsefulReceived,
+		BytesSent:       l.BytesSent,
+		BytesReceived:   l.BytesReceived,
+	}
+}
+
+// ReciprocityPolicy chokes free riders, i.e. peers whose give/take ratio
+// stays below MinRatio for a number of consecutive rechoke rounds.
+type ReciprocityPolicy struct {
+	MinRatio float64 // Any value <= 0 disables the policy
+	Rounds   int     // Consecutive rounds below MinRatio before a peer is choked
+	MinTaken int     // Updates a peer has to take from us before it is judged
+}
+
+// Enforce updates the free rider state of all known peers and chokes the ones
+// that are considered free riders. It returns the names of the choked peers.
+// Peers that improve their ratio again are forgiven.
+func (rp *ReciprocityPolicy) Enforce(ps *PeerSet) []string {
+	if rp == nil || rp.MinRatio <= 0 {
+		return nil
+	}
+	ps.Lock()
+	defer ps.Unlock()
+	choked := make([]string, 0)
+	for name, kp := range ps.known {
+		l := kp.ledger.Snapshot()
+		if l.UpdatesSent < rp.MinTaken {
+			continue
+		}
+		if l.ratio() >= rp.MinRatio {
+			kp.lowRatioRounds = 0
+			kp.freeRider = false
+			continue
+		}
+		kp.lowRatioRounds++
+		if kp.lowRatioRounds >= rp.Rounds {
+			kp.freeRider = true
+			if kp.State == UNCHOKED {
+				ps.choke(name)
+				choked = append(choked, name)
+			}
+		}
+	}
+	return choked
+}
@@ -0,0 +1,81 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedgerRatio(t *testing.T) {
+	// prepare
+	l := &Ledger{}
+
+	// run & verify
+	assert.Equal(t, -1.0, l.Ratio(), "ratio should be undefined without sent updates")
+	l.recordSent(100)
+	l.recordSent(100)
+	l.recordReceived(50)
+	l.recordUseful()
+	assert.Equal(t, 0.5, l.Ratio(), "ratio should be useful received per sent update")
+	assert.Equal(t, 200, l.Snapshot().BytesSent)
+	assert.Equal(t, 50, l.Snapshot().BytesReceived)
+}
+
+func TestApplyResultCountsUseful(t *testing.T) {
+	// prepare
+	ps := buildPeerSet(1)
+	kp := ps.known["peer0"]
+
+	// run
+	kp.ApplyResult(1)
+	kp.ApplyResult(0)
+	kp.ApplyResult(-1)
+
+	// verify
+	assert.Equal(t, 2, kp.GetLedger().UsefulReceived, "only non-negative results should be useful")
+	assert.Equal(t, 0, int(kp.GetScore()), "score should reflect the non-zero changes")
+}
+
+func TestReciprocityPolicyChokesFreeRiders(t *testing.T) {
+	// prepare
+	ps := buildPeerSet(3)
+	for _, kp := range ps.known {
+		kp.LastSeen = time.Now()
+	}
+	for range 4 {
+		ps.known["peer0"].ledger.recordSent(1)
+		ps.known["peer1"].ledger.recordSent(1)
+		ps.known["peer1"].ledger.recordUseful()
+	}
+	ps.known["peer2"].ledger.recordSent(1)
+	rp := &ReciprocityPolicy{MinRatio: 0.5, Rounds: 2, MinTaken: 2}
+
+	// run
+	first := rp.Enforce(ps)
+	second := rp.Enforce(ps)
+
+	// verify
+	assert.Empty(t, first, "no peer should be choked in the first round")
+	assert.Equal(t, []string{"peer0"}, second, "only the free rider should be choked")
+	assert.True(t, ps.known["peer0"].IsFreeRider())
+	assert.Equal(t, CHOKED, ps.known["peer0"].State)
+	assert.False(t, ps.known["peer2"].IsFreeRider(), "peers below MinTaken should not be judged")
+}
+
+func TestReciprocityPolicyForgives(t *testing.T) {
+	// prepare
+	ps := buildPeerSet(1)
+	kp := ps.known["peer0"]
+	kp.LastSeen = time.Now()
+	kp.ledger.recordSent(1)
+	rp := &ReciprocityPolicy{MinRatio: 0.5, Rounds: 1, MinTaken: 1}
+	rp.Enforce(ps)
+
+	// run
+	kp.ledger.recordUseful()
+	rp.Enforce(ps)
+
+	// verify
+	assert.False(t, kp.IsFreeRider(), "peer should be forgiven after its ratio recovered")
+}
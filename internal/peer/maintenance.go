@@ -1,6 +1,7 @@
 package peer
 
 import (
+	"log/slog"
 	"time"
 )
 
@@ -10,7 +11,7 @@ func (me *Me) MaintenanceLoop() {
 	go me.tracker.periodicUpdate(&me.Wg, me.Ctx)
 
 	timer := time.NewTimer(time.Second)
-	wait := time.Duration(time.Second * 30)
+	wait := me.config.Tuning.RechokeInterval
 	for {
 		select {
 		case <-me.Ctx.Done():
@@ -19,6 +20,9 @@ func (me *Me) MaintenanceLoop() {
 			me.UpdatePeerset()
 			if len(me.tracker.Peers.List) > 0 {
 				me.pss.Select(me)
+				if choked := me.config.Reciprocity.Enforce(me.peerset); len(choked) > 0 {
+					slog.Info("Choked free riders", "peers", choked)
+				}
 				me.sendTelemetry()
 				timer.Reset(wait)
 			} else {
@@ -32,12 +36,38 @@ func (me *Me) UpdatePeerset() {
 	me.tracker.Lock()
 	defer me.tracker.Unlock()
 	for _, p := range me.tracker.Peers.List {
+		if me.tracker.Banned.Has(p.Name) {
+			continue
+		}
 		me.peerset.Add(p)
 	}
+	for name := range me.tracker.Banned.List {
+		if kp, ok := me.peerset.known[name]; ok && kp.State == UNCHOKED {
+			me.peerset.Choke(name)
+		}
+	}
 }
 
 func (me *Me) sendTelemetry() {
-	if me.telemetry != nil {
-		me.telemetry.RecordActivePeers(me.peerset.UnchokedToString())
+	if me.telemetry == nil {
+		return
+	}
+	me.telemetry.RecordActivePeers(me.peerset.UnchokedToString())
+	// Copy the ledgers, so the peer set is not locked during the writes
+	type entry struct {
+		name      string
+		ledger    Ledger
+		freeRider bool
+	}
+	me.peerset.Lock()
+	entries := make([]entry, 0, len(me.peerset.known))
+	for name, kp := range me.peerset.known {
+		entries = append(entries, entry{name, kp.GetLedger(), kp.IsFreeRider()})
+	}
+	me.peerset.Unlock()
+	for i := range entries {
+		e := &entries[i]
+		l := &e.ledger
+		me.telemetry.RecordLedger(e.name, l.UpdatesSent, l.UpdatesReceived, l.UsefulReceived, l.BytesSent, l.BytesReceived, l.ratio(), e.freeRider)
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/quic-go/quic-go"
 	"github.com/vs-ude/btml/internal/model"
@@ -39,31 +40,76 @@ type Me struct {
 	pss        PeerSelectionStrategy
 	pds        StorageStrategy
 	data       storage
+	incoming   *incomingQueue // Received updates waiting for incomingChan
+	sendPolicy SendPolicy
+	changes    chan *model.PendingWeights // Latest change of the model that was not offered yet
+	lastSent   *structs.Weights           // Weights sent last, only used by ChangesLoop
 	telemetry  *telemetry.Client
+	arch       string // Architecture ID of the model, updates of other architectures are rejected
+	secagg     *secureAggregation
+	pieces     *pieceStore   // Only set if versions are distributed in pieces
+	seen       *recentHashes // Hashes of received updates
+	duplicates atomic.Int64  // Received updates that were dropped as duplicates
 }
 
 func NewMe(config *Config, telemetry *telemetry.Client, p *structs.Peer) *Me {
 	ctx, cancel := context.WithCancel(context.Background())
-	myPeerInfo, _ = proto.Marshal(&PeerInfo{
-		Id:          p.Name,
-		Fingerprint: p.Fingerprint,
-	})
-	return &Me{
+	config.Tuning = structs.DefaultTuning().Override(config.Tuning)
+	var arch string
+	if config.ModelConf != nil {
+		arch = config.ModelConf.GetArchitecture()
+	}
+	me := &Me{
 		Wg:         sync.WaitGroup{},
 		Ctx:        ctx,
 		cancel:     cancel,
 		config:     config,
 		pss:        &RandomPeerSelectionStrategy{},
-		pds:        NewDoubleAgeStorage(10, 40),
-		quicConfig: generateQUICConfig(),
+		pds:        NewDoubleAgeStorage(config.Tuning.StorageLastN, config.Tuning.StorageStepCap),
+		quicConfig: generateQUICConfig(config.Tuning),
 		tlsConfig:  generateTLSConfig(),
 		data: storage{
-			incomingChan:    make(chan *model.WeightsWithCallback, 10),
-			outgoingChan:    make(chan *structs.Weights, 5),
+			incomingChan:    make(chan *model.WeightsWithCallback),
+			outgoingChan:    make(chan *structs.Weights, config.Tuning.OutgoingCapacity),
 			outgoingStorage: make(map[int]*structs.Weights),
 		},
+		changes:   make(chan *model.PendingWeights, 1),
 		telemetry: telemetry,
+		arch:      arch,
+		seen:      newRecentHashes(recentHashesSize),
+	}
+	queue, err := newIncomingQueue(config.Incoming, nil)
+	if err != nil {
+		slog.Error("Invalid incoming queue config", "error", err)
+		panic(err)
+	}
+	me.incoming = queue
+	if me.sendPolicy, err = NewSendPolicy(config.Send); err != nil {
+		slog.Error("Invalid send policy config", "error", err)
+		panic(err)
+	}
+	info := &PeerInfo{
+		Id:           p.Name,
+		Fingerprint:  p.Fingerprint,
+		Architecture: arch,
+	}
+	if config.ModelConf != nil && config.ModelConf.SecureAggregation.Enabled {
+		sa, err := newSecureAggregation(me, config.ModelConf.SecureAggregation)
+		if err != nil {
+			slog.Error("Failed setting up secure aggregation", "error", err)
+			panic(err)
+		}
+		me.secagg = sa
+	}
+	if config.Pieces {
+		if me.secagg != nil {
+			slog.Warn("Masked updates cannot be distributed in pieces, sending them whole")
+		} else {
+			me.pieces = newPieceStore()
+		}
 	}
+	myPeerInfo, _ = proto.Marshal(info)
+	return me
 }
 
 func (me *Me) Setup() {
@@ -106,7 +152,6 @@ func (me *Me) ListenForWeights() (<-chan *model.WeightsWithCallback, error) {
 func (me *Me) Shutdown() {
 	me.cancel()
 	me.tracker.Leave()
-	close(me.data.incomingChan)
 	me.Wg.Wait()
 }
 
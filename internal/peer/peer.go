@@ -11,33 +11,64 @@ import (
 )
 
 func Start(c *Config, m *model.Model, t *telemetry.Client) *Me {
+	fingerprint, key, err := structs.NewIdentity()
+	if err != nil {
+		slog.Error("Failed generating peer identity", "error", err)
+		panic(err)
+	}
 	self := &structs.Peer{
 		Name:        c.Name,
-		Fingerprint: "abbabbaba",
+		Fingerprint: fingerprint,
 	}
 	me := NewMe(c, t, self)
+	if m != nil {
+		me.incoming.modelAge = m.GetAge
+	}
 	me.Setup()
 	self.Addr = me.localAddr.(*net.UDPAddr)
 
 	me.tracker = &Tracker{
 		URL:        c.TrackerURL,
+		Token:      c.SwarmToken,
 		UpdateFreq: c.UpdateFreq,
+		key:        key,
 	}
 	me.tracker.Setup(c, self)
 
 	me.peerset = NewPeerSet(c.PeerSetSize, c.PeerSetArchiveAfter, me.telemetry)
+	me.peerset.SetReporter(c.ReportAfter, func(accused, reason string) {
+		if err := me.tracker.Report(accused, reason); err != nil {
+			slog.Warn("Failed reporting peer misbehavior", "peer", accused, "error", err)
+		}
+	})
 	me.Wg.Add(1)
 	go me.Listen()
 
 	me.Wg.Add(1)
 	go me.MaintenanceLoop()
 
+	me.Wg.Add(1)
+	go me.Incoming()
+
 	me.Wg.Add(1)
 	go me.Outgoing()
 
 	me.Wg.Add(1)
 	go me.LaggingPeersLoop()
 
+	me.Wg.Add(1)
+	go me.ChangesLoop()
+
+	if me.pieces != nil {
+		me.Wg.Add(1)
+		go me.PiecesLoop()
+	}
+
+	if me.secagg != nil {
+		me.Wg.Add(1)
+		go me.GroupLoop()
+	}
+
 	return me
 }
 
@@ -26,6 +26,8 @@ type PeerSet struct {
 	archiveAfter   time.Duration
 	orderedByScore *list.List
 	telemetry      *telemetry.Client
+	reportAfter    int
+	reportFunc     func(accused, reason string)
 	sync.Mutex
 }
 
@@ -50,8 +52,8 @@ func (ps *PeerSet) Add(p *structs.Peer) error {
 		return err
 	case status == CHOKED:
 		ps.known[p.Name].Update(p)
-		if ps.Space() > 0 {
-			ps.Unchoke(p.Name)
+		if ps.Space() > 0 && !ps.known[p.Name].freeRider {
+			ps.unchoke(p.Name)
 			return nil
 		}
 		return fmt.Errorf("peer is known and choked")
@@ -60,6 +62,7 @@ func (ps *PeerSet) Add(p *structs.Peer) error {
 	case status == UNKNOWN:
 		ps.known[p.Name] = NewKnownPeer(p, ps.telemetry)
 		ps.known[p.Name].updateScorePropagationFunc = ps.UpdateScore
+		ps.known[p.Name].misbehaviorFunc = ps.misbehavior
 		ps.orderedByScore.PushBack(ps.known[p.Name])
 		if ps.Space() > 0 {
 			ps.unchoke(p.Name)
@@ -72,6 +75,24 @@ func (ps *PeerSet) GetUnchoked() map[string]*KnownPeer {
 	return ps.known
 }
 
+// Known returns the known peer of the given name or nil.
+func (ps *PeerSet) Known(name string) *KnownPeer {
+	ps.Lock()
+	defer ps.Unlock()
+	return ps.known[name]
+}
+
+// UnchokedPeers returns copies of the unchoked peers sorted by name.
+func (ps *PeerSet) UnchokedPeers() []structs.Peer {
+	ps.Lock()
+	defer ps.Unlock()
+	peers := make([]structs.Peer, 0, len(ps.unchoked))
+	for _, name := range ps.UnchokedToString() {
+		peers = append(peers, *ps.unchoked[name].Copy())
+	}
+	return peers
+}
+
 // Len returns the number of known peers in the set.
 func (ps *PeerSet) Len() int {
 	return len(ps.known)
@@ -225,6 +246,24 @@ func (ps *PeerSet) updateScore(kp *KnownPeer) error {
 	return nil
 }
 
+// SetReporter configures how misbehaving peers are reported. A peer is
+// reported once after sending `after` consecutive harmful updates. Any value
+// < 1 disables reporting.
+func (ps *PeerSet) SetReporter(after int, report func(accused, reason string)) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.reportAfter = after
+	ps.reportFunc = report
+}
+
+func (ps *PeerSet) misbehavior(kp *KnownPeer) {
+	if ps.reportAfter < 1 || ps.reportFunc == nil || kp.reported || kp.harmfulStreak < ps.reportAfter {
+		return
+	}
+	kp.reported = true
+	go ps.reportFunc(kp.Name, fmt.Sprintf("%d consecutive harmful updates", kp.harmfulStreak))
+}
+
 func (ps *PeerSet) UnchokedToString() []string {
 	keys := make([]string, 0, len(ps.unchoked))
 	for k := range ps.unchoked {
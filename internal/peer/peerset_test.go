@@ -116,3 +116,32 @@ func buildPeerSet(length int) *PeerSet {
 	}
 	return ps
 }
+
+func TestMisbehaviorIsReportedOnce(t *testing.T) {
+	// prepare
+	ps := buildPeerSet(1)
+	reports := make(chan string, 2)
+	ps.SetReporter(2, func(accused, _ string) {
+		reports <- accused
+	})
+
+	// run
+	ps.known["peer0"].ApplyResult(-1)
+	ps.known["peer0"].ApplyResult(0)
+	ps.known["peer0"].ApplyResult(-1)
+	ps.known["peer0"].ApplyResult(-1)
+	ps.known["peer0"].ApplyResult(-1)
+
+	// verify
+	select {
+	case accused := <-reports:
+		assert.Equal(t, "peer0", accused)
+	case <-time.After(time.Second):
+		t.Fatal("misbehaving peer was not reported")
+	}
+	select {
+	case <-reports:
+		t.Error("peer was reported more than once")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
@@ -0,0 +1,443 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/vs-ude/btml/internal/structs"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	maxPieceVersions = 8    // Versions whose pieces are kept for other peers
+	maxPieces        = 1024 // Pieces per version, i.e. layers of the model
+	piecesPerRound   = 2    // Pieces sent to every peer per round
+	pieceInterval    = time.Second
+)
+
+// bitfield marks the held pieces of a version, starting with the most
+// significant bit of the first byte.
+type bitfield []byte
+
+func newBitfield(n int) bitfield {
+	return make(bitfield, (n+7)/8)
+}
+
+func (b bitfield) has(i int) bool {
+	return i/8 < len(b) && b[i/8]&(0x80>>(i%8)) != 0
+}
+
+func (b bitfield) set(i int) {
+	b[i/8] |= 0x80 >> (i % 8)
+}
+
+func (b bitfield) unset(i int) {
+	b[i/8] &^= 0x80 >> (i % 8)
+}
+
+func (b bitfield) empty() bool {
+	return !slices.ContainsFunc(b, func(x byte) bool { return x != 0 })
+}
+
+// pieceVersion is a version of the weights split into pieces. Only the
+// pieces and their bitfield change after it was created.
+type pieceVersion struct {
+	hash    []byte
+	hashes  [][]byte // SHA-256 of every piece
+	pieces  [][]byte // nil for missing pieces
+	have    bitfield
+	missing int
+	origin  string
+	age     int
+	samples int
+	lineage *Lineage
+}
+
+// assemble returns the weights of a complete version. The version hash is
+// chosen by the sender, so it has to match the hash of the lineage as well.
+func (v *pieceVersion) assemble() (*structs.Weights, error) {
+	if !bytes.Equal(v.lineage.GetHash(), v.hash) {
+		return nil, errors.New("version hash does not match the lineage")
+	}
+	data := slices.Concat(v.pieces...)
+	if !bytes.Equal(structs.HashWeights(data), v.hash) {
+		return nil, errors.New("pieces do not match the version hash")
+	}
+	if _, err := structs.DecodeTensorMap(data); err != nil {
+		return nil, err
+	}
+	w := structs.NewWeights(data, v.age)
+	w.SetSource(v.origin)
+	w.SetSamples(v.samples)
+	w.SetLineage(unmarshalLineage(v.lineage))
+	return w, nil
+}
+
+// update returns the message that carries a piece the version holds.
+func (v *pieceVersion) update(index int, source, arch string) *ModelUpdate {
+	return &ModelUpdate{
+		Source:       source,
+		Weights:      v.pieces[index],
+		Age:          int64(v.age),
+		Architecture: arch,
+		Samples:      int64(v.samples),
+		Lineage:      v.lineage,
+		Piece:        &Piece{Version: v.hash, Index: uint32(index), Hashes: v.hashes, Origin: v.origin},
+	}
+}
+
+// scheduledPiece is a piece to send to a peer.
+type scheduledPiece struct {
+	peer    string
+	version *pieceVersion
+	index   int
+	first   bool // The first piece of the version the peer gets
+}
+
+// pieceStore keeps the pieces of the latest versions and the pieces the
+// neighbors announced, so versions spread like torrents: every peer sends
+// the pieces that are rarest among its neighbors and forwards the pieces it
+// received.
+type pieceStore struct {
+	versions  map[string]*pieceVersion
+	order     []string                       // Keys of the versions, oldest first
+	neighbors map[string]map[string]bitfield // Pieces the neighbors hold by peer and version
+	changed   map[string]bool                // Versions with pieces that were not announced yet
+	sync.Mutex
+}
+
+func newPieceStore() *pieceStore {
+	return &pieceStore{
+		versions:  make(map[string]*pieceVersion),
+		neighbors: make(map[string]map[string]bitfield),
+		changed:   make(map[string]bool),
+	}
+}
+
+// addVersion splits own weights into pieces. The weights need a lineage.
+func (s *pieceStore) addVersion(w *structs.Weights, origin string) error {
+	l := w.GetLineage()
+	if l == nil {
+		return errors.New("weights without lineage")
+	}
+	pieces, err := structs.SplitLayers(w.Get())
+	if err != nil {
+		return err
+	}
+	if len(pieces) > maxPieces {
+		return fmt.Errorf("%d pieces exceed %d", len(pieces), maxPieces)
+	}
+	v := &pieceVersion{
+		hash:    l.Hash,
+		hashes:  make([][]byte, len(pieces)),
+		pieces:  pieces,
+		have:    newBitfield(len(pieces)),
+		origin:  origin,
+		age:     w.GetAge(),
+		samples: w.GetSamples(),
+		lineage: marshalLineage(l),
+	}
+	for i, p := range pieces {
+		v.hashes[i] = structs.HashWeights(p)
+		v.have.set(i)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.add(v)
+	return nil
+}
+
+// add stores a new version and drops the oldest one beyond
+// maxPieceVersions. It assumes that the store is locked.
+func (s *pieceStore) add(v *pieceVersion) {
+	key := string(v.hash)
+	s.versions[key] = v
+	s.order = append(s.order, key)
+	s.changed[key] = true
+	if len(s.order) > maxPieceVersions {
+		s.remove(s.order[0])
+	}
+}
+
+// remove assumes that the store is locked.
+func (s *pieceStore) remove(key string) {
+	delete(s.versions, key)
+	delete(s.changed, key)
+	s.order = slices.DeleteFunc(s.order, func(k string) bool { return k == key })
+	for _, versions := range s.neighbors {
+		delete(versions, key)
+	}
+}
+
+// addPiece verifies and stores a received piece. It returns the version once
+// it got complete with this piece.
+func (s *pieceStore) addPiece(update *ModelUpdate) (*pieceVersion, error) {
+	p := update.Piece
+	if len(p.Version) != 32 || len(p.Hashes) == 0 || len(p.Hashes) > maxPieces {
+		return nil, errors.New("invalid piece header")
+	}
+	if int(p.Index) >= len(p.Hashes) {
+		return nil, fmt.Errorf("piece %d of %d", p.Index, len(p.Hashes))
+	}
+	for _, h := range p.Hashes {
+		if len(h) != 32 {
+			return nil, errors.New("invalid piece hash")
+		}
+	}
+	if !bytes.Equal(structs.HashWeights(update.Weights), p.Hashes[p.Index]) {
+		return nil, fmt.Errorf("piece %d does not match its hash", p.Index)
+	}
+	i := int(p.Index)
+	key := string(p.Version)
+	s.Lock()
+	defer s.Unlock()
+	v := s.versions[key]
+	if v == nil {
+		v = &pieceVersion{
+			hash:    p.Version,
+			hashes:  p.Hashes,
+			pieces:  make([][]byte, len(p.Hashes)),
+			have:    newBitfield(len(p.Hashes)),
+			missing: len(p.Hashes),
+			origin:  p.Origin,
+			age:     int(update.Age),
+			samples: int(update.Samples),
+			lineage: update.Lineage,
+		}
+		s.add(v)
+	} else if !slices.EqualFunc(v.hashes, p.Hashes, bytes.Equal) {
+		return nil, errors.New("piece hashes differ from the known version")
+	}
+	s.neighbor(update.Source, key, len(p.Hashes)).set(i)
+	if v.have.has(i) {
+		return nil, nil
+	}
+	v.pieces[i] = update.Weights
+	v.have.set(i)
+	v.missing--
+	s.changed[key] = true
+	if v.missing > 0 {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// drop removes a version whose pieces turned out to be invalid.
+func (s *pieceStore) drop(v *pieceVersion) {
+	s.Lock()
+	defer s.Unlock()
+	s.remove(string(v.hash))
+}
+
+// neighbor returns the announced pieces of a version held by the peer. It
+// assumes that the store is locked.
+func (s *pieceStore) neighbor(peer, key string, n int) bitfield {
+	versions := s.neighbors[peer]
+	if versions == nil {
+		versions = make(map[string]bitfield)
+		s.neighbors[peer] = versions
+	}
+	b := versions[key]
+	if len(b) != len(newBitfield(n)) {
+		b = newBitfield(n)
+		versions[key] = b
+	}
+	return b
+}
+
+// setHave records the pieces the peer announced. Announcements of unknown
+// versions are ignored.
+func (s *pieceStore) setHave(peer string, haves []*Have) {
+	s.Lock()
+	defer s.Unlock()
+	for _, h := range haves {
+		key := string(h.Version)
+		v := s.versions[key]
+		if v == nil || len(h.Bitfield) != len(v.have) {
+			continue
+		}
+		copy(s.neighbor(peer, key, len(v.hashes)), h.Bitfield)
+	}
+}
+
+// announcements returns the bitfields of the versions that changed since the
+// last call.
+func (s *pieceStore) announcements() []*Have {
+	s.Lock()
+	defer s.Unlock()
+	var haves []*Have
+	for _, key := range s.order {
+		if s.changed[key] {
+			v := s.versions[key]
+			haves = append(haves, &Have{Version: v.hash, Bitfield: slices.Clone(v.have)})
+		}
+	}
+	clear(s.changed)
+	return haves
+}
+
+// schedule selects up to limit pieces for every peer that it lacks, rarest
+// first among the peers. Ties are broken by newer versions first. The peers
+// take turns, and scheduled pieces count as held, so the peers get different
+// pieces they can exchange among themselves. Pieces that could not be
+// delivered have to be unscheduled.
+func (s *pieceStore) schedule(peers []string, limit int) []scheduledPiece {
+	s.Lock()
+	defer s.Unlock()
+	type ref struct {
+		key   string
+		index int
+	}
+	availability := make(map[ref]int)
+	for _, peer := range peers {
+		for key, b := range s.neighbors[peer] {
+			for i := range len(b) * 8 {
+				if b.has(i) {
+					availability[ref{key, i}]++
+				}
+			}
+		}
+	}
+	var plan []scheduledPiece
+	for range limit {
+		for _, peer := range peers {
+			var best *ref
+			for o := len(s.order) - 1; o >= 0; o-- {
+				key := s.order[o]
+				v := s.versions[key]
+				if v.origin == peer {
+					continue
+				}
+				b := s.neighbors[peer][key]
+				for i := range v.hashes {
+					r := ref{key, i}
+					if !v.have.has(i) || b.has(i) {
+						continue
+					}
+					if best == nil || availability[r] < availability[*best] {
+						best = &r
+					}
+				}
+			}
+			if best == nil {
+				continue
+			}
+			v := s.versions[best.key]
+			b := s.neighbor(peer, best.key, len(v.hashes))
+			plan = append(plan, scheduledPiece{peer: peer, version: v, index: best.index, first: b.empty()})
+			b.set(best.index)
+			availability[*best]++
+		}
+	}
+	return plan
+}
+
+// unschedule marks a scheduled piece as missing again, so it is scheduled
+// once more in the next round.
+func (s *pieceStore) unschedule(p scheduledPiece) {
+	s.Lock()
+	defer s.Unlock()
+	if b := s.neighbors[p.peer][string(p.version.hash)]; b != nil {
+		b.unset(p.index)
+	}
+}
+
+// sendPieces sends the scheduled pieces to the unchoked peers. Pieces that
+// could not be delivered are sent again in a later round.
+func (me *Me) sendPieces(wg *sync.WaitGroup) {
+	peers := make(map[string]*KnownPeer)
+	for _, peer := range me.peerset.GetUnchoked() {
+		if !peer.IsFreeRider() {
+			peers[peer.Name] = peer
+		}
+	}
+	for _, p := range me.pieces.schedule(slices.Sorted(maps.Keys(peers)), piecesPerRound) {
+		v := p.version
+		msg, err := proto.Marshal(v.update(p.index, me.config.Name, me.arch))
+		if err != nil {
+			slog.Warn("Failed marshaling piece", "error", err)
+			continue
+		}
+		slog.Debug("Sending piece to peer", "target", p.peer, "origin", v.origin, "age", v.age, "piece", p.index)
+		peer := peers[p.peer]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var delivered bool
+			if p.first {
+				delivered = peer.SendUpdate(msg, v.age, me.Ctx, me.dialPeer)
+			} else {
+				delivered = peer.SendPiece(msg, me.Ctx, me.dialPeer)
+			}
+			if !delivered {
+				me.pieces.unschedule(p)
+			}
+		}()
+	}
+}
+
+// announcePieces sends the pieces received since the last announcement to
+// the unchoked peers.
+func (me *Me) announcePieces(wg *sync.WaitGroup) {
+	haves := me.pieces.announcements()
+	if len(haves) == 0 {
+		return
+	}
+	msg, err := proto.Marshal(&ModelUpdate{Source: me.config.Name, Architecture: me.arch, Have: haves})
+	if err != nil {
+		slog.Warn("Failed marshaling piece announcement", "error", err)
+		return
+	}
+	for _, peer := range me.peerset.GetUnchoked() {
+		wg.Add(1)
+		go peer.Notify(msg, wg, me.Ctx, me.dialPeer)
+	}
+}
+
+// receivePiece stores a piece and passes the version on once it is complete.
+func (me *Me) receivePiece(update *ModelUpdate) {
+	v, err := me.pieces.addPiece(update)
+	if err != nil {
+		slog.Warn("Rejected piece", "source", update.Source, "error", err)
+		return
+	}
+	if v == nil {
+		return
+	}
+	w, err := v.assemble()
+	if err != nil {
+		slog.Warn("Rejected assembled version", "origin", v.origin, "error", err)
+		me.pieces.drop(v)
+		return
+	}
+	if kp := me.peerset.Known(v.origin); kp != nil {
+		kp.ledger.recordReceived(0)
+	}
+	me.receive(w)
+}
+
+// PiecesLoop periodically announces received pieces and sends pieces to the
+// peers that lack them.
+func (me *Me) PiecesLoop() {
+	defer me.Wg.Done()
+
+	wg := &sync.WaitGroup{}
+	ticker := time.NewTicker(pieceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-me.Ctx.Done():
+			return
+		case <-ticker.C:
+			wg.Wait() // We wait here so the application can be stopped at any time
+			me.announcePieces(wg)
+			me.sendPieces(wg)
+		}
+	}
+}
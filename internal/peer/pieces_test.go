@@ -0,0 +1,149 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func buildPieceWeights(t *testing.T, layers int) *structs.Weights {
+	tm := &structs.TensorMap{}
+	for i := range layers {
+		tm.Tensors = append(tm.Tensors, structs.NewFloat32Tensor(fmt.Sprintf("layer%d.weight", i), []int64{2}, []float32{float32(i), 1}))
+	}
+	w, err := structs.NewTensorWeights(tm, 3)
+	require.NoError(t, err)
+	w.SetLineage(&structs.Lineage{Hash: structs.HashWeights(w.Get()), Versions: structs.VersionVector{"me": 3}})
+	return w
+}
+
+func TestPieceStoreRarestFirst(t *testing.T) {
+	// prepare
+	s := newPieceStore()
+	w := buildPieceWeights(t, 4)
+	require.NoError(t, s.addVersion(w, "me"))
+	held := newBitfield(4)
+	held.set(0)
+	s.setHave("a", []*Have{{Version: w.GetLineage().Hash, Bitfield: held}})
+
+	// run
+	plan := s.schedule([]string{"a", "b", "c", "me"}, 1)
+
+	// verify
+	require.Len(t, plan, 3, "the origin should not get pieces")
+	assert.Equal(t, scheduledPiece{peer: "a", version: plan[0].version, index: 1, first: false}, plan[0])
+	assert.Equal(t, scheduledPiece{peer: "b", version: plan[0].version, index: 2, first: true}, plan[1])
+	assert.Equal(t, scheduledPiece{peer: "c", version: plan[0].version, index: 3, first: true}, plan[2])
+	next := s.schedule([]string{"a", "b", "c"}, 1)
+	assert.Equal(t, 2, next[0].index, "scheduled pieces should count as held")
+}
+
+func TestPieceStoreUnschedule(t *testing.T) {
+	// prepare
+	s := newPieceStore()
+	w := buildPieceWeights(t, 2)
+	require.NoError(t, s.addVersion(w, "me"))
+	plan := s.schedule([]string{"a"}, 1)
+	require.Len(t, plan, 1)
+
+	// run
+	s.unschedule(plan[0])
+	next := s.schedule([]string{"a"}, 1)
+
+	// verify
+	require.Len(t, next, 1)
+	assert.Equal(t, plan[0].index, next[0].index, "a piece that was not delivered should be scheduled again")
+	assert.True(t, next[0].first, "the peer should still lack all pieces")
+}
+
+func TestPieceStoreAssemble(t *testing.T) {
+	// prepare
+	sender := newPieceStore()
+	receiver := newPieceStore()
+	w := buildPieceWeights(t, 3)
+	require.NoError(t, sender.addVersion(w, "me"))
+	plan := sender.schedule([]string{"r"}, 3)
+	require.Len(t, plan, 3)
+	tampered := plan[0].version.update(0, "me", "")
+	tampered.Weights = []byte("other")
+
+	// run
+	_, errTampered := receiver.addPiece(tampered)
+	var complete []*pieceVersion
+	for _, p := range plan {
+		v, err := receiver.addPiece(p.version.update(p.index, "me", ""))
+		require.NoError(t, err)
+		complete = append(complete, v)
+	}
+
+	// verify
+	assert.Error(t, errTampered, "pieces that do not match their hash should be rejected")
+	assert.Nil(t, complete[0])
+	assert.Nil(t, complete[1])
+	require.NotNil(t, complete[2], "the last piece should complete the version")
+	assembled, err := complete[2].assemble()
+	require.NoError(t, err)
+	assert.Equal(t, w.Get(), assembled.Get())
+	assert.Equal(t, "me", assembled.GetSource())
+	assert.Equal(t, w.GetLineage().Versions, assembled.GetLineage().Versions)
+	assert.Len(t, receiver.announcements(), 1, "received pieces should be announced")
+}
+
+func TestPieceStoreRejectsForeignVersionHash(t *testing.T) {
+	// prepare
+	sender := newPieceStore()
+	receiver := newPieceStore()
+	w := buildPieceWeights(t, 1)
+	require.NoError(t, sender.addVersion(w, "me"))
+	plan := sender.schedule([]string{"r"}, 1)
+	require.Len(t, plan, 1)
+	update := plan[0].version.update(0, "me", "")
+	update.Lineage = marshalLineage(&structs.Lineage{Hash: structs.HashWeights([]byte("other"))})
+
+	// run
+	v, err := receiver.addPiece(update)
+	require.NoError(t, err)
+	require.NotNil(t, v)
+	_, err = v.assemble()
+
+	// verify
+	assert.Error(t, err, "a version whose lineage names other weights should be rejected")
+}
+
+func TestReceivePieceOfUnknownOrigin(t *testing.T) {
+	// prepare
+	queue, err := newIncomingQueue(structs.QueueConfig{Policy: structs.QueueDropOldest, Size: 1}, nil)
+	require.NoError(t, err)
+	me := &Me{
+		Ctx:      context.Background(),
+		peerset:  NewPeerSet(1, time.Minute, nil),
+		pds:      NewDoubleAgeStorage(1, 0),
+		seen:     newRecentHashes(recentHashesSize),
+		incoming: queue,
+		pieces:   newPieceStore(),
+	}
+	sender := newPieceStore()
+	w := buildPieceWeights(t, 2)
+	require.NoError(t, sender.addVersion(w, "origin"))
+	plan := sender.schedule([]string{"me"}, 2)
+	require.Len(t, plan, 2)
+
+	// run
+	for _, p := range plan {
+		me.receivePiece(p.version.update(p.index, "relay", ""))
+	}
+	received, ok := queue.pop(context.Background())
+	require.True(t, ok)
+
+	// verify
+	assert.Equal(t, "origin", received.GetSource())
+	assert.Equal(t, w.Get(), received.Get())
+	assert.NotPanics(t, func() {
+		applyCallback(me.peerset.Known(received.GetSource()))(1)
+	}, "the result of an update of an unknown origin should be ignored")
+}
@@ -0,0 +1,201 @@
+package peer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vs-ude/btml/internal/model"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+// incomingQueue holds received updates until the model takes them, so
+// reading streams never waits for the model. If the queue is full, its
+// policy decides which update is dropped.
+type incomingQueue struct {
+	policy   string
+	size     int
+	timeout  time.Duration
+	modelAge func() int // Only used by QueueAge, may be nil
+	items    []*model.WeightsWithCallback
+	ready    chan struct{} // Signalled when an update was queued
+	space    chan struct{} // Signalled when an update was taken
+	dropped  int64
+	replaced int64
+	sync.Mutex
+}
+
+func newIncomingQueue(c structs.QueueConfig, modelAge func() int) (*incomingQueue, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	q := &incomingQueue{
+		policy:   c.Policy,
+		size:     c.Size,
+		timeout:  c.Timeout,
+		modelAge: modelAge,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+	}
+	if q.policy == "" {
+		q.policy = structs.QueueBlock
+	}
+	if q.size < 1 {
+		q.size = structs.DefaultQueueSize
+	}
+	return q, nil
+}
+
+// push queues w. It returns the update that was dropped for it, which may be
+// w itself, and whether it was replaced by w as a newer update of the same
+// source. Only QueueBlock waits for space, at most until the timeout or ctx
+// is done.
+func (q *incomingQueue) push(ctx context.Context, w *model.WeightsWithCallback) (dropped *model.WeightsWithCallback, replaced bool) {
+	var timeout <-chan time.Time
+	if q.policy == structs.QueueBlock && q.timeout > 0 {
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		q.Lock()
+		if q.policy == structs.QueueNewestPerSource {
+			if i := q.sameSource(w); i >= 0 {
+				dropped = q.items[i]
+				q.items[i] = w
+				q.replaced++
+				q.Unlock()
+				return dropped, true
+			}
+		}
+		if len(q.items) < q.size {
+			q.items = append(q.items, w)
+			if len(q.items) < q.size {
+				// Pass on the space to other waiting updates
+				signal(q.space)
+			}
+			q.Unlock()
+			signal(q.ready)
+			return nil, false
+		}
+		if q.policy != structs.QueueBlock {
+			dropped = q.evict(w)
+			q.dropped++
+			q.Unlock()
+			signal(q.ready)
+			return dropped, false
+		}
+		q.Unlock()
+
+		select {
+		case <-q.space:
+		case <-timeout:
+			q.Lock()
+			q.dropped++
+			q.Unlock()
+			return w, false
+		case <-ctx.Done():
+			return w, false
+		}
+	}
+}
+
+// pop takes the next update from the queue. It waits until an update is
+// queued and returns false once ctx is done.
+func (q *incomingQueue) pop(ctx context.Context) (*model.WeightsWithCallback, bool) {
+	for {
+		q.Lock()
+		if len(q.items) > 0 {
+			best := 0
+			for i := range q.items {
+				if q.worse(q.items[best], q.items[i]) {
+					best = i
+				}
+			}
+			w := q.items[best]
+			q.items = append(q.items[:best], q.items[best+1:]...)
+			q.Unlock()
+			signal(q.space)
+			return w, true
+		}
+		q.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// counts returns the number of queued updates and the number of updates
+// dropped and replaced so far.
+func (q *incomingQueue) counts() (depth int, dropped, replaced int64) {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items), q.dropped, q.replaced
+}
+
+// sameSource returns the index of the queued update of the source of w, or
+// -1 if there is none. Masked updates belong to a round and are never
+// replaced. It assumes that the queue is locked.
+func (q *incomingQueue) sameSource(w *model.WeightsWithCallback) int {
+	if w.GetMasked() != nil {
+		return -1
+	}
+	for i, item := range q.items {
+		if item.GetSource() == w.GetSource() && item.GetMasked() == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// evict makes room for w in the full queue and returns the dropped update.
+// It assumes that the queue is locked.
+func (q *incomingQueue) evict(w *model.WeightsWithCallback) *model.WeightsWithCallback {
+	worst := 0
+	for i := range q.items {
+		if q.worse(q.items[i], q.items[worst]) {
+			worst = i
+		}
+	}
+	if q.policy != structs.QueueDropOldest && q.policy != structs.QueueNewestPerSource && !q.worse(q.items[worst], w) {
+		return w
+	}
+	dropped := q.items[worst]
+	q.items = append(q.items[:worst], q.items[worst+1:]...)
+	q.items = append(q.items, w)
+	return dropped
+}
+
+// worse reports whether a should be taken after b. Without priorities the
+// queue is in order of arrival, so nothing is worse than an earlier update.
+func (q *incomingQueue) worse(a, b *model.WeightsWithCallback) bool {
+	switch q.policy {
+	case structs.QueueTrust:
+		return a.GetTrust() < b.GetTrust()
+	case structs.QueueAge:
+		if sa, sb := q.staleness(a), q.staleness(b); sa != sb {
+			return sa > sb
+		}
+		return a.GetAge() < b.GetAge()
+	default:
+		return false
+	}
+}
+
+// staleness returns the number of ages w is behind the model.
+func (q *incomingQueue) staleness(w *model.WeightsWithCallback) int {
+	if q.modelAge == nil {
+		return 0
+	}
+	return max(q.modelAge()-w.GetAge(), 0)
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
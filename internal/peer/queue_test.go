@@ -0,0 +1,139 @@
+package peer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/model"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func queuedUpdate(source string, age int, trust float32) *model.WeightsWithCallback {
+	w := structs.NewWeights(nil, age)
+	w.SetSource(source)
+	w.SetTrust(trust)
+	return model.NewWeightsWithCallback(w, nil)
+}
+
+func TestIncomingQueueDropOldest(t *testing.T) {
+	// prepare
+	q, err := newIncomingQueue(structs.QueueConfig{Policy: structs.QueueDropOldest, Size: 2}, nil)
+	require.NoError(t, err)
+	a, b, c := queuedUpdate("a", 1, 0), queuedUpdate("b", 2, 0), queuedUpdate("c", 3, 0)
+
+	// run
+	q.push(context.Background(), a)
+	q.push(context.Background(), b)
+	dropped, replaced := q.push(context.Background(), c)
+
+	// verify
+	assert.Same(t, a, dropped)
+	assert.False(t, replaced)
+	first, _ := q.pop(context.Background())
+	assert.Same(t, b, first)
+}
+
+func TestIncomingQueueNewestPerSource(t *testing.T) {
+	// prepare
+	q, err := newIncomingQueue(structs.QueueConfig{Policy: structs.QueueNewestPerSource}, nil)
+	require.NoError(t, err)
+	old, other, newer := queuedUpdate("a", 1, 0), queuedUpdate("b", 1, 0), queuedUpdate("a", 2, 0)
+
+	// run
+	q.push(context.Background(), old)
+	q.push(context.Background(), other)
+	dropped, replaced := q.push(context.Background(), newer)
+
+	// verify
+	assert.Same(t, old, dropped)
+	assert.True(t, replaced)
+	first, _ := q.pop(context.Background())
+	assert.Same(t, newer, first, "the newer update should keep the place of the old one")
+	depth, drops, replacements := q.counts()
+	assert.Equal(t, 1, depth)
+	assert.Equal(t, int64(0), drops)
+	assert.Equal(t, int64(1), replacements)
+}
+
+func TestIncomingQueueTrust(t *testing.T) {
+	// prepare
+	q, err := newIncomingQueue(structs.QueueConfig{Policy: structs.QueueTrust, Size: 2}, nil)
+	require.NoError(t, err)
+	low, high, mid := queuedUpdate("a", 1, 0.1), queuedUpdate("b", 1, 0.9), queuedUpdate("c", 1, 0.5)
+
+	// run
+	q.push(context.Background(), low)
+	q.push(context.Background(), high)
+	dropped, _ := q.push(context.Background(), mid)
+	lowest, _ := q.push(context.Background(), queuedUpdate("d", 1, 0))
+
+	// verify
+	assert.Same(t, low, dropped)
+	assert.Equal(t, "d", lowest.GetSource(), "an update less trusted than all queued ones should be dropped")
+	first, _ := q.pop(context.Background())
+	assert.Same(t, high, first)
+}
+
+func TestIncomingQueueAge(t *testing.T) {
+	// prepare
+	q, err := newIncomingQueue(structs.QueueConfig{Policy: structs.QueueAge}, func() int { return 10 })
+	require.NoError(t, err)
+	stale, fresh, ahead := queuedUpdate("a", 2, 0), queuedUpdate("b", 9, 0), queuedUpdate("c", 12, 0)
+
+	// run
+	for _, w := range []*model.WeightsWithCallback{stale, fresh, ahead} {
+		q.push(context.Background(), w)
+	}
+
+	// verify
+	for _, expected := range []*model.WeightsWithCallback{ahead, fresh, stale} {
+		w, _ := q.pop(context.Background())
+		assert.Same(t, expected, w)
+	}
+}
+
+func TestIncomingQueueBlockTimeout(t *testing.T) {
+	// prepare
+	q, err := newIncomingQueue(structs.QueueConfig{Size: 1, Timeout: 10 * time.Millisecond}, nil)
+	require.NoError(t, err)
+	queued, blocked := queuedUpdate("a", 1, 0), queuedUpdate("b", 1, 0)
+	q.push(context.Background(), queued)
+
+	// run
+	dropped, _ := q.push(context.Background(), blocked)
+
+	// verify
+	assert.Same(t, blocked, dropped, "the new update should be dropped after the timeout")
+	_, drops, _ := q.counts()
+	assert.Equal(t, int64(1), drops)
+}
+
+func TestIncomingQueueBlockWaitsForSpace(t *testing.T) {
+	// prepare
+	q, err := newIncomingQueue(structs.QueueConfig{Size: 1}, nil)
+	require.NoError(t, err)
+	first, second := queuedUpdate("a", 1, 0), queuedUpdate("b", 1, 0)
+	q.push(context.Background(), first)
+	done := make(chan *model.WeightsWithCallback)
+	go func() {
+		dropped, _ := q.push(context.Background(), second)
+		done <- dropped
+	}()
+
+	// run
+	w, _ := q.pop(context.Background())
+
+	// verify
+	assert.Same(t, first, w)
+	select {
+	case dropped := <-done:
+		assert.Nil(t, dropped)
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked update was not queued after space was freed")
+	}
+	w, _ = q.pop(context.Background())
+	assert.Same(t, second, w)
+}
@@ -0,0 +1,737 @@
+package peer
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/vs-ude/btml/internal/model"
+	"github.com/vs-ude/btml/internal/secagg"
+	"github.com/vs-ude/btml/internal/structs"
+	"google.golang.org/protobuf/proto"
+)
+
+// State of past rounds is kept for this many rounds to answer requests.
+const keepShareRounds = 4
+
+// requestTimeout limits the time of a request to a single peer.
+const requestTimeout = 5 * time.Second
+
+// maxControlMessageSize limits the size of messages without weights, like
+// peer infos and share responses.
+const maxControlMessageSize = 1 << 16
+
+var errNoGroup = errors.New("no secure aggregation group")
+
+var _ model.SeedSource = &secureAggregation{}
+
+// secureAggregation masks outgoing updates for the group this peer joined for
+// the round and keeps the shares of the seeds the other members sent along
+// with their updates. The groups are formed among unchoked peers one round
+// ahead, and the members exchange their mask keys on their own connections,
+// so neither passes the tracker.
+type secureAggregation struct {
+	me     *Me
+	conf   secagg.Config
+	key    *secagg.KeyPair
+	keys   map[string][]byte // Latest mask keys of other peers
+	rounds map[int64]*secaggRound
+	size   int // Length of the masked vectors, 0 until the first update
+	sync.Mutex
+}
+
+// secaggRound is the state of this peer in a round.
+type secaggRound struct {
+	leader     string            // Peer whose group this peer joined, this peer if it leads, empty while free
+	group      []string          // Sorted members including this peer, nil without a group
+	keys       map[string][]byte // Mask keys of the members, fixed on first use
+	sent       bool              // The own update was masked
+	revealed   bool              // Shares were revealed, so no further updates are accepted
+	received   map[string]bool   // Members whose update this peer received
+	shares     map[secagg.Residual]secagg.Share
+	selfShares map[string]secagg.Share // Shares of the self mask seeds by source
+}
+
+func newSecureAggregation(me *Me, conf secagg.Config) (*secureAggregation, error) {
+	key, err := secagg.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate mask key: %w", err)
+	}
+	return &secureAggregation{
+		me:     me,
+		conf:   conf,
+		key:    key,
+		keys:   make(map[string][]byte),
+		rounds: make(map[int64]*secaggRound),
+	}, nil
+}
+
+// SeedSource returns the seed source for the MaskedStrategy, or nil if
+// secure aggregation is disabled.
+func (me *Me) SeedSource() model.SeedSource {
+	if me.secagg == nil {
+		return nil
+	}
+	return me.secagg
+}
+
+func (sa *secureAggregation) Name() string {
+	return sa.me.config.Name
+}
+
+// state returns the state of the round and creates it on the first call. The
+// lock has to be held.
+func (sa *secureAggregation) state(round int64) *secaggRound {
+	r, ok := sa.rounds[round]
+	if !ok {
+		r = &secaggRound{
+			keys:       make(map[string][]byte),
+			received:   make(map[string]bool),
+			shares:     make(map[secagg.Residual]secagg.Share),
+			selfShares: make(map[string]secagg.Share),
+		}
+		sa.rounds[round] = r
+		for past := range sa.rounds {
+			if past < round-keepShareRounds {
+				delete(sa.rounds, past)
+			}
+		}
+	}
+	return r
+}
+
+// round returns the state of a round in which this peer is in a group.
+func (sa *secureAggregation) round(round int64) (*secaggRound, error) {
+	sa.Lock()
+	defer sa.Unlock()
+	r := sa.rounds[round]
+	if r == nil || r.group == nil {
+		return nil, errNoGroup
+	}
+	return r, nil
+}
+
+// GroupLoop forms the secure aggregation groups of the next round. At the
+// start of a round, only peers with the smallest name among their unchoked
+// peers lead, so most peers join a group instead of competing for members.
+// Peers that are still free in the middle of the round lead themselves.
+func (me *Me) GroupLoop() {
+	defer me.Wg.Done()
+
+	sa := me.secagg
+	for {
+		now := time.Now()
+		round := sa.conf.RoundAt(now)
+		next := sa.conf.End(round)
+		if mid := next.Add(-sa.conf.Round / 2); now.Before(mid) {
+			if sa.leads() {
+				sa.lead(me.Ctx, round+1)
+			}
+			next = mid
+		} else {
+			sa.lead(me.Ctx, round+1)
+		}
+		select {
+		case <-me.Ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// leads reports whether this peer has the smallest name among itself and
+// its unchoked peers.
+func (sa *secureAggregation) leads() bool {
+	return !slices.ContainsFunc(sa.me.peerset.UnchokedPeers(), func(p structs.Peer) bool {
+		return p.Name < sa.Name()
+	})
+}
+
+// lead invites unchoked peers to the group of this peer for the round unless
+// this peer already joined a group. The group is only formed if enough peers
+// accept, else the peers that accepted are released again.
+func (sa *secureAggregation) lead(ctx context.Context, round int64) {
+	sa.Lock()
+	r := sa.state(round)
+	free := r.leader == ""
+	if free {
+		r.leader = sa.Name()
+	}
+	sa.Unlock()
+	if !free {
+		return
+	}
+
+	candidates := sa.me.peerset.UnchokedPeers()
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	invite := &ModelUpdate{Source: sa.Name(), GroupInvite: &GroupInvite{Round: round}}
+	var accepted []structs.Peer
+	for _, p := range candidates {
+		if len(accepted)+1 >= sa.conf.Size() {
+			break
+		}
+		reply := &GroupReply{}
+		if err := sa.request(ctx, p.Name, invite, reply); err != nil {
+			slog.Debug("Failed to invite peer to the secure aggregation group", "peer", p.Name, "error", err)
+			continue
+		}
+		if reply.Accept {
+			accepted = append(accepted, p)
+		}
+	}
+
+	commit := &GroupCommit{Round: round}
+	group := []string{sa.Name()}
+	if len(accepted)+1 >= secagg.MinGroupSize {
+		commit.Members = append(commit.Members, &GroupMember{Id: sa.Name()})
+		for _, p := range accepted {
+			commit.Members = append(commit.Members, &GroupMember{Id: p.Name, Addr: p.Addr.String(), Fingerprint: p.Fingerprint})
+			group = append(group, p.Name)
+		}
+		slices.Sort(group)
+		slog.Info("Formed secure aggregation group", "round", round, "group", group)
+	} else {
+		slog.Info("Too few peers joined the secure aggregation group", "round", round, "joined", len(accepted))
+		group = nil
+	}
+	sa.Lock()
+	if group == nil {
+		r.leader = ""
+	}
+	r.group = group
+	sa.Unlock()
+
+	msg, err := proto.Marshal(&ModelUpdate{Source: sa.Name(), GroupCommit: commit})
+	if err != nil {
+		slog.Error("Failed to marshal group commit", "error", err)
+		return
+	}
+	wg := &sync.WaitGroup{}
+	for _, p := range accepted {
+		if kp := sa.me.peerset.Known(p.Name); kp != nil {
+			wg.Add(1)
+			go kp.Notify(msg, wg, ctx, sa.me.dialPeer)
+		}
+	}
+	wg.Wait()
+	sa.exchangeKeys(ctx, group)
+}
+
+// join accepts the invitation of a peer to its group of the next round
+// unless this peer already joined or leads another group.
+func (sa *secureAggregation) join(leader string, round int64) bool {
+	if round != sa.conf.RoundAt(time.Now())+1 {
+		return false
+	}
+	sa.Lock()
+	defer sa.Unlock()
+	r := sa.state(round)
+	if r.leader != "" {
+		return false
+	}
+	r.leader = leader
+	return true
+}
+
+// commit fixes the group of the leader whose invitation this peer accepted
+// and returns it, or nil if the leader did not form a group. The other
+// members are added to the peer set, so they can be reached even if they
+// are choked.
+func (sa *secureAggregation) commit(leader string, c *GroupCommit) ([]string, error) {
+	if c.Round < sa.conf.RoundAt(time.Now()) {
+		return nil, errors.New("group commit of a past round")
+	}
+	var (
+		group  []string
+		others []*structs.Peer
+	)
+	for _, m := range c.Members {
+		group = append(group, m.Id)
+		if m.Id == sa.Name() || m.Id == leader {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", m.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address of member %s: %w", m.Id, err)
+		}
+		others = append(others, &structs.Peer{Name: m.Id, Addr: addr, Fingerprint: m.Fingerprint, LastSeen: time.Now()})
+	}
+	slices.Sort(group)
+
+	sa.Lock()
+	r := sa.rounds[c.Round]
+	if r == nil || r.leader != leader || r.group != nil {
+		sa.Unlock()
+		return nil, fmt.Errorf("no invitation of %s accepted for round %d", leader, c.Round)
+	}
+	if !slices.Contains(group, sa.Name()) {
+		r.leader = ""
+		sa.Unlock()
+		return nil, nil
+	}
+	if len(group) < secagg.MinGroupSize || len(group) > sa.conf.Size() || !slices.Contains(group, leader) || len(slices.Compact(slices.Clone(group))) != len(group) {
+		r.leader = ""
+		sa.Unlock()
+		return nil, fmt.Errorf("invalid group of %d members", len(group))
+	}
+	r.group = group
+	sa.Unlock()
+
+	for _, p := range others {
+		sa.addMember(p)
+	}
+	return group, nil
+}
+
+// addMember makes a member of a group known, so it can be reached even if
+// it is not among the unchoked peers.
+func (sa *secureAggregation) addMember(p *structs.Peer) {
+	if err := sa.me.peerset.Add(p); err != nil {
+		slog.Debug("Member of the secure aggregation group stays choked", "peer", p.Name, "error", err)
+	}
+}
+
+// isMember reports whether the peer is in the group of this peer in the
+// previous, the current or the next round.
+func (sa *secureAggregation) isMember(name string) bool {
+	now := sa.conf.RoundAt(time.Now())
+	sa.Lock()
+	defer sa.Unlock()
+	for _, round := range []int64{now - 1, now, now + 1} {
+		if r := sa.rounds[round]; r != nil && slices.Contains(r.group, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeKeys swaps the mask keys with the other members of the group.
+func (sa *secureAggregation) exchangeKeys(ctx context.Context, group []string) {
+	wg := &sync.WaitGroup{}
+	for _, name := range group {
+		if name == sa.Name() {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &KeyExchange{}
+			err := sa.request(ctx, name, &ModelUpdate{Source: sa.Name(), KeyExchange: &KeyExchange{MaskKey: sa.key.Public()}}, res)
+			if err == nil {
+				err = sa.setKey(name, res.MaskKey)
+			}
+			if err != nil {
+				slog.Warn("Failed to exchange mask keys", "peer", name, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// setKey keeps the mask key a peer sent on its connection. Rounds in which
+// the key of the peer was used keep the previous one.
+func (sa *secureAggregation) setKey(name string, key []byte) error {
+	if _, err := ecdh.X25519().NewPublicKey(key); err != nil {
+		return fmt.Errorf("invalid mask key: %w", err)
+	}
+	sa.Lock()
+	defer sa.Unlock()
+	sa.keys[name] = key
+	return nil
+}
+
+// handle answers the secure aggregation messages of the peer of the
+// connection.
+func (sa *secureAggregation) handle(stream *quic.Stream, peer string, update *ModelUpdate) error {
+	switch {
+	case update.ShareRequest != nil:
+		return sa.answerShareRequest(stream, peer, update.ShareRequest)
+	case update.KeyExchange != nil:
+		if err := sa.setKey(peer, update.KeyExchange.MaskKey); err != nil {
+			return err
+		}
+		return reply(stream, &KeyExchange{MaskKey: sa.key.Public()})
+	case update.GroupInvite != nil:
+		return reply(stream, &GroupReply{Accept: sa.join(peer, update.GroupInvite.Round)})
+	default:
+		group, err := sa.commit(peer, update.GroupCommit)
+		if err != nil {
+			return err
+		}
+		sa.exchangeKeys(sa.me.Ctx, group)
+		return nil
+	}
+}
+
+func (sa *secureAggregation) Seed(pair secagg.Pair, round int64) (secagg.Seed, error) {
+	other := pair.A
+	if other == sa.Name() {
+		other = pair.B
+	}
+	r, err := sa.round(round)
+	if err != nil {
+		return secagg.Seed{}, err
+	}
+	sa.Lock()
+	key := r.keys[other]
+	if key == nil && slices.Contains(r.group, other) {
+		// Fixed for the round, so a new key of a restarted member cannot
+		// change the seeds of updates already sent
+		key = sa.keys[other]
+		r.keys[other] = key
+	}
+	sa.Unlock()
+	if key == nil {
+		return secagg.Seed{}, fmt.Errorf("no mask key of peer %s", other)
+	}
+	return sa.key.Seed(key, pair, round)
+}
+
+// mask marshals the update for every other member of the group of the
+// current round, each with its shares of the seeds. Only one update is
+// masked per round, as the same masks on two updates would reveal their
+// difference.
+func (sa *secureAggregation) mask(data *structs.Weights) (map[string][]byte, error) {
+	v, err := data.Floats()
+	if err != nil {
+		return nil, err
+	}
+	round := sa.conf.RoundAt(time.Now())
+	r, err := sa.round(round)
+	if err != nil {
+		return nil, err
+	}
+	sa.Lock()
+	sent := r.sent
+	r.sent = true
+	// This peer holds its own update, it never reveals seeds of it
+	r.received[sa.Name()] = true
+	sa.Unlock()
+	if sent {
+		return nil, errors.New("an update was already sent in this round")
+	}
+	members := slices.DeleteFunc(slices.Clone(r.group), func(name string) bool {
+		return name == sa.Name()
+	})
+	if len(members)+1 < secagg.MinGroupSize {
+		return nil, fmt.Errorf("group of %d members is too small", len(members)+1)
+	}
+	threshold := secagg.Threshold(len(members))
+	vector := secagg.Quantize(v)
+	sa.Lock()
+	sa.size = len(vector)
+	sa.Unlock()
+	self, err := secagg.NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	secagg.AddSelfMask(vector, self, false)
+	selfSplit, err := secagg.Split(self[:], len(members), threshold)
+	if err != nil {
+		return nil, err
+	}
+	// shares[i] are the shares of member i
+	shares := make([][]*SeedShare, len(members))
+	for _, name := range members {
+		pair := secagg.NewPair(sa.Name(), name)
+		seed, err := sa.Seed(pair, round)
+		if err != nil {
+			return nil, err
+		}
+		secagg.AddMask(vector, seed, pair, sa.Name(), false)
+		split, err := secagg.Split(seed[:], len(members), threshold)
+		if err != nil {
+			return nil, err
+		}
+		for i, s := range split {
+			shares[i] = append(shares[i], &SeedShare{A: pair.A, B: pair.B, X: uint32(s.X), Y: s.Y, Source: sa.Name()})
+		}
+	}
+	weights := make([]byte, 0, len(vector)*4)
+	for _, x := range vector {
+		weights = binary.LittleEndian.AppendUint32(weights, x)
+	}
+	messages := make(map[string][]byte, len(members))
+	for i, name := range members {
+		msg, err := proto.Marshal(&ModelUpdate{
+			Source:       sa.Name(),
+			Weights:      weights,
+			Age:          int64(data.GetAge()),
+			Architecture: sa.me.arch,
+			Samples:      int64(data.GetSamples()),
+			Lineage:      marshalLineage(data.GetLineage()),
+			Masked: &MaskedUpdate{
+				Round:     round,
+				Group:     members,
+				Threshold: int32(threshold),
+				Shares:    shares[i],
+				SelfShare: &SeedShare{X: uint32(selfSplit[i].X), Y: selfSplit[i].Y, Source: sa.Name()},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		messages[name] = msg
+	}
+	return messages, nil
+}
+
+// unmask converts a received masked update and keeps its shares. The update
+// has to be masked for the group of the round.
+func (sa *secureAggregation) unmask(update *ModelUpdate) (*secagg.Update, error) {
+	m := update.Masked
+	sa.Lock()
+	size := sa.size
+	sa.Unlock()
+	// All peers mask vectors of the same model, so the own vector gives the
+	// expected length
+	if len(update.Weights)%4 != 0 || size > 0 && len(update.Weights) != size*4 {
+		return nil, errors.New("masked vector has an invalid size")
+	}
+	if m.SelfShare == nil {
+		return nil, errors.New("masked update has no self mask share")
+	}
+	r, err := sa.round(m.Round)
+	if err != nil {
+		return nil, err
+	}
+	group := slices.DeleteFunc(slices.Clone(r.group), func(name string) bool {
+		return name == update.Source
+	})
+	if len(group) == len(r.group) || !slices.Equal(group, slices.Sorted(slices.Values(m.Group))) {
+		return nil, errors.New("masked update is not meant for the group of this peer")
+	}
+	if int(m.Threshold) != secagg.Threshold(len(group)) {
+		return nil, fmt.Errorf("masked update has threshold %d instead of %d", m.Threshold, secagg.Threshold(len(group)))
+	}
+	u := &secagg.Update{
+		Source:    update.Source,
+		Round:     m.Round,
+		Group:     group,
+		Threshold: int(m.Threshold),
+		Vector:    make([]uint32, len(update.Weights)/4),
+		Shares:    make(map[secagg.Pair]secagg.Share, len(m.Shares)),
+		SelfShare: secagg.Share{X: byte(m.SelfShare.X), Y: m.SelfShare.Y},
+	}
+	for i := range u.Vector {
+		u.Vector[i] = binary.LittleEndian.Uint32(update.Weights[i*4:])
+	}
+	for _, s := range m.Shares {
+		pair := secagg.NewPair(s.A, s.B)
+		if pair.A != u.Source && pair.B != u.Source {
+			return nil, errors.New("masked update carries shares of other peers")
+		}
+		u.Shares[pair] = secagg.Share{X: byte(s.X), Y: s.Y}
+	}
+
+	sa.Lock()
+	defer sa.Unlock()
+	if r.revealed {
+		return nil, errors.New("shares of the round were already revealed")
+	}
+	for pair, s := range u.Shares {
+		r.shares[secagg.Residual{Source: u.Source, Pair: pair}] = s
+	}
+	r.selfShares[u.Source] = u.SelfShare
+	r.received[u.Source] = true
+	return u, nil
+}
+
+// answer returns the requested shares that may be revealed to the
+// requester. Shares are only revealed to members of the group once the round
+// is closed and enough updates of peers other than this peer and the
+// requester were received, so the requester never learns a single update.
+// The seed of a pairwise mask is only revealed if the other peer of the pair
+// did not send an update, the seed of a self mask only if its source did. So
+// the masks of an update that was sent can never be removed completely. Once
+// shares are revealed, no further updates of the round are accepted.
+func (sa *secureAggregation) answer(requester string, req *ShareRequest) *ShareResponse {
+	res := &ShareResponse{}
+	if !sa.conf.Closed(req.Round, time.Now()) {
+		return res
+	}
+	sa.Lock()
+	defer sa.Unlock()
+	r := sa.rounds[req.Round]
+	if r == nil || !slices.Contains(r.group, requester) {
+		return res
+	}
+	others := 0
+	for name := range r.received {
+		if name != sa.Name() && name != requester {
+			others++
+		}
+	}
+	if others < max(sa.conf.MinUpdates, 2) {
+		return res
+	}
+	r.revealed = true
+	for _, p := range req.Pairs {
+		pair := secagg.NewPair(p.A, p.B)
+		other := pair.A
+		if other == p.Source {
+			other = pair.B
+		}
+		if r.received[other] {
+			continue
+		}
+		if s, ok := r.shares[secagg.Residual{Source: p.Source, Pair: pair}]; ok {
+			res.Shares = append(res.Shares, &SeedShare{A: pair.A, B: pair.B, X: uint32(s.X), Y: s.Y, Source: p.Source})
+		}
+	}
+	for _, source := range req.Selves {
+		if !r.received[source] {
+			continue
+		}
+		if s, ok := r.selfShares[source]; ok {
+			res.SelfShares = append(res.SelfShares, &SeedShare{X: uint32(s.X), Y: s.Y, Source: source})
+		}
+	}
+	return res
+}
+
+// answerShareRequest replies with the requested shares that may be revealed
+// to the requesting peer of the connection.
+func (sa *secureAggregation) answerShareRequest(stream *quic.Stream, requester string, req *ShareRequest) error {
+	res := sa.answer(requester, req)
+	slog.Debug("Answering share request", "peer", requester, "round", req.Round, "shares", len(res.Shares)+len(res.SelfShares))
+	return reply(stream, res)
+}
+
+func (sa *secureAggregation) Recover(ctx context.Context, r secagg.Residual, round int64, holders []string, threshold int) (secagg.Seed, error) {
+	req := &ShareRequest{Round: round, Pairs: []*SeedShare{{A: r.Pair.A, B: r.Pair.B, Source: r.Source}}}
+	return sa.collect(ctx, req, holders, threshold, func(res *ShareResponse) (secagg.Share, bool) {
+		for _, s := range res.Shares {
+			if s.A == r.Pair.A && s.B == r.Pair.B && s.Source == r.Source {
+				return secagg.Share{X: byte(s.X), Y: s.Y}, true
+			}
+		}
+		return secagg.Share{}, false
+	})
+}
+
+func (sa *secureAggregation) RecoverSelf(ctx context.Context, source string, round int64, holders []string, threshold int) (secagg.Seed, error) {
+	req := &ShareRequest{Round: round, Selves: []string{source}}
+	return sa.collect(ctx, req, holders, threshold, func(res *ShareResponse) (secagg.Share, bool) {
+		for _, s := range res.SelfShares {
+			if s.Source == source {
+				return secagg.Share{X: byte(s.X), Y: s.Y}, true
+			}
+		}
+		return secagg.Share{}, false
+	})
+}
+
+// collect gets the share picked from the answers to the request from this
+// peer and the holders until the threshold is reached and combines them.
+func (sa *secureAggregation) collect(ctx context.Context, req *ShareRequest, holders []string, threshold int, pick func(*ShareResponse) (secagg.Share, bool)) (secagg.Seed, error) {
+	var shares []secagg.Share
+	if s, ok := pick(sa.answer(sa.Name(), req)); ok {
+		shares = append(shares, s)
+	}
+	for _, name := range holders {
+		if len(shares) >= threshold {
+			break
+		}
+		if name == sa.Name() {
+			continue
+		}
+		res := &ShareResponse{}
+		if err := sa.request(ctx, name, &ModelUpdate{Source: sa.Name(), ShareRequest: req}, res); err != nil {
+			slog.Debug("Failed to get share", "peer", name, "error", err)
+			continue
+		}
+		if s, ok := pick(res); ok {
+			shares = append(shares, s)
+		}
+	}
+	if len(shares) < threshold {
+		return secagg.Seed{}, fmt.Errorf("got %d of %d shares", len(shares), threshold)
+	}
+	secret, err := secagg.Combine(shares)
+	if err != nil {
+		return secagg.Seed{}, err
+	}
+	var seed secagg.Seed
+	copy(seed[:], secret)
+	return seed, nil
+}
+
+// request sends the message to a peer and reads its reply into res.
+func (sa *secureAggregation) request(ctx context.Context, name string, msg *ModelUpdate, res proto.Message) error {
+	kp := sa.me.peerset.Known(name)
+	if kp == nil {
+		return errors.New("unknown peer")
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	conn := kp.getOrEstablishConnection(sa.me.dialPeer, ctx)
+	if conn == nil {
+		return errors.New("no connection")
+	}
+	req, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.CancelRead(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	if err = writeMessage(stream, req); err != nil {
+		return err
+	}
+	stream.Close()
+	data, err := readMessage(stream, maxControlMessageSize)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, res)
+}
+
+// reply answers a request on its stream.
+func reply(stream *quic.Stream, res proto.Message) error {
+	data, err := proto.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return writeMessage(stream, data)
+}
+
+// writeMessage writes the length prefixed message.
+func writeMessage(stream *quic.Stream, data []byte) error {
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	_, err := stream.Write(append(buf, data...))
+	return err
+}
+
+// readMessage reads a length prefixed message of at most limit bytes.
+func readMessage(stream *quic.Stream, limit uint32) ([]byte, error) {
+	msgLen, err := readLengthPrefix(stream)
+	if err != nil {
+		return nil, err
+	}
+	if msgLen > limit {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", msgLen, limit)
+	}
+	data := make([]byte, msgLen)
+	if _, err = io.ReadFull(stream, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,221 @@
+package peer
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/secagg"
+	"github.com/vs-ude/btml/internal/structs"
+	"google.golang.org/protobuf/proto"
+)
+
+// buildSecaggGroup sets up the secure aggregation of all members of a group
+// for the given rounds, with the mask keys already exchanged.
+func buildSecaggGroup(t *testing.T, conf secagg.Config, rounds []int64, names ...string) map[string]*secureAggregation {
+	peers := make(map[string]*secureAggregation, len(names))
+	for _, name := range names {
+		me := &Me{config: &Config{Name: name}, peerset: NewPeerSet(len(names), time.Minute, nil)}
+		sa, err := newSecureAggregation(me, conf)
+		require.NoError(t, err)
+		me.secagg = sa
+		peers[name] = sa
+	}
+	for _, name := range names {
+		sa := peers[name]
+		for j, other := range names {
+			if other == name {
+				continue
+			}
+			require.NoError(t, sa.setKey(other, peers[other].key.Public()))
+			addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7000 + j}
+			sa.addMember(&structs.Peer{Name: other, Addr: addr})
+		}
+		for _, round := range rounds {
+			r := sa.state(round)
+			r.leader = names[0]
+			r.group = slices.Sorted(slices.Values(names))
+		}
+	}
+	return peers
+}
+
+func TestSecureAggregationRevealsOnlyDropouts(t *testing.T) {
+	// prepare
+	conf := secagg.Config{Enabled: true, Round: 200 * time.Millisecond, MinUpdates: 2}
+	time.Sleep(time.Until(conf.End(conf.RoundAt(time.Now()))))
+	round := conf.RoundAt(time.Now())
+	peers := buildSecaggGroup(t, conf, []int64{round}, "a", "b", "c", "d", "e")
+	w := structs.NewFlatWeights([]float32{1, 2}, 1)
+	// a, b, c and d send to b, c and d, the update of e arrives too late
+	holders := []string{"b", "c", "d"}
+	for _, source := range []string{"a", "b", "c", "d"} {
+		messages, err := peers[source].mask(w)
+		require.NoError(t, err)
+		require.Len(t, messages, 4)
+		for _, receiver := range holders {
+			if receiver == source {
+				continue
+			}
+			update := &ModelUpdate{}
+			require.NoError(t, proto.Unmarshal(messages[receiver], update))
+			_, err = peers[receiver].unmask(update)
+			require.NoError(t, err)
+		}
+	}
+	_, errTwice := peers["a"].mask(w)
+	late, err := peers["e"].mask(w)
+	require.NoError(t, err)
+	time.Sleep(time.Until(conf.End(round).Add(conf.Round / 2)))
+	req := &ShareRequest{
+		Round: round,
+		Pairs: []*SeedShare{
+			{A: "a", B: "b", Source: "a"},
+			{A: "a", B: "e", Source: "a"},
+		},
+		Selves: []string{"a", "e"},
+	}
+
+	// run
+	outsider := peers["c"].answer("f", req)
+	responses := []*ShareResponse{
+		peers["b"].answer("c", req),
+		peers["c"].answer("b", req),
+		peers["d"].answer("b", req),
+	}
+
+	// verify
+	assert.Error(t, errTwice, "only one update should be masked per round")
+	assert.Empty(t, outsider.Shares, "peers outside the group should get nothing")
+	assert.Empty(t, outsider.SelfShares)
+	var shares []secagg.Share
+	for _, res := range responses {
+		require.Len(t, res.Shares, 1, "only the seed with the dropped peer should be revealed")
+		assert.Equal(t, "e", res.Shares[0].B)
+		require.Len(t, res.SelfShares, 1, "only the self mask of a peer that sent should be revealed")
+		assert.Equal(t, "a", res.SelfShares[0].Source)
+		shares = append(shares, secagg.Share{X: byte(res.Shares[0].X), Y: res.Shares[0].Y})
+	}
+	secret, err := secagg.Combine(shares)
+	require.NoError(t, err)
+	expected, err := peers["a"].Seed(secagg.NewPair("a", "e"), round)
+	require.NoError(t, err)
+	assert.Equal(t, expected[:], secret)
+	update := &ModelUpdate{}
+	require.NoError(t, proto.Unmarshal(late["c"], update))
+	_, err = peers["c"].unmask(update)
+	assert.Error(t, err, "no update should be accepted after shares were revealed")
+}
+
+func TestSecureAggregationCountsOnlyUpdatesOfOthers(t *testing.T) {
+	// prepare
+	conf := secagg.Config{Enabled: true, Round: 200 * time.Millisecond, MinUpdates: 2}
+	time.Sleep(time.Until(conf.End(conf.RoundAt(time.Now()))))
+	round := conf.RoundAt(time.Now())
+	peers := buildSecaggGroup(t, conf, []int64{round}, "a", "b", "c", "d")
+	w := structs.NewFlatWeights([]float32{1, 2}, 1)
+	// Only a and the requester b send to c besides c itself
+	for _, source := range []string{"a", "b", "c"} {
+		messages, err := peers[source].mask(w)
+		require.NoError(t, err)
+		if source == "c" {
+			continue
+		}
+		update := &ModelUpdate{}
+		require.NoError(t, proto.Unmarshal(messages["c"], update))
+		_, err = peers["c"].unmask(update)
+		require.NoError(t, err)
+	}
+	time.Sleep(time.Until(conf.End(round).Add(conf.Round / 2)))
+
+	// run
+	res := peers["c"].answer("b", &ShareRequest{Round: round, Selves: []string{"a"}})
+
+	// verify
+	assert.Empty(t, res.SelfShares, "the sum of b would only hold the update of a")
+}
+
+func TestSecureAggregationGroupCommit(t *testing.T) {
+	// prepare
+	conf := secagg.Config{Enabled: true, Round: time.Hour}
+	peers := buildSecaggGroup(t, conf, nil, "a", "b", "c", "d", "e")
+	sa := peers["b"]
+	next := conf.RoundAt(time.Now()) + 1
+	members := func(names ...string) []*GroupMember {
+		var m []*GroupMember
+		for _, name := range names {
+			m = append(m, &GroupMember{Id: name, Addr: "127.0.0.1:7000"})
+		}
+		return m
+	}
+
+	// run
+	joinedCurrent := sa.join("a", next-1)
+	joined := sa.join("a", next)
+	joinedTwice := sa.join("c", next)
+	_, errOther := sa.commit("c", &GroupCommit{Round: next, Members: members("a", "b", "c", "d")})
+	dropped, errDropped := sa.commit("a", &GroupCommit{Round: next})
+	rejoined := sa.join("c", next)
+	_, errSmall := sa.commit("c", &GroupCommit{Round: next, Members: members("b", "c", "d")})
+	sa.join("c", next)
+	group, err := sa.commit("c", &GroupCommit{Round: next, Members: members("b", "c", "d", "e")})
+
+	// verify
+	assert.False(t, joinedCurrent, "groups are only formed for the next round")
+	assert.True(t, joined)
+	assert.False(t, joinedTwice, "a peer joins one group per round")
+	assert.Error(t, errOther, "only the invitation that was accepted can be committed")
+	assert.NoError(t, errDropped)
+	assert.Nil(t, dropped)
+	assert.True(t, rejoined, "a peer left out of a group is free again")
+	assert.Error(t, errSmall)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d", "e"}, group)
+	assert.True(t, sa.isMember("e"))
+	assert.False(t, sa.isMember("a"))
+}
+
+func TestSecureAggregationKeepsKeysOfARound(t *testing.T) {
+	// prepare
+	conf := secagg.Config{Enabled: true, Round: time.Hour}
+	round := conf.RoundAt(time.Now())
+	peers := buildSecaggGroup(t, conf, []int64{round}, "a", "b", "c", "d")
+	pair := secagg.NewPair("a", "b")
+	before, err := peers["a"].Seed(pair, round)
+	require.NoError(t, err)
+	restarted, err := secagg.GenerateKey()
+	require.NoError(t, err)
+
+	// run
+	require.NoError(t, peers["a"].setKey("b", restarted.Public()))
+	after, err := peers["a"].Seed(pair, round)
+	require.NoError(t, err)
+	errInvalid := peers["a"].setKey("b", []byte("short"))
+	_, errOutsider := peers["a"].Seed(secagg.NewPair("a", "e"), round)
+
+	// verify
+	assert.Equal(t, before, after, "a new key must not change the seeds of a round")
+	assert.Error(t, errInvalid)
+	assert.Error(t, errOutsider)
+}
+
+func TestSecureAggregationRejectsVectorsOfAnotherSize(t *testing.T) {
+	// prepare
+	conf := secagg.Config{Enabled: true, Round: time.Hour, MinUpdates: 2}
+	peers := buildSecaggGroup(t, conf, []int64{conf.RoundAt(time.Now())}, "a", "b", "c", "d")
+	messages, err := peers["a"].mask(structs.NewFlatWeights([]float32{1, 2}, 1))
+	require.NoError(t, err)
+	_, err = peers["b"].mask(structs.NewFlatWeights([]float32{1, 2, 3}, 1))
+	require.NoError(t, err)
+	update := &ModelUpdate{}
+	require.NoError(t, proto.Unmarshal(messages["b"], update))
+
+	// run
+	_, err = peers["b"].unmask(update)
+
+	// verify
+	assert.Error(t, err)
+}
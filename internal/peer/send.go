@@ -0,0 +1,250 @@
+package peer
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/vs-ude/btml/internal/model"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+// SendPolicy decides which changes of the model are sent to other peers.
+// Decide is called for one change at a time.
+type SendPolicy interface {
+	Decide(ctx context.Context, c *ModelChange) (bool, error)
+	Name() string
+}
+
+// ModelChange is a change of the model offered to the send policy.
+type ModelChange struct {
+	Age     int
+	Loss    float32 // Training loss of the change
+	Peers   int     // Unchoked peers at the time of the change
+	pending *model.PendingWeights
+	weights *structs.Weights
+}
+
+// Weights fetches the weights of the change. They are only exported once.
+func (c *ModelChange) Weights(ctx context.Context) (*structs.Weights, error) {
+	if c.weights == nil {
+		w, err := c.pending.Weights(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.weights = w
+	}
+	return c.weights, nil
+}
+
+// Local fetches the weights of the change for comparisons. Unlike Weights,
+// they are never noised and do not spend the privacy budget, so they must
+// not be sent.
+func (c *ModelChange) Local(ctx context.Context) (*structs.Weights, error) {
+	if c.weights != nil {
+		return c.weights, nil
+	}
+	return c.pending.Local(ctx)
+}
+
+// NewSendPolicy returns the send policy selected in the config.
+func NewSendPolicy(c structs.SendConfig) (SendPolicy, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Policy {
+	case structs.SendEvery:
+		return &EverySendPolicy{N: c.Every}, nil
+	case structs.SendChange:
+		return &ChangeSendPolicy{MinDelta: c.MinDelta, MinLossDrop: c.MinLossDrop}, nil
+	case structs.SendRate:
+		return &RateSendPolicy{Interval: c.Interval}, nil
+	case structs.SendAdaptive:
+		return &AdaptiveSendPolicy{Reach: c.Reach}, nil
+	default:
+		p := structs.DefaultSendProbability
+		if c.Probability != nil {
+			p = *c.Probability
+		}
+		return &ProbabilitySendPolicy{P: p}, nil
+	}
+}
+
+// ProbabilitySendPolicy sends every change with probability P.
+type ProbabilitySendPolicy struct {
+	P float64
+}
+
+func (sp *ProbabilitySendPolicy) Decide(context.Context, *ModelChange) (bool, error) {
+	return rand.Float64() < sp.P, nil
+}
+
+func (sp *ProbabilitySendPolicy) Name() string {
+	return structs.SendProbability
+}
+
+// EverySendPolicy sends every N-th change.
+type EverySendPolicy struct {
+	N       int
+	changes int
+}
+
+func (sp *EverySendPolicy) Decide(context.Context, *ModelChange) (bool, error) {
+	sp.changes++
+	if sp.changes < sp.N {
+		return false, nil
+	}
+	sp.changes = 0
+	return true, nil
+}
+
+func (sp *EverySendPolicy) Name() string {
+	return structs.SendEvery
+}
+
+// ChangeSendPolicy sends a change once the training loss dropped by at least
+// MinLossDrop or the weights moved by at least MinDelta, relative to their
+// norm, since the last sent change. The first change is always sent. Zero
+// values disable a criterion. Checking the weights needs them to be exported
+// for every change, but only sent changes spend the privacy budget.
+type ChangeSendPolicy struct {
+	MinDelta    float64
+	MinLossDrop float32
+	last        *structs.TensorView
+	lastLoss    float32
+	sent        bool
+}
+
+func (sp *ChangeSendPolicy) Decide(ctx context.Context, c *ModelChange) (bool, error) {
+	var view *structs.TensorView
+	if sp.MinDelta > 0 {
+		w, err := c.Local(ctx)
+		if err != nil {
+			return false, err
+		}
+		if view, err = w.View(); err != nil {
+			return false, err
+		}
+	}
+	if sp.sent && !sp.changed(c, view) {
+		return false, nil
+	}
+	sp.last, sp.lastLoss, sp.sent = view, c.Loss, true
+	return true, nil
+}
+
+// changed reports whether the change differs enough from the last sent one.
+// Weights that cannot be compared count as changed.
+func (sp *ChangeSendPolicy) changed(c *ModelChange, view *structs.TensorView) bool {
+	if sp.MinLossDrop > 0 && sp.lastLoss-c.Loss >= sp.MinLossDrop {
+		return true
+	}
+	if view == nil || sp.last == nil {
+		return false
+	}
+	delta, err := view.Sub(sp.last)
+	return err != nil || delta.L2Norm() >= sp.MinDelta*sp.last.L2Norm()
+}
+
+func (sp *ChangeSendPolicy) Name() string {
+	return structs.SendChange
+}
+
+// RateSendPolicy sends a change if the last sent change is at least Interval
+// ago.
+type RateSendPolicy struct {
+	Interval time.Duration
+	last     time.Time
+}
+
+func (sp *RateSendPolicy) Decide(context.Context, *ModelChange) (bool, error) {
+	if time.Since(sp.last) < sp.Interval {
+		return false, nil
+	}
+	sp.last = time.Now()
+	return true, nil
+}
+
+func (sp *RateSendPolicy) Name() string {
+	return structs.SendRate
+}
+
+// AdaptiveSendPolicy sends changes with a probability that is inversely
+// proportional to the number of unchoked peers, which all receive a sent
+// change. On average Reach peers receive every change.
+type AdaptiveSendPolicy struct {
+	Reach float64
+}
+
+func (sp *AdaptiveSendPolicy) Decide(_ context.Context, c *ModelChange) (bool, error) {
+	if c.Peers < 1 {
+		return false, nil
+	}
+	return rand.Float64() < sp.Reach/float64(c.Peers), nil
+}
+
+func (sp *AdaptiveSendPolicy) Name() string {
+	return structs.SendAdaptive
+}
+
+// ModelChanged is the callback for changes of the model. It passes the change
+// on to ChangesLoop without blocking. A change that is still waiting is
+// replaced, as only the latest change is worth offering.
+func (me *Me) ModelChanged(pending *model.PendingWeights) {
+	for {
+		select {
+		case me.changes <- pending:
+			return
+		default:
+		}
+		select {
+		case <-me.changes:
+		default:
+		}
+	}
+}
+
+// ChangesLoop offers the changes of the model to the send policy one after
+// the other until the peer is shut down.
+func (me *Me) ChangesLoop() {
+	defer me.Wg.Done()
+
+	for {
+		select {
+		case <-me.Ctx.Done():
+			return
+		case pending := <-me.changes:
+			me.offer(pending)
+		}
+	}
+}
+
+// offer asks the send policy about the change and sends the weights if the
+// policy decides so.
+func (me *Me) offer(pending *model.PendingWeights) {
+	c := &ModelChange{
+		Age:     pending.Age(),
+		Loss:    pending.Loss(),
+		Peers:   me.peerset.UnchokedLen(),
+		pending: pending,
+	}
+	send, err := me.sendPolicy.Decide(me.Ctx, c)
+	if err == nil && send {
+		_, err = c.Weights(me.Ctx)
+	}
+	if me.Ctx.Err() != nil {
+		return
+	} else if err != nil {
+		slog.Debug("Not sending weights", "age", c.Age, "error", err)
+		send = false
+	}
+	if me.telemetry != nil {
+		go me.telemetry.RecordSendDecision(me.sendPolicy.Name(), send, c.Age, c.Loss, c.Peers)
+	}
+	if send && c.weights != me.lastSent {
+		// A superseded change may already have sent the weights of this one
+		me.lastSent = c.weights
+		me.Send(c.weights)
+	}
+}
@@ -0,0 +1,147 @@
+package peer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/model"
+	"github.com/vs-ude/btml/internal/privacy"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func TestNewSendPolicy(t *testing.T) {
+	p, err := NewSendPolicy(structs.SendConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, &ProbabilitySendPolicy{P: structs.DefaultSendProbability}, p)
+
+	_, err = NewSendPolicy(structs.SendConfig{Policy: structs.SendEvery})
+	assert.Error(t, err, "every needs a positive count")
+	_, err = NewSendPolicy(structs.SendConfig{Policy: "never"})
+	assert.Error(t, err)
+}
+
+func TestEverySendPolicy(t *testing.T) {
+	// prepare
+	p := &EverySendPolicy{N: 3}
+
+	// run
+	var sent []bool
+	for range 6 {
+		send, err := p.Decide(context.Background(), &ModelChange{})
+		require.NoError(t, err)
+		sent = append(sent, send)
+	}
+
+	// verify
+	assert.Equal(t, []bool{false, false, true, false, false, true}, sent)
+}
+
+func TestRateSendPolicy(t *testing.T) {
+	// prepare
+	p := &RateSendPolicy{Interval: time.Hour}
+
+	// run
+	first, _ := p.Decide(context.Background(), &ModelChange{})
+	second, _ := p.Decide(context.Background(), &ModelChange{})
+
+	// verify
+	assert.True(t, first)
+	assert.False(t, second, "a change within the interval should not be sent")
+}
+
+func TestAdaptiveSendPolicy(t *testing.T) {
+	p := &AdaptiveSendPolicy{Reach: 4}
+
+	send, _ := p.Decide(context.Background(), &ModelChange{Peers: 0})
+	assert.False(t, send, "nothing should be sent without peers")
+	send, _ = p.Decide(context.Background(), &ModelChange{Peers: 4})
+	assert.True(t, send, "changes should always be sent to fewer peers than the reach")
+}
+
+func TestChangeSendPolicyLoss(t *testing.T) {
+	// prepare
+	p := &ChangeSendPolicy{MinLossDrop: 0.1}
+
+	// run
+	var sent []bool
+	for _, loss := range []float32{1, 0.95, 0.85, 0.8} {
+		send, err := p.Decide(context.Background(), &ModelChange{Loss: loss})
+		require.NoError(t, err)
+		sent = append(sent, send)
+	}
+
+	// verify
+	assert.Equal(t, []bool{true, false, true, false}, sent)
+}
+
+func TestChangeSendPolicyDelta(t *testing.T) {
+	// prepare
+	m, err := model.NewModel(&model.Config{Name: "1", Backend: model.BackendGo, Dataset: model.SyntheticDataset, DataPath: t.TempDir()}, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Start())
+	var pending *model.PendingWeights
+	m.SetCallback(func(p *model.PendingWeights) { pending = p })
+	p := &ChangeSendPolicy{MinDelta: 1e6}
+
+	// run
+	var sent []bool
+	for range 2 {
+		_, err = m.Train(context.Background())
+		require.NoError(t, err)
+		send, err := p.Decide(context.Background(), &ModelChange{pending: pending})
+		require.NoError(t, err)
+		sent = append(sent, send)
+	}
+
+	// verify
+	assert.Equal(t, []bool{true, false}, sent, "a small change of the weights should not be sent")
+}
+
+func TestChangeSendPolicyDeltaSpendsNoBudget(t *testing.T) {
+	// prepare
+	m, err := model.NewModel(&model.Config{
+		Name:     "1",
+		Backend:  model.BackendGo,
+		Dataset:  model.SyntheticDataset,
+		DataPath: t.TempDir(),
+		Privacy:  privacy.Config{Epsilon: 10, Delta: 1e-5, ClipNorm: 1, Releases: 1},
+	}, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Start())
+	var pending *model.PendingWeights
+	m.SetCallback(func(p *model.PendingWeights) { pending = p })
+	p := &ChangeSendPolicy{MinDelta: 1e6}
+
+	// run
+	var sent []bool
+	for range 3 {
+		_, err = m.Train(context.Background())
+		require.NoError(t, err)
+		send, err := p.Decide(context.Background(), &ModelChange{pending: pending})
+		require.NoError(t, err)
+		sent = append(sent, send)
+	}
+	_, errSend := pending.Weights(context.Background())
+
+	// verify
+	assert.Equal(t, []bool{true, false, false}, sent)
+	assert.NoError(t, errSend, "deciding on a change should not spend the privacy budget")
+}
+
+func TestModelChangedKeepsOnlyLatest(t *testing.T) {
+	// prepare
+	me := &Me{changes: make(chan *model.PendingWeights, 1)}
+	first, second, third := &model.PendingWeights{}, &model.PendingWeights{}, &model.PendingWeights{}
+
+	// run
+	me.ModelChanged(first)
+	me.ModelChanged(second)
+	me.ModelChanged(third)
+
+	// verify
+	require.Len(t, me.changes, 1)
+	assert.Same(t, third, <-me.changes, "older changes that were not offered yet should be replaced")
+}
@@ -0,0 +1,213 @@
+package peer
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/vs-ude/btml/internal/model"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+// FileConfig is the TOML config file of a peer. Keys that are missing keep
+// the defaults, zero values in the tuning, send and incoming sections too.
+// Environment variables, flags and the tracker override it.
+type FileConfig struct {
+	Tracker    string              `toml:"tracker"`
+	Autoconf   bool                `toml:"autoconf"`
+	Name       string              `toml:"name"`
+	Addr       string              `toml:"addr"`
+	UpdateFreq time.Duration       `toml:"update_freq"`
+	Tuning     structs.Tuning      `toml:"tuning"`
+	Send       structs.SendConfig  `toml:"send"`
+	Incoming   structs.QueueConfig `toml:"incoming"`
+	Model      struct {
+		Backend         string  `toml:"backend"`
+		DataPath        string  `toml:"data_path"`
+		LogPath         string  `toml:"log_path"`
+		RunID           string  `toml:"run_id"`
+		ApplyStrategy   string  `toml:"apply_strategy"`
+		ChangeThreshold float32 `toml:"change_threshold"`
+	} `toml:"model"`
+	meta toml.MetaData // Tells which keys are defined
+}
+
+// LoadConfigFile reads the config file at path. Unknown keys are rejected,
+// so typos do not go unnoticed.
+func LoadConfigFile(path string) (*FileConfig, error) {
+	f := new(FileConfig)
+	md, err := toml.DecodeFile(path, f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read peer config file: %w", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown keys in peer config file: %v", undecoded)
+	}
+	f.meta = md
+	return f, nil
+}
+
+// Apply sets the values defined in the file on c, even zero values.
+func (f *FileConfig) Apply(c *Config) {
+	overrideDefined(f.meta, &c.TrackerURL, f.Tracker, "tracker")
+	overrideDefined(f.meta, &c.Name, f.Name, "name")
+	overrideDefined(f.meta, &c.Addr, f.Addr, "addr")
+	overrideDefined(f.meta, &c.UpdateFreq, f.UpdateFreq, "update_freq")
+	c.Tuning = c.Tuning.Override(f.Tuning)
+	c.Send = c.Send.Override(f.Send)
+	c.Incoming = c.Incoming.Override(f.Incoming)
+	if c.ModelConf != nil {
+		overrideDefined(f.meta, &c.ModelConf.Backend, f.Model.Backend, "model", "backend")
+		overrideDefined(f.meta, &c.ModelConf.DataPath, f.Model.DataPath, "model", "data_path")
+		overrideDefined(f.meta, &c.ModelConf.LogPath, f.Model.LogPath, "model", "log_path")
+		overrideDefined(f.meta, &c.ModelConf.RunID, f.Model.RunID, "model", "run_id")
+		overrideDefined(f.meta, &c.ModelConf.Apply.Strategy, f.Model.ApplyStrategy, "model", "apply_strategy")
+		overrideDefined(f.meta, &c.ModelConf.Apply.ChangeThreshold, f.Model.ChangeThreshold, "model", "change_threshold")
+	}
+}
+
+// overrideDefined sets v to o if the key is defined in the file.
+func overrideDefined[T any](md toml.MetaData, v *T, o T, key ...string) {
+	if md.IsDefined(key...) {
+		*v = o
+	}
+}
+
+// TuningFromEnv returns the tuning set by the PEER_* environment variables,
+// e.g. PEER_RECHOKE_INTERVAL for rechoke_interval.
+func TuningFromEnv() (structs.Tuning, error) {
+	var t structs.Tuning
+	var errs []error
+	for env, n := range map[string]*int{
+		"PEER_STORAGE_LAST_N":    &t.StorageLastN,
+		"PEER_STORAGE_STEP_CAP":  &t.StorageStepCap,
+		"PEER_OUTGOING_CAPACITY": &t.OutgoingCapacity,
+	} {
+		if v := os.Getenv(env); v != "" {
+			var err error
+			if *n, err = strconv.Atoi(v); err != nil {
+				errs = append(errs, fmt.Errorf("error parsing %s: %w", env, err))
+			}
+		}
+	}
+	for env, d := range map[string]*time.Duration{
+		"PEER_LAGGING_INTERVAL": &t.LaggingInterval,
+		"PEER_RECHOKE_INTERVAL": &t.RechokeInterval,
+		"PEER_KEEP_ALIVE":       &t.KeepAlive,
+		"PEER_IDLE_TIMEOUT":     &t.IdleTimeout,
+	} {
+		if v := os.Getenv(env); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil {
+				errs = append(errs, fmt.Errorf("error parsing %s: %w", env, err))
+			}
+		}
+	}
+	return t, errors.Join(errs...)
+}
+
+// TuningFlags defines a flag for every value of t on fs, e.g.
+// -rechoke-interval for rechoke_interval. Flags that are not given stay
+// zero.
+func TuningFlags(fs *flag.FlagSet, t *structs.Tuning) {
+	fs.IntVar(&t.StorageLastN, "storage-last-n", 0, "Latest sent updates kept for lagging peers.")
+	fs.IntVar(&t.StorageStepCap, "storage-step-cap", 0, "Maximum age gap between older updates kept for lagging peers.")
+	fs.IntVar(&t.OutgoingCapacity, "outgoing-capacity", 0, "Updates waiting to be sent.")
+	fs.DurationVar(&t.LaggingInterval, "lagging-interval", 0, "Interval of sending stored updates to lagging peers.")
+	fs.DurationVar(&t.RechokeInterval, "rechoke-interval", 0, "Interval of selecting the unchoked peers.")
+	fs.DurationVar(&t.KeepAlive, "keep-alive", 0, "QUIC keep alive period.")
+	fs.DurationVar(&t.IdleTimeout, "idle-timeout", 0, "QUIC idle timeout.")
+}
+
+// Validate checks the effective config, with the defaults of the tuning
+// applied.
+func (c *Config) Validate() error {
+	if c.Name == "" {
+		return errors.New("peer name is empty")
+	}
+	if c.TrackerURL == "" {
+		return errors.New("tracker URL is empty")
+	}
+	if c.PeerSetSize < 0 {
+		return fmt.Errorf("peer set size must not be negative, got %d", c.PeerSetSize)
+	}
+	if err := c.Incoming.Validate(); err != nil {
+		return err
+	}
+	if err := c.Send.Validate(); err != nil {
+		return err
+	}
+	if err := structs.DefaultTuning().Override(c.Tuning).Validate(); err != nil {
+		return fmt.Errorf("invalid tuning: %w", err)
+	}
+	if c.ModelConf != nil {
+		switch c.ModelConf.Backend {
+		case model.BackendPython, model.BackendGo, "":
+		default:
+			return fmt.Errorf("unknown model backend %q", c.ModelConf.Backend)
+		}
+		switch c.ModelConf.Apply.Strategy {
+		case model.ApplySimple, model.ApplyNaive, model.ApplyBuffered, "":
+		default:
+			return fmt.Errorf("unknown apply strategy %q", c.ModelConf.Apply.Strategy)
+		}
+		if c.ModelConf.Apply.ChangeThreshold < 0 {
+			return fmt.Errorf("change threshold must not be negative, got %g", c.ModelConf.Apply.ChangeThreshold)
+		}
+	}
+	return nil
+}
+
+// LogValue logs the effective config without the swarm token and the
+// telemetry credentials.
+func (c *Config) LogValue() slog.Value {
+	t := structs.DefaultTuning().Override(c.Tuning)
+	attrs := []slog.Attr{
+		slog.String("name", c.Name),
+		slog.String("tracker", c.TrackerURL),
+		slog.String("addr", c.Addr),
+		slog.Duration("update_freq", c.UpdateFreq),
+		slog.Int("peer_set_size", c.PeerSetSize),
+		slog.Duration("peer_set_archive_after", c.PeerSetArchiveAfter),
+		slog.Int("report_after", c.ReportAfter),
+		slog.Bool("pieces", c.Pieces),
+		slog.Group("incoming",
+			"policy", cmp.Or(c.Incoming.Policy, structs.QueueBlock),
+			"size", cmp.Or(max(c.Incoming.Size, 0), structs.DefaultQueueSize),
+			"timeout", c.Incoming.Timeout,
+		),
+		slog.Group("send", "policy", cmp.Or(c.Send.Policy, structs.SendProbability)),
+		slog.Group("tuning",
+			"storage_last_n", t.StorageLastN,
+			"storage_step_cap", t.StorageStepCap,
+			"lagging_interval", t.LaggingInterval,
+			"rechoke_interval", t.RechokeInterval,
+			"keep_alive", t.KeepAlive,
+			"idle_timeout", t.IdleTimeout,
+			"outgoing_capacity", t.OutgoingCapacity,
+		),
+		slog.Bool("telemetry", c.TelConf != nil),
+	}
+	if mc := c.ModelConf; mc != nil {
+		attrs = append(attrs, slog.Group("model",
+			"backend", mc.Backend,
+			"runtime", strings.Join(append([]string{mc.PythonRuntime}, mc.ModelArgs...), " "),
+			"dataset", mc.Dataset,
+			"architecture", mc.GetArchitecture(),
+			"data_path", mc.DataPath,
+			"log_path", mc.LogPath,
+			"run_id", mc.RunID,
+			"merge_policy", mc.MergePolicy,
+			"apply_strategy", mc.Apply.Strategy,
+			"change_threshold", fmt.Sprint(mc.Apply.ChangeThreshold),
+		))
+	}
+	return slog.GroupValue(attrs...)
+}
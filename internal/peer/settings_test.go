@@ -0,0 +1,118 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vs-ude/btml/internal/model"
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+func TestConfigLayers(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+name = "file"
+[tuning]
+rechoke_interval = "1m"
+lagging_interval = "10s"
+[send]
+policy = "rate"
+interval = "1m"
+[incoming]
+policy = "drop_oldest"
+[model]
+change_threshold = 0.01
+`), 0o600))
+	t.Setenv("PEER_LAGGING_INTERVAL", "20s")
+	c := &Config{Name: "default", TrackerURL: "http://tracker", ModelConf: model.DefaultConfig()}
+
+	// run
+	f, err := LoadConfigFile(path)
+	require.NoError(t, err)
+	f.Apply(c)
+	env, err := TuningFromEnv()
+	require.NoError(t, err)
+	c.Tuning = c.Tuning.Override(env)
+
+	// verify
+	assert.Equal(t, "file", c.Name)
+	assert.Equal(t, time.Minute, c.Tuning.RechokeInterval)
+	assert.Equal(t, 20*time.Second, c.Tuning.LaggingInterval, "the environment should override the file")
+	assert.Equal(t, structs.SendConfig{Policy: structs.SendRate, Interval: time.Minute}, c.Send)
+	assert.Equal(t, structs.QueueDropOldest, c.Incoming.Policy)
+	assert.Equal(t, float32(0.01), c.ModelConf.Apply.ChangeThreshold)
+	assert.Equal(t, model.BackendPython, c.ModelConf.Backend, "values missing in the file should keep the defaults")
+	assert.NoError(t, c.Validate())
+}
+
+func TestConfigFileOverridesWithZero(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[send]
+probability = 0
+[model]
+change_threshold = 0
+`), 0o600))
+	c := &Config{Name: "default", TrackerURL: "http://tracker", ModelConf: model.DefaultConfig()}
+	require.NotZero(t, c.ModelConf.Apply.ChangeThreshold)
+
+	// run
+	f, err := LoadConfigFile(path)
+	require.NoError(t, err)
+	f.Apply(c)
+	c.Send = c.Send.Override(structs.SendConfig{Policy: structs.SendProbability})
+	policy, err := NewSendPolicy(c.Send)
+	require.NoError(t, err)
+
+	// verify
+	assert.Zero(t, c.ModelConf.Apply.ChangeThreshold, "a zero in the file should override the default")
+	assert.Equal(t, "default", c.Name, "keys missing in the file should keep the defaults")
+	assert.Equal(t, &ProbabilitySendPolicy{P: 0}, policy, "a probability the tracker does not set should be kept")
+	assert.NoError(t, c.Validate())
+}
+
+func TestLoadConfigFileRejectsUnknownKeys(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte("[tuning]\nrechoke = \"1m\"\n"), 0o600))
+
+	// run
+	_, err := LoadConfigFile(path)
+
+	// verify
+	assert.ErrorContains(t, err, "tuning.rechoke")
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{Name: "1", TrackerURL: "http://tracker", ModelConf: model.DefaultConfig()}
+	}
+	require.NoError(t, valid().Validate())
+
+	c := valid()
+	c.Tuning.OutgoingCapacity = -1
+	assert.Error(t, c.Validate())
+	c = valid()
+	c.Send = structs.SendConfig{Policy: structs.SendRate}
+	assert.Error(t, c.Validate(), "the rate policy needs an interval")
+	c = valid()
+	c.ModelConf.Backend = "rust"
+	assert.Error(t, c.Validate())
+	c = valid()
+	c.ModelConf.Apply.Strategy = "eager"
+	assert.Error(t, c.Validate())
+}
+
+func TestTuningFromEnvInvalid(t *testing.T) {
+	t.Setenv("PEER_OUTGOING_CAPACITY", "many")
+
+	_, err := TuningFromEnv()
+
+	assert.ErrorContains(t, err, "PEER_OUTGOING_CAPACITY")
+}
@@ -14,6 +14,8 @@ type StorageStrategy interface {
 	Decide(*KnownPeer, *structs.Weights) (bool, error)
 	Store(structs.Weights)
 	Retrieve(min int) (*structs.Weights, error)
+	// Lookup returns the stored weights with the given content hash or nil.
+	Lookup(hash []byte) *structs.Weights
 }
 
 // This strategy attempts to only serve updates that are at most double the age
@@ -21,6 +23,7 @@ type StorageStrategy interface {
 // gaps in the stored updates.
 type DoubleAgeStorage struct {
 	storage     map[int]*structs.Weights
+	byHash      map[string]*structs.Weights // All weights in storage and the ring by content hash
 	steps       []int
 	stepSizeCap int
 	currentMax  int
@@ -32,6 +35,7 @@ type DoubleAgeStorage struct {
 func NewDoubleAgeStorage(lastN int, stepSizeCap int) *DoubleAgeStorage {
 	return &DoubleAgeStorage{
 		storage:     make(map[int]*structs.Weights),
+		byHash:      make(map[string]*structs.Weights),
 		steps:       make([]int, 0),
 		stepSizeCap: stepSizeCap,
 		currentMax:  0,
@@ -72,10 +76,29 @@ func (h *DoubleAgeStorage) Store(w structs.Weights) {
 
 	// This now points to the oldest weight we stored in the ring
 	h.last = h.last.Next()
+	if old, ok := h.last.Value.(*structs.Weights); ok && h.storage[old.GetAge()] != old {
+		h.unindex(old)
+	}
 	h.last.Value = &w
+	h.byHash[string(w.Hash())] = &w
 	h.currentMax = a
 }
 
+// unindex removes the weights from the hash index, unless the hash belongs to
+// other weights by now.
+func (h *DoubleAgeStorage) unindex(w *structs.Weights) {
+	key := string(w.Hash())
+	if h.byHash[key] == w {
+		delete(h.byHash, key)
+	}
+}
+
+func (h *DoubleAgeStorage) Lookup(hash []byte) *structs.Weights {
+	h.Lock()
+	defer h.Unlock()
+	return h.byHash[string(hash)]
+}
+
 // oldIsCloser tests whether the older age is closer to the step than the
 // newer. It assumes old < step && step <= new
 func oldIsCloser(old, step, new int) bool {
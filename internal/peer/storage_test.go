@@ -102,3 +102,26 @@ func retrieve(t *testing.T, d StorageStrategy, min int) int {
 	}
 	return w.GetAge()
 }
+
+func TestDoubleAgeStorageLookup(t *testing.T) {
+	// prepare
+	d := NewDoubleAgeStorage(3, 6)
+	weights := make([]*structs.Weights, 22)
+	for a := range weights {
+		weights[a] = structs.NewWeights([]byte{byte(a)}, a)
+		d.Store(*weights[a])
+	}
+
+	// run & verify
+	for _, a := range []int{2, 4, 8, 14, 19, 20, 21} {
+		w := d.Lookup(weights[a].Hash())
+		if w == nil || w.GetAge() != a {
+			t.Errorf("expected weights of age %d to be stored, got %v", a, w)
+		}
+	}
+	for _, a := range []int{0, 3, 17, 18} {
+		if w := d.Lookup(weights[a].Hash()); w != nil {
+			t.Errorf("expected weights of age %d to be evicted, got age %d", a, w.GetAge())
+		}
+	}
+}
@@ -3,9 +3,11 @@ package peer
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -13,17 +15,27 @@ import (
 	"github.com/vs-ude/btml/internal/structs"
 )
 
+const (
+	tokenHeader       = "swarm-token"
+	powNonceHeader    = "pow-nonce"
+	powSolutionHeader = "pow-solution"
+)
+
 type Tracker struct {
 	URL        string
+	Token      string
 	Peers      *structs.Peerlist
+	Banned     *structs.Peerlist
 	Identity   *structs.Peer
 	UpdateFreq time.Duration
+	key        ed25519.PrivateKey
 	sync.Mutex
 }
 
 func (t *Tracker) Setup(c *Config, p *structs.Peer) {
 	t.Identity = p
 	t.Peers = structs.NewPeerList()
+	t.Banned = structs.NewPeerList()
 
 	err := t.Join()
 	if err != nil {
@@ -35,6 +47,7 @@ func (t *Tracker) Setup(c *Config, p *structs.Peer) {
 func (t *Tracker) Update() error {
 	req, err := http.NewRequest("GET", t.URL+"/list", http.NoBody)
 	req.Header.Add("peer-id", t.Identity.Name)
+	req.Header.Set(tokenHeader, t.Token)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -56,16 +69,142 @@ func (t *Tracker) Update() error {
 
 func (t *Tracker) Join() error {
 	id, _ := json.Marshal(t.Identity)
-	_, err := http.Post(t.URL+"/join", "application/json", bytes.NewBuffer(id))
-	return err
+	req, err := http.NewRequest("POST", t.URL+"/join", bytes.NewBuffer(id))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err = admit(req, t.URL, t.Token); err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tracker refused join: %s", resp.Status)
+	}
+	return nil
 }
 
 func (t *Tracker) Leave() error {
 	id, _ := json.Marshal(t.Identity)
-	_, err := http.Post(t.URL+"/leave", "application/json", bytes.NewBuffer(id))
+	req, err := http.NewRequest("POST", t.URL+"/leave", bytes.NewBuffer(id))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(tokenHeader, t.Token)
+	_, err = http.DefaultClient.Do(req)
 	return err
 }
 
+// Report sends a signed misbehavior report about the accused peer to the
+// tracker.
+func (t *Tracker) Report(accused, reason string) error {
+	r := structs.NewReport(t.Identity.Name, accused, reason)
+	r.Sign(t.key)
+	data, _ := json.Marshal(r)
+	req, err := http.NewRequest("POST", t.URL+"/report", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(tokenHeader, t.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tracker refused report: %s", resp.Status)
+	}
+	return nil
+}
+
+// UpdateBanList fetches the list of quarantined peers from the tracker.
+func (t *Tracker) UpdateBanList() error {
+	req, err := http.NewRequest("GET", t.URL+"/banlist", http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(tokenHeader, t.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := getResponseBody(resp)
+	if err != nil {
+		return err
+	}
+	banned := new(structs.Peerlist)
+	if err = banned.Unmarshal(*body); err != nil {
+		return fmt.Errorf("unable to parse ban list from tracker\n%w", err)
+	}
+	t.Banned = banned
+	return nil
+}
+
+// IsBanned checks whether the peer is quarantined by the tracker.
+func (t *Tracker) IsBanned(name string) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.Banned.Has(name)
+}
+
+// isBannedAddr checks whether the address belongs to a quarantined peer.
+func (t *Tracker) isBannedAddr(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, p := range t.Banned.List {
+		if p.Addr != nil && p.Addr.IP.Equal(udpAddr.IP) && p.Addr.Port == udpAddr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// admit prepares a request for the admission checks of the tracker. It sets
+// the swarm token and solves a proof-of-work challenge if the tracker demands
+// one.
+func admit(req *http.Request, trackerURL, token string) error {
+	req.Header.Set(tokenHeader, token)
+	creq, err := http.NewRequest("GET", trackerURL+"/challenge", http.NoBody)
+	if err != nil {
+		return err
+	}
+	creq.Header.Set(tokenHeader, token)
+	resp, err := http.DefaultClient.Do(creq)
+	if err != nil {
+		return fmt.Errorf("unable to get challenge from tracker: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tracker refused challenge: %s", resp.Status)
+	}
+	body, err := getResponseBody(resp)
+	if err != nil {
+		return err
+	}
+	c := new(structs.Challenge)
+	if err = json.Unmarshal(*body, c); err != nil {
+		return fmt.Errorf("unable to parse challenge from tracker: %w", err)
+	}
+	if c.Difficulty > 0 {
+		start := time.Now()
+		req.Header.Set(powNonceHeader, c.Nonce)
+		req.Header.Set(powSolutionHeader, c.Solve())
+		slog.Debug("Solved tracker challenge", "difficulty", c.Difficulty, "duration", time.Since(start))
+	}
+	return nil
+}
+
 func getResponseBody(resp *http.Response) (*[]byte, error) {
 	var b []byte
 	if resp.ContentLength > 0 {
@@ -98,6 +237,11 @@ func (t *Tracker) periodicUpdate(wg *sync.WaitGroup, ctx context.Context) {
 		case <-timer.C:
 			t.Lock()
 			err := t.Update()
+			if err == nil {
+				if banErr := t.UpdateBanList(); banErr != nil {
+					slog.Debug("Failed updating ban list from tracker", "error", banErr)
+				}
+			}
 			t.Unlock()
 			if err != nil {
 				errCount++
@@ -8,6 +8,7 @@ import (
 
 	"github.com/vs-ude/btml/internal/model"
 	"github.com/vs-ude/btml/internal/peer"
+	"github.com/vs-ude/btml/internal/structs"
 )
 
 type Step interface {
@@ -15,16 +16,21 @@ type Step interface {
 	Run(*peer.Me, *model.Model) error
 }
 
+// Train trains the model. Non-zero hyperparameters override the configured
+// ones for this step.
 type Train struct {
+	Hyperparams structs.Hyperparams
 }
 
-func (t *Train) Setup(_ string) error {
-	return nil
+// Setup parses hyperparameter overrides like "epochs=2,learning_rate=0.01".
+func (t *Train) Setup(in string) (err error) {
+	t.Hyperparams, err = structs.ParseHyperparams(in)
+	return
 }
 
-func (t *Train) Run(_ *peer.Me, mod *model.Model) error {
+func (t *Train) Run(me *peer.Me, mod *model.Model) error {
 	// log.Default().Println("Training model")
-	mod.Train()
+	mod.TrainWith(me.Ctx, t.Hyperparams)
 	return nil
 }
 
@@ -35,9 +41,9 @@ func (t *Eval) Setup(_ string) error {
 	return nil
 }
 
-func (t *Eval) Run(_ *peer.Me, mod *model.Model) error {
+func (t *Eval) Run(me *peer.Me, mod *model.Model) error {
 	// log.Default().Println("Evaluating model")
-	mod.Eval()
+	mod.Eval(me.Ctx)
 	return nil
 }
 
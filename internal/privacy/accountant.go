@@ -0,0 +1,118 @@
+// Package privacy implements the differential privacy accounting for the
+// updates a peer sends. Every update is clipped to an L2 norm bound and
+// Gaussian noise is added by the model backend, the Accountant keeps track of
+// the spent privacy budget using zero-concentrated differential privacy.
+package privacy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+var ErrBudgetExhausted = errors.New("privacy budget exhausted")
+
+// Config is the target privacy guarantee of a peer over all of its updates.
+// A zero Epsilon disables differential privacy.
+type Config struct {
+	Epsilon  float64 `toml:"epsilon"`
+	Delta    float64 `toml:"delta"`
+	ClipNorm float32 `toml:"clip_norm"` // L2 norm bound of an update
+	Releases int     `toml:"releases"`  // Number of updates the budget is planned for
+}
+
+func (c Config) Enabled() bool {
+	return c.Epsilon > 0
+}
+
+func (c Config) Validate() error {
+	if c.Delta <= 0 || c.Delta >= 1 {
+		return fmt.Errorf("delta must be between 0 and 1, got %g", c.Delta)
+	}
+	if c.ClipNorm <= 0 {
+		return fmt.Errorf("clip norm must be positive, got %g", c.ClipNorm)
+	}
+	if c.Releases < 1 {
+		return fmt.Errorf("releases must be positive, got %d", c.Releases)
+	}
+	return nil
+}
+
+// Accountant calibrates the noise for the planned number of releases and
+// tracks the budget spent by the actual releases.
+type Accountant struct {
+	conf            Config
+	noiseMultiplier float64 // Standard deviation of the noise relative to the clip norm
+	rho             float64 // Spent zCDP budget
+	releases        int
+	sync.Mutex
+}
+
+func NewAccountant(c Config) (*Accountant, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &Accountant{
+		conf:            c,
+		noiseMultiplier: NoiseMultiplier(c.Epsilon, c.Delta, c.Releases),
+	}, nil
+}
+
+// NoiseMultiplier returns the noise multiplier of the Gaussian mechanism, so
+// that the given number of releases satisfy (epsilon, delta)-DP.
+func NoiseMultiplier(epsilon, delta float64, releases int) float64 {
+	// A release with noise multiplier z is 1/(2z²)-zCDP and rho-zCDP implies
+	// (rho + 2*sqrt(rho*ln(1/delta)), delta)-DP.
+	l := math.Log(1 / delta)
+	rho := math.Pow(math.Sqrt(l+epsilon)-math.Sqrt(l), 2)
+	return math.Sqrt(float64(releases) / (2 * rho))
+}
+
+// Epsilon converts the zCDP budget rho to epsilon for the given delta.
+func Epsilon(rho, delta float64) float64 {
+	return rho + 2*math.Sqrt(rho*math.Log(1/delta))
+}
+
+func (a *Accountant) ClipNorm() float32 {
+	return a.conf.ClipNorm
+}
+
+func (a *Accountant) NoiseMultiplier() float32 {
+	return float32(a.noiseMultiplier)
+}
+
+func (a *Accountant) Delta() float64 {
+	return a.conf.Delta
+}
+
+// Check returns ErrBudgetExhausted if another release would exceed the
+// target epsilon.
+func (a *Accountant) Check() error {
+	a.Lock()
+	defer a.Unlock()
+	if Epsilon(a.rho+a.releaseRho(), a.conf.Delta) > a.conf.Epsilon*(1+1e-9) {
+		return ErrBudgetExhausted
+	}
+	return nil
+}
+
+// Spend records a release and returns the spent epsilon.
+func (a *Accountant) Spend() float64 {
+	a.Lock()
+	defer a.Unlock()
+	a.rho += a.releaseRho()
+	a.releases++
+	return Epsilon(a.rho, a.conf.Delta)
+}
+
+// Spent returns the spent epsilon and the number of releases.
+func (a *Accountant) Spent() (epsilon float64, releases int) {
+	a.Lock()
+	defer a.Unlock()
+	return Epsilon(a.rho, a.conf.Delta), a.releases
+}
+
+func (a *Accountant) releaseRho() float64 {
+	return 1 / (2 * a.noiseMultiplier * a.noiseMultiplier)
+}
@@ -0,0 +1,41 @@
+package privacy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountantSpendsPlannedBudget(t *testing.T) {
+	// prepare
+	a, err := NewAccountant(Config{Epsilon: 8, Delta: 1e-5, ClipNorm: 1, Releases: 10})
+	require.NoError(t, err)
+
+	// run
+	var epsilon float64
+	for range 10 {
+		require.NoError(t, a.Check())
+		epsilon = a.Spend()
+	}
+
+	// verify
+	assert.InDelta(t, 8, epsilon, 1e-6)
+	assert.ErrorIs(t, a.Check(), ErrBudgetExhausted)
+}
+
+func TestNoiseMultiplierGrowsWithReleases(t *testing.T) {
+	// run
+	few := NoiseMultiplier(1, 1e-5, 1)
+	many := NoiseMultiplier(1, 1e-5, 100)
+
+	// verify
+	assert.InDelta(t, few*10, many, 1e-9)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.Error(t, Config{Epsilon: 1, Delta: 0, ClipNorm: 1, Releases: 1}.Validate())
+	assert.Error(t, Config{Epsilon: 1, Delta: 1e-5, ClipNorm: 0, Releases: 1}.Validate())
+	assert.Error(t, Config{Epsilon: 1, Delta: 1e-5, ClipNorm: 1, Releases: 0}.Validate())
+	assert.NoError(t, Config{Epsilon: 1, Delta: 1e-5, ClipNorm: 1, Releases: 1}.Validate())
+}
@@ -0,0 +1,81 @@
+package secagg
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Update is a masked update of a round.
+type Update struct {
+	Source    string
+	Round     int64
+	Group     []string // Peers the source added masks for, i.e. its group without itself
+	Threshold int      // Number of shares needed to reconstruct a seed
+	Vector    []uint32
+	Shares    map[Pair]Share // Shares of the seeds of the source held by the receiver
+	SelfShare Share          // Share of the seed of the self mask held by the receiver
+}
+
+// Threshold returns the number of shares needed for a group of the given size.
+func Threshold(group int) int {
+	return group/2 + 1
+}
+
+// Residual is a mask the source added that is not cancelled in a sum.
+type Residual struct {
+	Source string
+	Pair   Pair
+}
+
+// Residuals returns the masks that do not cancel in the sum of the updates,
+// i.e. the masks for group members that did not send an update or did not
+// add the mask themselves.
+func Residuals(updates []*Update) []Residual {
+	groups := make(map[string][]string, len(updates))
+	for _, u := range updates {
+		groups[u.Source] = u.Group
+	}
+	var residuals []Residual
+	for _, u := range updates {
+		for _, other := range u.Group {
+			if g, ok := groups[other]; ok && slices.Contains(g, u.Source) {
+				continue
+			}
+			residuals = append(residuals, Residual{Source: u.Source, Pair: NewPair(u.Source, other)})
+		}
+	}
+	return residuals
+}
+
+// Sum adds the vectors of the updates and removes the residual masks and the
+// self masks with the given seeds.
+func Sum(updates []*Update, seeds map[Pair]Seed, selfSeeds map[string]Seed) ([]uint32, error) {
+	if len(updates) == 0 {
+		return nil, errors.New("no updates")
+	}
+	sum := make([]uint32, len(updates[0].Vector))
+	for _, u := range updates {
+		if len(u.Vector) != len(sum) {
+			return nil, fmt.Errorf("update of %s has %d values instead of %d", u.Source, len(u.Vector), len(sum))
+		}
+		for i, v := range u.Vector {
+			sum[i] += v
+		}
+	}
+	for _, r := range Residuals(updates) {
+		seed, ok := seeds[r.Pair]
+		if !ok {
+			return nil, fmt.Errorf("missing seed of %s and %s", r.Pair.A, r.Pair.B)
+		}
+		AddMask(sum, seed, r.Pair, r.Source, true)
+	}
+	for _, u := range updates {
+		seed, ok := selfSeeds[u.Source]
+		if !ok {
+			return nil, fmt.Errorf("missing self mask seed of %s", u.Source)
+		}
+		AddSelfMask(sum, seed, true)
+	}
+	return sum, nil
+}
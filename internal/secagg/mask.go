@@ -0,0 +1,176 @@
+// Package secagg implements secure aggregation with pairwise masks. Every
+// peer joins at most one group per round, formed among unchoked peers. Every
+// peer adds a mask for each member of its group, which the member subtracts
+// from its own update, so the masks cancel in the sum of both updates. The
+// masks are derived from X25519 key agreement per round. On top, every peer adds a
+// random self mask. The seeds of all masks are Shamir shared among the
+// group. Members reveal the self mask seeds of peers that sent an update and
+// the pairwise seeds of peers that dropped out, never both for one peer, so
+// no single update can be unmasked.
+package secagg
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	mrand "math/rand/v2"
+	"time"
+)
+
+// Fixed point precision of masked vectors. The sum of all updates of a
+// round must stay within ±2^15.
+const fractionBits = 16
+
+// Config configures secure aggregation.
+type Config struct {
+	Enabled bool          `toml:"enabled"`
+	Round   time.Duration `toml:"round"` // Updates of the same round are aggregated
+	// Rounds with fewer updates are discarded, as their sum would reveal
+	// single updates
+	MinUpdates int `toml:"min_updates"`
+	GroupSize  int `toml:"group_size"` // Any value < MinGroupSize selects DefaultGroupSize
+}
+
+// DefaultGroupSize is the size of the groups if none is configured.
+const DefaultGroupSize = 5
+
+// MinGroupSize is the size of the smallest group that can be aggregated. A
+// member reveals shares only if it received updates of two peers besides
+// itself and the requester.
+const MinGroupSize = 4
+
+// RoundAt returns the round at the given time.
+func (c Config) RoundAt(t time.Time) int64 {
+	return t.UnixNano() / int64(c.Round)
+}
+
+// End returns the time at which the round ends.
+func (c Config) End(round int64) time.Time {
+	return time.Unix(0, (round+1)*int64(c.Round))
+}
+
+// Closed returns whether updates of the round are no longer accepted. The
+// grace period allows for updates sent at the end of the round.
+func (c Config) Closed(round int64, now time.Time) bool {
+	return !now.Before(c.End(round).Add(c.Round / 2))
+}
+
+// Size returns the number of members a group grows to.
+func (c Config) Size() int {
+	if c.GroupSize < MinGroupSize {
+		return DefaultGroupSize
+	}
+	return c.GroupSize
+}
+
+type Seed [32]byte
+
+// Pair identifies the pairwise mask of two peers. A is the smaller name.
+type Pair struct {
+	A, B string
+}
+
+func NewPair(x, y string) Pair {
+	if x > y {
+		x, y = y, x
+	}
+	return Pair{A: x, B: y}
+}
+
+// KeyPair is the X25519 key pair of a peer.
+type KeyPair struct {
+	priv *ecdh.PrivateKey
+}
+
+func GenerateKey() (*KeyPair, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{priv: priv}, nil
+}
+
+func (k *KeyPair) Public() []byte {
+	return k.priv.PublicKey().Bytes()
+}
+
+// Seed derives the seed of the mask of the pair for a round from the public
+// key of the other peer of the pair.
+func (k *KeyPair) Seed(other []byte, pair Pair, round int64) (Seed, error) {
+	pub, err := ecdh.X25519().NewPublicKey(other)
+	if err != nil {
+		return Seed{}, fmt.Errorf("invalid mask key: %w", err)
+	}
+	secret, err := k.priv.ECDH(pub)
+	if err != nil {
+		return Seed{}, err
+	}
+	h := sha256.New()
+	h.Write([]byte("btml secagg"))
+	h.Write(secret)
+	h.Write([]byte(pair.A))
+	h.Write([]byte{0})
+	h.Write([]byte(pair.B))
+	h.Write(binary.LittleEndian.AppendUint64(nil, uint64(round)))
+	var seed Seed
+	copy(seed[:], h.Sum(nil))
+	return seed, nil
+}
+
+// NewSeed returns a random seed for a self mask.
+func NewSeed() (Seed, error) {
+	var seed Seed
+	_, err := rand.Read(seed[:])
+	return seed, err
+}
+
+// Quantize converts the vector to fixed point.
+func Quantize(v []float32) []uint32 {
+	q := make([]uint32, len(v))
+	for i, x := range v {
+		f := math.Round(float64(x) * (1 << fractionBits))
+		q[i] = uint32(int32(min(max(f, math.MinInt32), math.MaxInt32)))
+	}
+	return q
+}
+
+// Dequantize converts the fixed point sum of n vectors to their average.
+func Dequantize(q []uint32, n int) []float32 {
+	v := make([]float32, len(q))
+	for i, x := range q {
+		v[i] = float32(float64(int32(x)) / (1 << fractionBits) / float64(n))
+	}
+	return v
+}
+
+// AddMask adds the mask of the pair to the vector of source. The mask is
+// added for A and subtracted for B, so it cancels in the sum of both. With
+// remove the mask is removed again.
+func AddMask(v []uint32, seed Seed, pair Pair, source string, remove bool) {
+	prg := mrand.New(mrand.NewChaCha8(seed))
+	subtract := (source == pair.B) != remove
+	for i := range v {
+		m := prg.Uint32()
+		if subtract {
+			v[i] -= m
+		} else {
+			v[i] += m
+		}
+	}
+}
+
+// AddSelfMask adds the self mask of a peer to its vector. With remove the
+// mask is removed again.
+func AddSelfMask(v []uint32, seed Seed, remove bool) {
+	prg := mrand.New(mrand.NewChaCha8(seed))
+	for i := range v {
+		if remove {
+			v[i] -= prg.Uint32()
+		} else {
+			v[i] += prg.Uint32()
+		}
+	}
+}
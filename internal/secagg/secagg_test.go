@@ -0,0 +1,136 @@
+package secagg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShamirCombine(t *testing.T) {
+	// prepare
+	secret := []byte("a secret seed of thirty-two byte")
+	shares, err := Split(secret, 5, 3)
+	require.NoError(t, err)
+
+	// run
+	combined, err := Combine([]Share{shares[4], shares[0], shares[2]})
+
+	// verify
+	require.NoError(t, err)
+	assert.Equal(t, secret, combined)
+	few, err := Combine(shares[:2])
+	require.NoError(t, err)
+	assert.NotEqual(t, secret, few, "less than the threshold should not reveal the secret")
+}
+
+func TestShamirInvalid(t *testing.T) {
+	_, err := Split([]byte("x"), 2, 3)
+	assert.Error(t, err)
+	shares, err := Split([]byte("x"), 3, 2)
+	require.NoError(t, err)
+	_, err = Combine([]Share{shares[0], shares[0]})
+	assert.Error(t, err)
+}
+
+func TestSeedAgreement(t *testing.T) {
+	// prepare
+	a, err := GenerateKey()
+	require.NoError(t, err)
+	b, err := GenerateKey()
+	require.NoError(t, err)
+	pair := NewPair("b", "a")
+
+	// run
+	seedA, err := a.Seed(b.Public(), pair, 7)
+	require.NoError(t, err)
+	seedB, err := b.Seed(a.Public(), pair, 7)
+	require.NoError(t, err)
+	other, err := a.Seed(b.Public(), pair, 8)
+	require.NoError(t, err)
+
+	// verify
+	assert.Equal(t, seedA, seedB)
+	assert.NotEqual(t, seedA, other, "every round should use other masks")
+}
+
+// maskedUpdates masks the vectors of the peers with all other peers and their
+// self masks.
+func maskedUpdates(t *testing.T, vectors map[string][]float32) ([]*Update, map[Pair]Seed, map[string]Seed) {
+	names := []string{}
+	keys := map[string]*KeyPair{}
+	for name := range vectors {
+		k, err := GenerateKey()
+		require.NoError(t, err)
+		names = append(names, name)
+		keys[name] = k
+	}
+	seeds := map[Pair]Seed{}
+	selfSeeds := map[string]Seed{}
+	var updates []*Update
+	for _, name := range names {
+		u := &Update{Source: name, Vector: Quantize(vectors[name])}
+		self, err := NewSeed()
+		require.NoError(t, err)
+		selfSeeds[name] = self
+		AddSelfMask(u.Vector, self, false)
+		for _, other := range names {
+			if other == name {
+				continue
+			}
+			pair := NewPair(name, other)
+			seed, err := keys[name].Seed(keys[other].Public(), pair, 1)
+			require.NoError(t, err)
+			seeds[pair] = seed
+			AddMask(u.Vector, seed, pair, name, false)
+			u.Group = append(u.Group, other)
+		}
+		updates = append(updates, u)
+	}
+	return updates, seeds, selfSeeds
+}
+
+func TestMasksCancel(t *testing.T) {
+	// prepare
+	updates, _, selfSeeds := maskedUpdates(t, map[string][]float32{
+		"a": {1, -2, 0.5},
+		"b": {3, 2, -0.5},
+		"c": {-1, 3, 1.5},
+	})
+	assert.NotEqual(t, Quantize([]float32{1, -2, 0.5}), updates[0].Vector)
+
+	// run
+	_, errSelf := Sum(updates, nil, nil)
+	sum, err := Sum(updates, nil, selfSeeds)
+
+	// verify
+	assert.Error(t, errSelf, "the self masks should not cancel")
+	require.NoError(t, err)
+	assert.InDeltaSlice(t, []float32{1, 1, 0.5}, Dequantize(sum, 3), 1e-4)
+}
+
+func TestResidualMasksOfDropouts(t *testing.T) {
+	// prepare
+	updates, seeds, selfSeeds := maskedUpdates(t, map[string][]float32{
+		"a": {1, 2},
+		"b": {3, 4},
+		"c": {5, 6},
+	})
+	var survivors []*Update
+	for _, u := range updates {
+		if u.Source != "c" {
+			survivors = append(survivors, u)
+		}
+	}
+
+	// run
+	residuals := Residuals(survivors)
+	_, errMissing := Sum(survivors, nil, selfSeeds)
+	sum, err := Sum(survivors, seeds, selfSeeds)
+
+	// verify
+	assert.ElementsMatch(t, []Residual{{Source: "a", Pair: NewPair("a", "c")}, {Source: "b", Pair: NewPair("b", "c")}}, residuals)
+	assert.Error(t, errMissing)
+	require.NoError(t, err)
+	assert.InDeltaSlice(t, []float32{2, 3}, Dequantize(sum, 2), 1e-4)
+}
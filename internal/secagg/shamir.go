@@ -0,0 +1,116 @@
+package secagg
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Share is a Shamir share of a secret. X is the evaluation point and never 0.
+type Share struct {
+	X byte
+	Y []byte
+}
+
+// GF(2^8) with the AES polynomial, 3 generates the multiplicative group.
+var gfExp, gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := range 255 {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		x ^= gfMulSlow(x, 2)
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMulSlow(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 == 1 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])-int(gfLog[b])+255)%255]
+}
+
+// Split divides the secret into n shares, any t of which reconstruct it.
+func Split(secret []byte, n, t int) ([]Share, error) {
+	if t < 1 || t > n || n > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares", t, n)
+	}
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	coeffs := make([]byte, t)
+	for k, b := range secret {
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		coeffs[0] = b
+		for i := range shares {
+			// Horner's method
+			var y byte
+			for j := t - 1; j >= 0; j-- {
+				y = gfMul(y, shares[i].X) ^ coeffs[j]
+			}
+			shares[i].Y[k] = y
+		}
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from the shares. It needs at least the
+// threshold of shares given to Split, otherwise the result is wrong.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	size := len(shares[0].Y)
+	seen := make(map[byte]bool, len(shares))
+	for _, s := range shares {
+		if s.X == 0 || seen[s.X] {
+			return nil, fmt.Errorf("invalid or duplicate share %d", s.X)
+		}
+		if len(s.Y) != size {
+			return nil, errors.New("shares have different sizes")
+		}
+		seen[s.X] = true
+	}
+	secret := make([]byte, size)
+	for i, si := range shares {
+		// Lagrange basis polynomial of share i at 0
+		l := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				l = gfMul(l, gfDiv(sj.X, sj.X^si.X))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(l, si.Y[k])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,43 @@
+package structs
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// Challenge is a proof-of-work puzzle handed out by the tracker. A solution
+// is any string s for which sha256(Nonce + ":" + s) starts with at least
+// Difficulty zero bits.
+type Challenge struct {
+	Nonce      string
+	Difficulty int
+}
+
+// Solve searches for a solution to the challenge. The expected effort doubles
+// with each additional bit of difficulty.
+func (c *Challenge) Solve() string {
+	for i := uint64(0); ; i++ {
+		s := strconv.FormatUint(i, 36)
+		if c.Verify(s) {
+			return s
+		}
+	}
+}
+
+// Verify checks whether the given solution solves the challenge.
+func (c *Challenge) Verify(solution string) bool {
+	sum := sha256.Sum256([]byte(c.Nonce + ":" + solution))
+	return leadingZeroBits(sum[:]) >= c.Difficulty
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, v := range b {
+		if v != 0 {
+			return n + bits.LeadingZeros8(v)
+		}
+		n += 8
+	}
+	return n
+}
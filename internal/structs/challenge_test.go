@@ -0,0 +1,47 @@
+package structs
+
+import (
+	"testing"
+)
+
+func TestChallengeSolve(t *testing.T) {
+	// prepare
+	c := &Challenge{Nonce: "abc", Difficulty: 12}
+
+	// run
+	s := c.Solve()
+
+	// verify
+	if !c.Verify(s) {
+		t.Errorf("solution %s does not solve the challenge", s)
+	}
+}
+
+func TestChallengeVerifyDifficulty(t *testing.T) {
+	// prepare
+	easy := &Challenge{Nonce: "abc", Difficulty: 0}
+	impossible := &Challenge{Nonce: "abc", Difficulty: 257}
+
+	// run & verify
+	if !easy.Verify("anything") {
+		t.Error("difficulty 0 should accept any solution")
+	}
+	if impossible.Verify("anything") {
+		t.Error("difficulty above the hash size should reject every solution")
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	cases := map[int][]byte{
+		0:  {0x80},
+		3:  {0x10, 0xff},
+		8:  {0x00, 0xff},
+		15: {0x00, 0x01},
+		16: {0x00, 0x00},
+	}
+	for expect, in := range cases {
+		if got := leadingZeroBits(in); got != expect {
+			t.Errorf("for %x expected %d, got %d", in, expect, got)
+		}
+	}
+}
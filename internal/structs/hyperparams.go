@@ -0,0 +1,91 @@
+package structs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Hyperparams configure a local training run. Zero values mean that the
+// backend default is used.
+type Hyperparams struct {
+	Epochs       int     `toml:"epochs"`
+	Steps        int     `toml:"steps"` // Limits the number of batches per run, overrides Epochs
+	LearningRate float32 `toml:"learning_rate"`
+	BatchSize    int     `toml:"batch_size"`
+	Optimizer    string  `toml:"optimizer"` // "sgd" or "adam"
+	Momentum     float32 `toml:"momentum"`
+	WeightDecay  float32 `toml:"weight_decay"`
+}
+
+// Merge returns a copy of h where all non-zero values of override are
+// applied.
+func (h Hyperparams) Merge(override Hyperparams) Hyperparams {
+	if override.Epochs != 0 {
+		h.Epochs = override.Epochs
+	}
+	if override.Steps != 0 {
+		h.Steps = override.Steps
+	}
+	if override.LearningRate != 0 {
+		h.LearningRate = override.LearningRate
+	}
+	if override.BatchSize != 0 {
+		h.BatchSize = override.BatchSize
+	}
+	if override.Optimizer != "" {
+		h.Optimizer = override.Optimizer
+	}
+	if override.Momentum != 0 {
+		h.Momentum = override.Momentum
+	}
+	if override.WeightDecay != 0 {
+		h.WeightDecay = override.WeightDecay
+	}
+	return h
+}
+
+// ParseHyperparams parses a comma separated list of key=value pairs, e.g.
+// "epochs=2,learning_rate=0.01". The keys match the TOML keys.
+func ParseHyperparams(in string) (Hyperparams, error) {
+	var h Hyperparams
+	for pair := range strings.SplitSeq(in, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return h, fmt.Errorf("invalid hyperparameter %q", pair)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "epochs":
+			h.Epochs, err = strconv.Atoi(value)
+		case "steps":
+			h.Steps, err = strconv.Atoi(value)
+		case "batch_size":
+			h.BatchSize, err = strconv.Atoi(value)
+		case "learning_rate":
+			h.LearningRate, err = parseFloat32(value)
+		case "momentum":
+			h.Momentum, err = parseFloat32(value)
+		case "weight_decay":
+			h.WeightDecay, err = parseFloat32(value)
+		case "optimizer":
+			h.Optimizer = value
+		default:
+			return h, fmt.Errorf("unknown hyperparameter %q", key)
+		}
+		if err != nil {
+			return h, fmt.Errorf("invalid value for hyperparameter %s: %w", key, err)
+		}
+	}
+	return h, nil
+}
+
+func parseFloat32(s string) (float32, error) {
+	f, err := strconv.ParseFloat(s, 32)
+	return float32(f), err
+}
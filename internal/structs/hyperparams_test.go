@@ -0,0 +1,45 @@
+package structs
+
+import (
+	"testing"
+)
+
+func TestHyperparamsMerge(t *testing.T) {
+	// prepare
+	defaults := Hyperparams{Epochs: 1, LearningRate: 0.015, BatchSize: 64, Optimizer: "sgd"}
+	override := Hyperparams{LearningRate: 0.1, Optimizer: "adam"}
+
+	// run
+	h := defaults.Merge(override)
+
+	// verify
+	expected := Hyperparams{Epochs: 1, LearningRate: 0.1, BatchSize: 64, Optimizer: "adam"}
+	if h != expected {
+		t.Errorf("merged hyperparameters are %+v, expected %+v", h, expected)
+	}
+	if defaults.LearningRate != 0.015 {
+		t.Error("merge modified the defaults")
+	}
+}
+
+func TestParseHyperparams(t *testing.T) {
+	// run
+	h, err := ParseHyperparams("epochs=2, learning_rate=0.01,optimizer=adam")
+
+	// verify
+	if err != nil {
+		t.Fatal("unable to parse hyperparameters", err)
+	}
+	expected := Hyperparams{Epochs: 2, LearningRate: 0.01, Optimizer: "adam"}
+	if h != expected {
+		t.Errorf("parsed hyperparameters are %+v, expected %+v", h, expected)
+	}
+}
+
+func TestParseHyperparamsShouldError(t *testing.T) {
+	for _, in := range []string{"epochs", "epochs=two", "speed=1"} {
+		if _, err := ParseHyperparams(in); err == nil {
+			t.Errorf("%q should not parse", in)
+		}
+	}
+}
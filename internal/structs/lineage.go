@@ -0,0 +1,82 @@
+package structs
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"maps"
+	"slices"
+)
+
+// MaxContributors bounds the size of version vectors.
+const MaxContributors = 64
+
+// Lineage describes which work went into weights. Together, the hashes and
+// parents of all sent weights form the provenance DAG of the swarm.
+type Lineage struct {
+	Hash     []byte        // SHA-256 of the weights data
+	Parents  [][]byte      // Hashes of the weights this version was derived from
+	Versions VersionVector // Training steps of every contributor included
+}
+
+// HashWeights returns the content hash of weights data.
+func HashWeights(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// VersionVector counts the training steps of every peer that are included
+// in a model, directly or through merged updates.
+type VersionVector map[string]int
+
+// Merge returns the element-wise maximum of both vectors.
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+	res := maps.Clone(v)
+	if res == nil {
+		res = make(VersionVector, len(other))
+	}
+	for peer, steps := range other {
+		res[peer] = max(res[peer], steps)
+	}
+	return res.bound()
+}
+
+// Increment returns the vector with one more training step of peer.
+func (v VersionVector) Increment(peer string) VersionVector {
+	res := maps.Clone(v)
+	if res == nil {
+		res = make(VersionVector, 1)
+	}
+	res[peer]++
+	return res.bound()
+}
+
+// bound drops the contributors with the fewest steps beyond MaxContributors.
+func (v VersionVector) bound() VersionVector {
+	if len(v) <= MaxContributors {
+		return v
+	}
+	peers := slices.SortedFunc(maps.Keys(v), func(a, b string) int {
+		return cmp.Or(cmp.Compare(v[b], v[a]), cmp.Compare(a, b))
+	})
+	for _, peer := range peers[MaxContributors:] {
+		delete(v, peer)
+	}
+	return v
+}
+
+func (w *Weights) GetLineage() *Lineage {
+	return w.lineage
+}
+
+func (w *Weights) SetLineage(l *Lineage) {
+	w.lineage = l
+}
+
+// Hash returns the content hash of the weights, taken from the lineage if
+// it is set.
+func (w *Weights) Hash() []byte {
+	if w.lineage != nil && w.lineage.Hash != nil {
+		return w.lineage.Hash
+	}
+	return HashWeights(w.data)
+}
@@ -0,0 +1,47 @@
+package structs
+
+import (
+	"fmt"
+	"maps"
+	"testing"
+)
+
+func TestVersionVectorMerge(t *testing.T) {
+	// prepare
+	a := VersionVector{"a": 3, "b": 1}
+	b := VersionVector{"b": 2, "c": 1}
+
+	// run
+	merged := a.Merge(b).Increment("a")
+
+	// verify
+	expected := VersionVector{"a": 4, "b": 2, "c": 1}
+	if !maps.Equal(merged, expected) {
+		t.Errorf("merged vector is %v, expected %v", merged, expected)
+	}
+	if a["a"] != 3 || a["b"] != 1 {
+		t.Error("merge modified its input")
+	}
+	if v := VersionVector(nil).Increment("x"); v["x"] != 1 {
+		t.Error("incrementing an empty vector failed")
+	}
+}
+
+func TestVersionVectorBound(t *testing.T) {
+	// prepare
+	v := VersionVector{}
+	for i := range MaxContributors {
+		v[fmt.Sprint(i)] = i + 10
+	}
+
+	// run
+	v = v.Merge(VersionVector{"new": 1, "big": 100})
+
+	// verify
+	if len(v) != MaxContributors {
+		t.Errorf("vector has %d contributors", len(v))
+	}
+	if _, ok := v["new"]; ok || v["big"] != 100 || v["0"] != 0 {
+		t.Error("the contributors with the fewest steps should be dropped")
+	}
+}
@@ -0,0 +1,43 @@
+package structs
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policies of the incoming queue for full queues.
+const (
+	QueueBlock           = "block"             // Wait for space up to the timeout, then drop the new update
+	QueueDropOldest      = "drop_oldest"       // Drop the oldest queued update
+	QueueNewestPerSource = "newest_per_source" // Replace a queued update of the same source, else drop the oldest
+	QueueTrust           = "trust"             // Dequeue by trust in the source, drop the least trusted update
+	QueueAge             = "age"               // Dequeue by age gap to the model, drop the stalest update
+)
+
+// DefaultQueueSize is the size of the incoming queue if none is configured.
+const DefaultQueueSize = 10
+
+// QueueConfig configures the queue of received updates waiting for the
+// model.
+type QueueConfig struct {
+	Policy  string        `toml:"policy"`  // Empty selects QueueBlock
+	Size    int           `toml:"size"`    // Any value < 1 selects DefaultQueueSize
+	Timeout time.Duration `toml:"timeout"` // Only used by QueueBlock, any value < 1 means no timeout
+}
+
+// Override returns c with all non-zero values of o.
+func (c QueueConfig) Override(o QueueConfig) QueueConfig {
+	Override(&c.Policy, o.Policy)
+	Override(&c.Size, o.Size)
+	Override(&c.Timeout, o.Timeout)
+	return c
+}
+
+func (c QueueConfig) Validate() error {
+	switch c.Policy {
+	case "", QueueBlock, QueueDropOldest, QueueNewestPerSource, QueueTrust, QueueAge:
+		return nil
+	default:
+		return fmt.Errorf("unknown queue policy %q", c.Policy)
+	}
+}
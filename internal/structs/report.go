@@ -0,0 +1,60 @@
+package structs
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Report is a signed misbehavior report of one peer about another. It is
+// signed with the private key belonging to the fingerprint of the reporter.
+type Report struct {
+	Reporter  string
+	Accused   string
+	Reason    string
+	Timestamp time.Time
+	Signature []byte
+}
+
+func NewReport(reporter, accused, reason string) *Report {
+	return &Report{
+		Reporter:  reporter,
+		Accused:   accused,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	}
+}
+
+func (r *Report) payload() []byte {
+	return fmt.Appendf(nil, "%s\n%s\n%s\n%d", r.Reporter, r.Accused, r.Reason, r.Timestamp.UnixNano())
+}
+
+// Sign signs the report with the given key.
+func (r *Report) Sign(key ed25519.PrivateKey) {
+	r.Signature = ed25519.Sign(key, r.payload())
+}
+
+// Verify checks the signature of the report against the hex encoded public
+// key of the reporter.
+func (r *Report) Verify(fingerprint string) error {
+	pub, err := hex.DecodeString(fingerprint)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("fingerprint is not an ed25519 public key")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), r.payload(), r.Signature) {
+		return errors.New("invalid report signature")
+	}
+	return nil
+}
+
+// NewIdentity generates a new key pair for a peer. The returned fingerprint
+// is the hex encoded public key.
+func NewIdentity() (fingerprint string, key ed25519.PrivateKey, err error) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(pub), key, nil
+}
@@ -0,0 +1,42 @@
+package structs
+
+import (
+	"testing"
+)
+
+func TestReportSignVerify(t *testing.T) {
+	// prepare
+	fp, key, err := NewIdentity()
+	if err != nil {
+		t.Fatal("unable to create identity", err)
+	}
+	r := NewReport("a", "b", "poisoned updates")
+
+	// run
+	r.Sign(key)
+
+	// verify
+	if err := r.Verify(fp); err != nil {
+		t.Error("valid report did not verify", err)
+	}
+}
+
+func TestReportVerifyShouldError(t *testing.T) {
+	// prepare
+	fp, key, _ := NewIdentity()
+	otherFp, _, _ := NewIdentity()
+	r := NewReport("a", "b", "poisoned updates")
+	r.Sign(key)
+
+	// run & verify
+	if r.Verify(otherFp) == nil {
+		t.Error("report verified with the wrong key")
+	}
+	if r.Verify("abbabbaba") == nil {
+		t.Error("report verified with an invalid fingerprint")
+	}
+	r.Accused = "c"
+	if r.Verify(fp) == nil {
+		t.Error("tampered report verified")
+	}
+}
@@ -0,0 +1,71 @@
+package structs
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policies that decide which changes of the model are sent.
+const (
+	SendProbability = "probability" // Send with a fixed probability
+	SendEvery       = "every"       // Send every n-th change
+	SendChange      = "change"      // Send once the weights or the loss changed enough
+	SendRate        = "rate"        // Send at most once per interval
+	SendAdaptive    = "adaptive"    // Send with a probability that shrinks with the peer set
+)
+
+// DefaultSendProbability is the probability of SendProbability if none is
+// configured.
+const DefaultSendProbability = 0.2
+
+// SendConfig selects the send policy and holds the parameters of all
+// policies. Only the parameters of the selected policy are used.
+type SendConfig struct {
+	Policy      string        `toml:"policy"`      // Empty selects SendProbability
+	Probability *float64      `toml:"probability"` // Nil selects DefaultSendProbability, so 0 can be set
+	Every       int           `toml:"every"`
+	MinDelta    float64       `toml:"min_delta"`     // L2 norm of the change since the last sent weights relative to their norm, 0 means off
+	MinLossDrop float32       `toml:"min_loss_drop"` // Decrease of the training loss since the last sent weights, 0 means off
+	Interval    time.Duration `toml:"interval"`      // Minimum time between sent weights
+	Reach       float64       `toml:"reach"`         // Expected number of peers that receive a change
+}
+
+// Override returns c with all non-zero values of o.
+func (c SendConfig) Override(o SendConfig) SendConfig {
+	Override(&c.Policy, o.Policy)
+	Override(&c.Probability, o.Probability)
+	Override(&c.Every, o.Every)
+	Override(&c.MinDelta, o.MinDelta)
+	Override(&c.MinLossDrop, o.MinLossDrop)
+	Override(&c.Interval, o.Interval)
+	Override(&c.Reach, o.Reach)
+	return c
+}
+
+func (c SendConfig) Validate() error {
+	switch c.Policy {
+	case "", SendProbability:
+		if p := c.Probability; p != nil && (*p < 0 || *p > 1) {
+			return fmt.Errorf("send probability %g is not within 0 and 1", *p)
+		}
+	case SendEvery:
+		if c.Every < 1 {
+			return fmt.Errorf("send every must be positive, got %d", c.Every)
+		}
+	case SendChange:
+		if c.MinDelta <= 0 && c.MinLossDrop <= 0 {
+			return fmt.Errorf("send policy %q needs min_delta or min_loss_drop", c.Policy)
+		}
+	case SendRate:
+		if c.Interval <= 0 {
+			return fmt.Errorf("send interval must be positive, got %s", c.Interval)
+		}
+	case SendAdaptive:
+		if c.Reach <= 0 {
+			return fmt.Errorf("send reach must be positive, got %g", c.Reach)
+		}
+	default:
+		return fmt.Errorf("unknown send policy %q", c.Policy)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package structs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LayerGroup configures how the tensors of some layers are shared.
+type LayerGroup struct {
+	// Prefixes of tensor names, e.g. "fcl" matches "fcl.weight" and "fcl.bias"
+	Layers []string `toml:"layers"`
+	Local  bool     `toml:"local"` // The tensors are neither sent nor imported
+	// Factor of the share of incoming values, 0 keeps the share of the merge
+	// policy. The share is capped at 1.
+	Scale float32 `toml:"scale"`
+}
+
+// SharingPolicy decides per tensor whether it is sent and how much of
+// incoming values is mixed in. Tensors of no group are shared as usual, the
+// first matching group applies.
+type SharingPolicy struct {
+	Groups []LayerGroup `toml:"groups"`
+}
+
+// Partial reports whether the policy changes the sharing of any tensor.
+func (p SharingPolicy) Partial() bool {
+	return len(p.Groups) > 0
+}
+
+func (p SharingPolicy) Validate() error {
+	for i, g := range p.Groups {
+		if len(g.Layers) == 0 {
+			return fmt.Errorf("layer group %d has no layers", i)
+		}
+		if g.Scale < 0 {
+			return fmt.Errorf("layer group %d has negative scale %g", i, g.Scale)
+		}
+		for _, l := range g.Layers {
+			if l == "" {
+				return fmt.Errorf("layer group %d has an empty layer", i)
+			}
+		}
+	}
+	return nil
+}
+
+func (p SharingPolicy) group(name string) *LayerGroup {
+	for i, g := range p.Groups {
+		for _, l := range g.Layers {
+			if name == l || strings.HasPrefix(name, l+".") {
+				return &p.Groups[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Shared reports whether the tensor with the given name is sent.
+func (p SharingPolicy) Shared(name string) bool {
+	g := p.group(name)
+	return g == nil || !g.Local
+}
+
+// Filter returns the tensors that are sent.
+func (p SharingPolicy) Filter(tm *TensorMap) (*TensorMap, error) {
+	shared := &TensorMap{Tensors: make([]*Tensor, 0, len(tm.Tensors))}
+	for _, t := range tm.Tensors {
+		if p.Shared(t.Name) {
+			shared.Tensors = append(shared.Tensors, t)
+		}
+	}
+	if len(shared.Tensors) == 0 {
+		return nil, errors.New("no shared tensors")
+	}
+	return shared, nil
+}
+
+// Ratios returns the share of incoming values of every tensor of tm whose
+// share differs from ratio. Local tensors have a share of 0.
+func (p SharingPolicy) Ratios(tm *TensorMap, ratio float32) map[string]float32 {
+	var ratios map[string]float32
+	for _, t := range tm.Tensors {
+		g := p.group(t.Name)
+		if g == nil || (!g.Local && g.Scale == 0) {
+			continue
+		}
+		if ratios == nil {
+			ratios = make(map[string]float32)
+		}
+		if g.Local {
+			ratios[t.Name] = 0
+		} else {
+			ratios[t.Name] = min(ratio*g.Scale, 1)
+		}
+	}
+	return ratios
+}
@@ -0,0 +1,58 @@
+package structs
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestSharingPolicyFilter(t *testing.T) {
+	// prepare
+	p := SharingPolicy{Groups: []LayerGroup{
+		{Layers: []string{"fcl"}, Local: true},
+		{Layers: []string{"cnn2"}, Scale: 0.5},
+	}}
+	tm := &TensorMap{Tensors: []*Tensor{
+		NewFloat32Tensor("cnn1.weight", []int64{1}, []float32{1}),
+		NewFloat32Tensor("cnn2.weight", []int64{1}, []float32{1}),
+		NewFloat32Tensor("fcl.weight", []int64{1}, []float32{1}),
+		NewFloat32Tensor("fcl2.weight", []int64{1}, []float32{1}),
+	}}
+
+	// run
+	shared, err := p.Filter(tm)
+	ratios := p.Ratios(tm, 0.8)
+
+	// verify
+	if err != nil {
+		t.Fatalf("filter failed: %v", err)
+	}
+	names := make([]string, len(shared.Tensors))
+	for i, s := range shared.Tensors {
+		names[i] = s.Name
+	}
+	if len(names) != 3 || names[0] != "cnn1.weight" || names[1] != "cnn2.weight" || names[2] != "fcl2.weight" {
+		t.Errorf("shared tensors are %v, expected all but fcl.weight", names)
+	}
+	expected := map[string]float32{"cnn2.weight": 0.4, "fcl.weight": 0}
+	if !maps.Equal(ratios, expected) {
+		t.Errorf("ratios are %v, expected %v", ratios, expected)
+	}
+	if r := (SharingPolicy{}).Ratios(tm, 0.8); r != nil {
+		t.Errorf("empty policy returned ratios %v", r)
+	}
+}
+
+func TestSharingPolicyValidate(t *testing.T) {
+	for _, p := range []SharingPolicy{
+		{Groups: []LayerGroup{{}}},
+		{Groups: []LayerGroup{{Layers: []string{""}}}},
+		{Groups: []LayerGroup{{Layers: []string{"fcl"}, Scale: -1}}},
+	} {
+		if p.Validate() == nil {
+			t.Errorf("policy %v should be invalid", p)
+		}
+	}
+	if _, err := (SharingPolicy{Groups: []LayerGroup{{Layers: []string{"fcl"}, Local: true}}}).Filter(&TensorMap{Tensors: []*Tensor{{Name: "fcl.bias"}}}); err == nil {
+		t.Error("filtering all tensors should fail")
+	}
+}
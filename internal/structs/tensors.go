@@ -0,0 +1,214 @@
+package structs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxTensorMapSize limits the total size of the tensor data of weights.
+const MaxTensorMapSize = 1 << 30
+
+var dtypeSizes = map[DType]int{
+	DType_FLOAT32:  4,
+	DType_FLOAT64:  8,
+	DType_FLOAT16:  2,
+	DType_BFLOAT16: 2,
+	DType_INT64:    8,
+	DType_INT32:    4,
+	DType_INT16:    2,
+	DType_INT8:     1,
+	DType_UINT8:    1,
+	DType_BOOL:     1,
+}
+
+// DecodeTensorMap unmarshals and validates serialized weights.
+func DecodeTensorMap(data []byte) (*TensorMap, error) {
+	tm := &TensorMap{}
+	if err := proto.Unmarshal(data, tm); err != nil {
+		return nil, fmt.Errorf("failed to decode tensors: %w", err)
+	}
+	if err := tm.Validate(); err != nil {
+		return nil, err
+	}
+	return tm, nil
+}
+
+// Validate checks that every tensor has a unique name, a known dtype and as
+// much data as its shape requires, and that the total size is within
+// MaxTensorMapSize.
+func (tm *TensorMap) Validate() error {
+	if len(tm.Tensors) == 0 {
+		return errors.New("no tensors")
+	}
+	names := make(map[string]bool, len(tm.Tensors))
+	total := 0
+	for _, t := range tm.Tensors {
+		if t.Name == "" {
+			return errors.New("tensor without name")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tensor %q", t.Name)
+		}
+		names[t.Name] = true
+		size, err := t.size()
+		if err != nil {
+			return fmt.Errorf("tensor %q: %w", t.Name, err)
+		}
+		if len(t.Data) != size {
+			return fmt.Errorf("tensor %q has %d bytes, its shape %v needs %d", t.Name, len(t.Data), t.Shape, size)
+		}
+		total += size
+		if total > MaxTensorMapSize {
+			return fmt.Errorf("tensors exceed %d bytes", MaxTensorMapSize)
+		}
+	}
+	return nil
+}
+
+// size returns the number of bytes of the tensor given by dtype and shape.
+func (t *Tensor) size() (int, error) {
+	size, ok := dtypeSizes[t.Dtype]
+	if !ok {
+		return 0, fmt.Errorf("unknown dtype %s", t.Dtype)
+	}
+	for _, d := range t.Shape {
+		if d < 0 {
+			return 0, fmt.Errorf("negative dimension in shape %v", t.Shape)
+		}
+		if d > 0 && size > MaxTensorMapSize/int(min(d, MaxTensorMapSize)) {
+			return 0, fmt.Errorf("shape %v exceeds %d bytes", t.Shape, MaxTensorMapSize)
+		}
+		size *= int(d)
+	}
+	return size, nil
+}
+
+// CheckLayout returns an error unless both tensor maps have the same
+// tensors with the same dtypes and shapes.
+func (tm *TensorMap) CheckLayout(other *TensorMap) error {
+	if len(tm.Tensors) != len(other.Tensors) {
+		return fmt.Errorf("%d tensors instead of %d", len(tm.Tensors), len(other.Tensors))
+	}
+	for i, t := range tm.Tensors {
+		o := other.Tensors[i]
+		if t.Name != o.Name {
+			return fmt.Errorf("tensor %q instead of %q", t.Name, o.Name)
+		}
+		if err := t.checkLayout(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckPartialLayout is like CheckLayout, but tm may lack tensors of other
+// and have them in any order.
+func (tm *TensorMap) CheckPartialLayout(other *TensorMap) error {
+	for _, t := range tm.Tensors {
+		i := slices.IndexFunc(other.Tensors, func(o *Tensor) bool { return o.Name == t.Name })
+		if i < 0 {
+			return fmt.Errorf("unknown tensor %q", t.Name)
+		}
+		if err := t.checkLayout(other.Tensors[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tensor) checkLayout(o *Tensor) error {
+	if t.Dtype != o.Dtype {
+		return fmt.Errorf("tensor %q has dtype %s instead of %s", t.Name, t.Dtype, o.Dtype)
+	}
+	if !slices.Equal(t.Shape, o.Shape) {
+		return fmt.Errorf("tensor %q has shape %v instead of %v", t.Name, t.Shape, o.Shape)
+	}
+	return nil
+}
+
+// Layout returns the tensors without their data.
+func (tm *TensorMap) Layout() *TensorMap {
+	layout := &TensorMap{Tensors: make([]*Tensor, len(tm.Tensors))}
+	for i, t := range tm.Tensors {
+		layout.Tensors[i] = &Tensor{Name: t.Name, Dtype: t.Dtype, Shape: t.Shape}
+	}
+	return layout
+}
+
+// NewFloat32Tensor encodes the values as float32 tensor.
+func NewFloat32Tensor(name string, shape []int64, v []float32) *Tensor {
+	data := make([]byte, 0, len(v)*4)
+	for _, x := range v {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(x))
+	}
+	return &Tensor{Name: name, Dtype: DType_FLOAT32, Shape: shape, Data: data}
+}
+
+// SplitLayers splits serialized tensors into pieces with the tensors of one
+// layer each, e.g. "fcl.weight" and "fcl.bias". The concatenation of the
+// pieces is the original data.
+func SplitLayers(data []byte) ([][]byte, error) {
+	var pieces [][]byte
+	layer, start := "", 0
+	for offset := 0; offset < len(data); {
+		num, typ, n := protowire.ConsumeTag(data[offset:])
+		if n < 0 {
+			return nil, fmt.Errorf("failed to decode tensors: %w", protowire.ParseError(n))
+		}
+		if num != 1 || typ != protowire.BytesType {
+			return nil, fmt.Errorf("unexpected field %d in tensors", num)
+		}
+		value, m := protowire.ConsumeBytes(data[offset+n:])
+		if m < 0 {
+			return nil, fmt.Errorf("failed to decode tensors: %w", protowire.ParseError(m))
+		}
+		name, err := tensorName(value)
+		if err != nil {
+			return nil, err
+		}
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name = name[:i]
+		}
+		if offset > start && name != layer {
+			pieces = append(pieces, data[start:offset])
+			start = offset
+		}
+		layer = name
+		offset += n + m
+	}
+	if start == len(data) {
+		return nil, errors.New("no tensors")
+	}
+	return append(pieces, data[start:]), nil
+}
+
+// tensorName returns the name of a serialized tensor without decoding its
+// data.
+func tensorName(data []byte) (string, error) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", fmt.Errorf("failed to decode tensor: %w", protowire.ParseError(n))
+		}
+		if num == 1 && typ == protowire.BytesType {
+			name, m := protowire.ConsumeString(data[n:])
+			if m < 0 {
+				return "", fmt.Errorf("failed to decode tensor: %w", protowire.ParseError(m))
+			}
+			return name, nil
+		}
+		m := protowire.ConsumeFieldValue(num, typ, data[n:])
+		if m < 0 {
+			return "", fmt.Errorf("failed to decode tensor: %w", protowire.ParseError(m))
+		}
+		data = data[n+m:]
+	}
+	return "", errors.New("tensor without name")
+}
@@ -0,0 +1,109 @@
+package structs
+
+import (
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTensorWeightsRoundtrip(t *testing.T) {
+	// prepare
+	tm := &TensorMap{Tensors: []*Tensor{
+		NewFloat32Tensor("weight", []int64{2, 2}, []float32{1, 2, 3, 4}),
+		NewFloat32Tensor("bias", []int64{2}, []float32{-1, 1}),
+	}}
+
+	// run
+	w, err := NewTensorWeights(tm, 3)
+	if err != nil {
+		t.Fatal("unable to encode tensors", err)
+	}
+	decoded, err := w.Tensors()
+
+	// verify
+	if err != nil {
+		t.Fatal("unable to decode tensors", err)
+	}
+	if err = decoded.CheckLayout(tm); err != nil {
+		t.Error("layout changed", err)
+	}
+	if !slices.Equal(decoded.Tensors[0].Data, tm.Tensors[0].Data) {
+		t.Error("data changed")
+	}
+}
+
+func TestDecodeTensorMapShouldError(t *testing.T) {
+	valid := NewFloat32Tensor("weight", []int64{2}, []float32{1, 2})
+	for name, tm := range map[string]*TensorMap{
+		"empty":          {},
+		"no name":        {Tensors: []*Tensor{{Dtype: DType_UINT8, Shape: []int64{1}, Data: []byte{1}}}},
+		"duplicate":      {Tensors: []*Tensor{valid, valid}},
+		"unknown dtype":  {Tensors: []*Tensor{{Name: "x", Dtype: 99, Shape: []int64{1}, Data: []byte{1}}}},
+		"unset dtype":    {Tensors: []*Tensor{{Name: "x", Shape: []int64{1}, Data: []byte{1}}}},
+		"short data":     {Tensors: []*Tensor{{Name: "x", Dtype: DType_FLOAT32, Shape: []int64{2}, Data: make([]byte, 4)}}},
+		"negative shape": {Tensors: []*Tensor{{Name: "x", Dtype: DType_UINT8, Shape: []int64{-1, -1}, Data: []byte{1}}}},
+		"overflow":       {Tensors: []*Tensor{{Name: "x", Dtype: DType_INT64, Shape: []int64{1 << 40, 1 << 40}}}},
+	} {
+		data, _ := proto.Marshal(tm)
+		if _, err := DecodeTensorMap(data); err == nil {
+			t.Errorf("%s tensor map should be rejected", name)
+		}
+	}
+	if _, err := DecodeTensorMap([]byte("\x80\x02pickle")); err == nil {
+		t.Error("a pickle should be rejected")
+	}
+}
+
+func TestCheckLayoutShouldError(t *testing.T) {
+	// prepare
+	tm := &TensorMap{Tensors: []*Tensor{NewFloat32Tensor("weight", []int64{2}, []float32{1, 2})}}
+
+	// run
+	for name, other := range map[string]*TensorMap{
+		"name":  {Tensors: []*Tensor{NewFloat32Tensor("bias", []int64{2}, []float32{1, 2})}},
+		"shape": {Tensors: []*Tensor{NewFloat32Tensor("weight", []int64{1, 2}, []float32{1, 2})}},
+		"dtype": {Tensors: []*Tensor{{Name: "weight", Dtype: DType_INT32, Shape: []int64{2}, Data: make([]byte, 8)}}},
+		"count": {},
+	} {
+		// verify
+		if err := tm.CheckLayout(other); err == nil {
+			t.Errorf("layout with another %s should not match", name)
+		}
+	}
+}
+
+func TestSplitLayers(t *testing.T) {
+	// prepare
+	tm := &TensorMap{Tensors: []*Tensor{
+		NewFloat32Tensor("cnn1.weight", []int64{2}, []float32{1, 2}),
+		NewFloat32Tensor("cnn1.bias", []int64{1}, []float32{3}),
+		NewFloat32Tensor("fcl.weight", []int64{1}, []float32{4}),
+		NewFloat32Tensor("scale", []int64{1}, []float32{5}),
+	}}
+	data, err := proto.Marshal(tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run
+	pieces, err := SplitLayers(data)
+
+	// verify
+	if err != nil {
+		t.Fatalf("splitting failed: %v", err)
+	}
+	if len(pieces) != 3 {
+		t.Fatalf("got %d pieces, expected one per layer", len(pieces))
+	}
+	if !slices.Equal(slices.Concat(pieces...), data) {
+		t.Error("pieces do not add up to the data")
+	}
+	first, err := DecodeTensorMap(pieces[0])
+	if err != nil || len(first.Tensors) != 2 || first.Tensors[1].Name != "cnn1.bias" {
+		t.Errorf("first piece should hold the cnn1 tensors, got %v, %v", first, err)
+	}
+	if _, err = SplitLayers(nil); err == nil {
+		t.Error("splitting no tensors should fail")
+	}
+}
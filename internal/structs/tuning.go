@@ -0,0 +1,79 @@
+package structs
+
+import (
+	"fmt"
+	"time"
+)
+
+// Tuning holds the internal parameters of a peer. Zero values keep the value
+// of the layer below, see Override.
+type Tuning struct {
+	StorageLastN     int           `toml:"storage_last_n"`    // Latest sent updates kept for lagging peers
+	StorageStepCap   int           `toml:"storage_step_cap"`  // Maximum age gap between older kept updates
+	LaggingInterval  time.Duration `toml:"lagging_interval"`  // Interval of sending stored updates to lagging peers
+	RechokeInterval  time.Duration `toml:"rechoke_interval"`  // Interval of selecting the unchoked peers
+	KeepAlive        time.Duration `toml:"keep_alive"`        // QUIC keep alive period
+	IdleTimeout      time.Duration `toml:"idle_timeout"`      // QUIC idle timeout
+	OutgoingCapacity int           `toml:"outgoing_capacity"` // Updates waiting to be sent
+}
+
+// DefaultTuning returns the tuning used if nothing else is configured.
+func DefaultTuning() Tuning {
+	return Tuning{
+		StorageLastN:     10,
+		StorageStepCap:   40,
+		LaggingInterval:  time.Second * 5,
+		RechokeInterval:  time.Second * 30,
+		KeepAlive:        time.Second * 15,
+		IdleTimeout:      time.Second * 60,
+		OutgoingCapacity: 5,
+	}
+}
+
+// Override returns t with all non-zero values of o.
+func (t Tuning) Override(o Tuning) Tuning {
+	Override(&t.StorageLastN, o.StorageLastN)
+	Override(&t.StorageStepCap, o.StorageStepCap)
+	Override(&t.LaggingInterval, o.LaggingInterval)
+	Override(&t.RechokeInterval, o.RechokeInterval)
+	Override(&t.KeepAlive, o.KeepAlive)
+	Override(&t.IdleTimeout, o.IdleTimeout)
+	Override(&t.OutgoingCapacity, o.OutgoingCapacity)
+	return t
+}
+
+// Override sets *v to o unless o is the zero value, so config layers only
+// replace the values they set.
+func Override[T comparable](v *T, o T) {
+	var zero T
+	if o != zero {
+		*v = o
+	}
+}
+
+// Validate checks a complete tuning, i.e. one with the defaults applied.
+func (t Tuning) Validate() error {
+	for name, n := range map[string]int{
+		"storage_last_n":    t.StorageLastN,
+		"storage_step_cap":  t.StorageStepCap,
+		"outgoing_capacity": t.OutgoingCapacity,
+	} {
+		if n < 1 {
+			return fmt.Errorf("%s must be positive, got %d", name, n)
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"lagging_interval": t.LaggingInterval,
+		"rechoke_interval": t.RechokeInterval,
+		"keep_alive":       t.KeepAlive,
+		"idle_timeout":     t.IdleTimeout,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", name, d)
+		}
+	}
+	if t.KeepAlive >= t.IdleTimeout {
+		return fmt.Errorf("keep_alive %s must be shorter than idle_timeout %s", t.KeepAlive, t.IdleTimeout)
+	}
+	return nil
+}
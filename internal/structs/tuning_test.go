@@ -0,0 +1,34 @@
+package structs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTuningOverride(t *testing.T) {
+	// prepare
+	base := DefaultTuning()
+
+	// run
+	tuning := base.Override(Tuning{RechokeInterval: time.Minute, OutgoingCapacity: 8})
+
+	// verify
+	if tuning.RechokeInterval != time.Minute || tuning.OutgoingCapacity != 8 {
+		t.Errorf("non-zero values were not overridden: %+v", tuning)
+	}
+	if tuning.StorageLastN != base.StorageLastN || tuning.KeepAlive != base.KeepAlive {
+		t.Errorf("zero values should keep the base: %+v", tuning)
+	}
+}
+
+func TestTuningValidate(t *testing.T) {
+	if err := DefaultTuning().Validate(); err != nil {
+		t.Errorf("defaults should be valid: %v", err)
+	}
+	if err := DefaultTuning().Override(Tuning{StorageLastN: -1}).Validate(); err == nil {
+		t.Error("negative storage size should be invalid")
+	}
+	if err := DefaultTuning().Override(Tuning{KeepAlive: time.Hour}).Validate(); err == nil {
+		t.Error("keep alive beyond the idle timeout should be invalid")
+	}
+}
@@ -0,0 +1,344 @@
+package structs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Layer is a tensor of a TensorView. Floating point tensors are decoded to
+// float32 values, other tensors like counters are kept as raw data and
+// ignored by arithmetic.
+type Layer struct {
+	Name   string
+	Shape  []int64
+	Values []float32 // nil unless IsFloat
+	dtype  DType     // dtype of the serialized tensor
+	raw    []byte    // Data of tensors that are not floating point
+}
+
+// IsFloat returns whether the layer holds floating point values.
+func (l *Layer) IsFloat() bool {
+	return l.raw == nil
+}
+
+func (l *Layer) DType() DType {
+	return l.dtype
+}
+
+// L2Norm returns the euclidean norm of the values.
+func (l *Layer) L2Norm() float64 {
+	return math.Sqrt(dot(l.Values, l.Values))
+}
+
+// Cosine returns the cosine similarity of the values of both layers, 0 if one
+// of them is zero.
+func (l *Layer) Cosine(other *Layer) (float64, error) {
+	if err := l.check(other); err != nil {
+		return 0, err
+	}
+	return cosine(dot(l.Values, other.Values), dot(l.Values, l.Values), dot(other.Values, other.Values)), nil
+}
+
+func (l *Layer) check(other *Layer) error {
+	if l.Name != other.Name {
+		return fmt.Errorf("layer %q instead of %q", other.Name, l.Name)
+	}
+	if !slices.Equal(l.Shape, other.Shape) || l.IsFloat() != other.IsFloat() {
+		return fmt.Errorf("layer %q has shape %v instead of %v", l.Name, other.Shape, l.Shape)
+	}
+	return nil
+}
+
+func (l *Layer) clone() *Layer {
+	c := *l
+	c.Values = slices.Clone(l.Values)
+	return &c
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+func cosine(ab, aa, bb float64) float64 {
+	if aa == 0 || bb == 0 {
+		return 0
+	}
+	return ab / math.Sqrt(aa*bb)
+}
+
+// TensorView is the parsed form of weights, which allows computing with them
+// in Go. Operations return new views and keep their inputs unchanged.
+type TensorView struct {
+	layers []*Layer
+}
+
+// NewTensorView decodes the tensors. Float32, float16, bfloat16 and float64
+// tensors are decoded to float32.
+func NewTensorView(tm *TensorMap) (*TensorView, error) {
+	if err := tm.Validate(); err != nil {
+		return nil, err
+	}
+	v := &TensorView{layers: make([]*Layer, len(tm.Tensors))}
+	for i, t := range tm.Tensors {
+		l := &Layer{Name: t.Name, Shape: slices.Clone(t.Shape), dtype: t.Dtype}
+		switch t.Dtype {
+		case DType_FLOAT32:
+			l.Values = decodeValues(t.Data, 4, func(b []byte) float32 {
+				return math.Float32frombits(binary.LittleEndian.Uint32(b))
+			})
+		case DType_FLOAT16:
+			l.Values = decodeValues(t.Data, 2, func(b []byte) float32 {
+				return float16ToFloat32(binary.LittleEndian.Uint16(b))
+			})
+		case DType_BFLOAT16:
+			l.Values = decodeValues(t.Data, 2, func(b []byte) float32 {
+				return math.Float32frombits(uint32(binary.LittleEndian.Uint16(b)) << 16)
+			})
+		case DType_FLOAT64:
+			l.Values = decodeValues(t.Data, 8, func(b []byte) float32 {
+				return float32(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+			})
+		default:
+			l.raw = t.Data
+			if l.raw == nil {
+				l.raw = []byte{}
+			}
+		}
+		v.layers[i] = l
+	}
+	return v, nil
+}
+
+func decodeValues(data []byte, size int, decode func([]byte) float32) []float32 {
+	values := make([]float32, len(data)/size)
+	for i := range values {
+		values[i] = decode(data[i*size:])
+	}
+	return values
+}
+
+// TensorMap encodes the view with the dtypes of the decoded tensors.
+func (v *TensorView) TensorMap() *TensorMap {
+	tm := &TensorMap{Tensors: make([]*Tensor, len(v.layers))}
+	for i, l := range v.layers {
+		t := &Tensor{Name: l.Name, Dtype: l.dtype, Shape: l.Shape, Data: l.raw}
+		switch l.dtype {
+		case DType_FLOAT32:
+			t.Data = encodeValues(l.Values, 4, func(b []byte, x float32) {
+				binary.LittleEndian.PutUint32(b, math.Float32bits(x))
+			})
+		case DType_FLOAT16:
+			t.Data = encodeValues(l.Values, 2, func(b []byte, x float32) {
+				binary.LittleEndian.PutUint16(b, float32ToFloat16(x))
+			})
+		case DType_BFLOAT16:
+			t.Data = encodeValues(l.Values, 2, func(b []byte, x float32) {
+				binary.LittleEndian.PutUint16(b, float32ToBfloat16(x))
+			})
+		case DType_FLOAT64:
+			t.Data = encodeValues(l.Values, 8, func(b []byte, x float32) {
+				binary.LittleEndian.PutUint64(b, math.Float64bits(float64(x)))
+			})
+		}
+		tm.Tensors[i] = t
+	}
+	return tm
+}
+
+func encodeValues(values []float32, size int, encode func([]byte, float32)) []byte {
+	data := make([]byte, len(values)*size)
+	for i, x := range values {
+		encode(data[i*size:], x)
+	}
+	return data
+}
+
+// Layers returns the layers in the order of the serialized tensors.
+func (v *TensorView) Layers() []*Layer {
+	return v.layers
+}
+
+// Layer returns the layer with the given name or nil.
+func (v *TensorView) Layer(name string) *Layer {
+	for _, l := range v.layers {
+		if l.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// Len returns the number of floating point values.
+func (v *TensorView) Len() int {
+	n := 0
+	for _, l := range v.layers {
+		n += len(l.Values)
+	}
+	return n
+}
+
+// Add returns the element-wise sum of both views.
+func (v *TensorView) Add(other *TensorView) (*TensorView, error) {
+	return v.combine(other, func(a, b float32) float32 { return a + b })
+}
+
+// Sub returns the element-wise difference of both views, e.g. the delta of
+// an update to the weights it is based on.
+func (v *TensorView) Sub(other *TensorView) (*TensorView, error) {
+	return v.combine(other, func(a, b float32) float32 { return a - b })
+}
+
+// Scale returns the view with all values multiplied by f.
+func (v *TensorView) Scale(f float32) *TensorView {
+	res := &TensorView{layers: make([]*Layer, len(v.layers))}
+	for i, l := range v.layers {
+		res.layers[i] = l.clone()
+		for j := range res.layers[i].Values {
+			res.layers[i].Values[j] *= f
+		}
+	}
+	return res
+}
+
+// combine applies op to the values of both views. Layers that are not
+// floating point are taken from v.
+func (v *TensorView) combine(other *TensorView, op func(a, b float32) float32) (*TensorView, error) {
+	if err := v.check(other); err != nil {
+		return nil, err
+	}
+	res := &TensorView{layers: make([]*Layer, len(v.layers))}
+	for i, l := range v.layers {
+		res.layers[i] = l.clone()
+		for j, x := range other.layers[i].Values {
+			res.layers[i].Values[j] = op(res.layers[i].Values[j], x)
+		}
+	}
+	return res, nil
+}
+
+func (v *TensorView) check(other *TensorView) error {
+	if len(v.layers) != len(other.layers) {
+		return fmt.Errorf("%d layers instead of %d", len(other.layers), len(v.layers))
+	}
+	for i, l := range v.layers {
+		if err := l.check(other.layers[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// L2Norm returns the euclidean norm over all floating point values.
+func (v *TensorView) L2Norm() float64 {
+	var sum float64
+	for _, l := range v.layers {
+		sum += dot(l.Values, l.Values)
+	}
+	return math.Sqrt(sum)
+}
+
+// Cosine returns the cosine similarity over all floating point values of
+// both views, 0 if one of them is zero.
+func (v *TensorView) Cosine(other *TensorView) (float64, error) {
+	if err := v.check(other); err != nil {
+		return 0, err
+	}
+	var ab, aa, bb float64
+	for i, l := range v.layers {
+		ab += dot(l.Values, other.layers[i].Values)
+		aa += dot(l.Values, l.Values)
+		bb += dot(other.layers[i].Values, other.layers[i].Values)
+	}
+	return cosine(ab, aa, bb), nil
+}
+
+// View decodes the tensors of weights that are not flat.
+func (w *Weights) View() (*TensorView, error) {
+	if w.flat {
+		return nil, errors.New("weights are a flat vector")
+	}
+	tm, err := DecodeTensorMap(w.data)
+	if err != nil {
+		return nil, err
+	}
+	return NewTensorView(tm)
+}
+
+// NewViewWeights encodes the view as weights.
+func NewViewWeights(v *TensorView, age int) (*Weights, error) {
+	return NewTensorWeights(v.TensorMap(), age)
+}
+
+// float16ToFloat32 converts IEEE 754 half precision to single precision.
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h) & 0x3ff
+	switch exp {
+	case 0:
+		// Zero or subnormal
+		f := float32(math.Ldexp(float64(mant), -24))
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
+
+// float32ToFloat16 converts to half precision, rounding to nearest even.
+func float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23) & 0xff
+	mant := bits & 0x7fffff
+	if exp == 0xff {
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	}
+	e := exp - 127 + 15
+	if e >= 0x1f {
+		return sign | 0x7c00
+	}
+	if e <= 0 {
+		if e < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - e)
+		return sign | uint16(roundShift(mant, shift))
+	}
+	// A carry into the exponent is correct, up to infinity
+	return sign | uint16(roundShift(uint32(e)<<23|mant, 13))
+}
+
+// float32ToBfloat16 truncates to bfloat16, rounding to nearest even.
+func float32ToBfloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	if bits&0x7fffffff > 0x7f800000 {
+		return uint16(bits>>16) | 0x40
+	}
+	return uint16(roundShift(bits, 16))
+}
+
+// roundShift shifts x right, rounding to nearest even.
+func roundShift(x uint32, shift uint) uint32 {
+	res := x >> shift
+	rem := x & (1<<shift - 1)
+	half := uint32(1) << (shift - 1)
+	if rem > half || (rem == half && res&1 == 1) {
+		res++
+	}
+	return res
+}
@@ -0,0 +1,143 @@
+package structs
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func newTestView(t *testing.T, weight, bias []float32) *TensorView {
+	t.Helper()
+	v, err := NewTensorView(&TensorMap{Tensors: []*Tensor{
+		NewFloat32Tensor("weight", []int64{2, 2}, weight),
+		NewFloat32Tensor("bias", []int64{2}, bias),
+		{Name: "steps", Dtype: DType_INT64, Shape: []int64{}, Data: make([]byte, 8)},
+	}})
+	if err != nil {
+		t.Fatal("unable to create view", err)
+	}
+	return v
+}
+
+func TestTensorViewArithmetic(t *testing.T) {
+	// prepare
+	a := newTestView(t, []float32{1, 2, 3, 4}, []float32{0, 1})
+	b := newTestView(t, []float32{1, 1, 1, 1}, []float32{2, 2})
+
+	// run
+	sum, err := a.Add(b)
+	if err != nil {
+		t.Fatal("unable to add views", err)
+	}
+	delta, err := a.Sub(b)
+	if err != nil {
+		t.Fatal("unable to subtract views", err)
+	}
+	scaled := a.Scale(0.5)
+
+	// verify
+	if v := sum.Layer("weight").Values; !slices.Equal(v, []float32{2, 3, 4, 5}) {
+		t.Errorf("sum is %v", v)
+	}
+	if v := delta.Layer("bias").Values; !slices.Equal(v, []float32{-2, -1}) {
+		t.Errorf("delta is %v", v)
+	}
+	if v := scaled.Layer("weight").Values; !slices.Equal(v, []float32{0.5, 1, 1.5, 2}) {
+		t.Errorf("scaled view is %v", v)
+	}
+	if v := a.Layer("weight").Values; !slices.Equal(v, []float32{1, 2, 3, 4}) {
+		t.Error("operations modified their input")
+	}
+	if sum.Layer("steps").IsFloat() || sum.Len() != 6 {
+		t.Error("integer tensors should not be part of the values")
+	}
+}
+
+func TestTensorViewNormAndCosine(t *testing.T) {
+	// prepare
+	a := newTestView(t, []float32{3, 0, 0, 0}, []float32{0, 4})
+	b := a.Scale(-2)
+	c := newTestView(t, []float32{0, 1, 0, 0}, []float32{0, 0})
+
+	// run
+	opposite, err := a.Cosine(b)
+	if err != nil {
+		t.Fatal("unable to compare views", err)
+	}
+	orthogonal, _ := a.Cosine(c)
+	layer, _ := a.Layer("weight").Cosine(b.Layer("weight"))
+
+	// verify
+	if a.L2Norm() != 5 || a.Layer("bias").L2Norm() != 4 {
+		t.Errorf("norm is %f, bias norm is %f", a.L2Norm(), a.Layer("bias").L2Norm())
+	}
+	if math.Abs(opposite+1) > 1e-9 || orthogonal != 0 || math.Abs(layer+1) > 1e-9 {
+		t.Errorf("cosine similarities are %f, %f and %f", opposite, orthogonal, layer)
+	}
+}
+
+func TestTensorViewMismatch(t *testing.T) {
+	a := newTestView(t, []float32{1, 2, 3, 4}, []float32{0, 1})
+	other, _ := NewTensorView(&TensorMap{Tensors: []*Tensor{NewFloat32Tensor("weight", []int64{4}, []float32{1, 2, 3, 4})}})
+	if _, err := a.Add(other); err == nil {
+		t.Error("views with other layers should not be added")
+	}
+	if _, err := a.Cosine(other); err == nil {
+		t.Error("views with other layers should not be compared")
+	}
+}
+
+func TestTensorViewHalfPrecision(t *testing.T) {
+	// prepare
+	values := []float32{0, -0.5, 1, 65504, 1e-7, 0.1, float32(math.Inf(-1))}
+	half := &Tensor{Name: "half", Dtype: DType_FLOAT16, Shape: []int64{int64(len(values))}}
+	brain := &Tensor{Name: "brain", Dtype: DType_BFLOAT16, Shape: []int64{int64(len(values))}}
+	for _, x := range values {
+		half.Data = append(half.Data, byte(float32ToFloat16(x)), byte(float32ToFloat16(x)>>8))
+		brain.Data = append(brain.Data, byte(float32ToBfloat16(x)), byte(float32ToBfloat16(x)>>8))
+	}
+
+	// run
+	v, err := NewTensorView(&TensorMap{Tensors: []*Tensor{half, brain}})
+	if err != nil {
+		t.Fatal("unable to create view", err)
+	}
+	encoded := v.TensorMap()
+
+	// verify
+	for i, x := range values {
+		for _, l := range v.Layers() {
+			if d := math.Abs(float64(l.Values[i] - x)); d > math.Abs(float64(x))/100+1e-7 && !math.IsInf(float64(x), 0) {
+				t.Errorf("%s value %f was decoded as %f", l.Name, x, l.Values[i])
+			}
+		}
+	}
+	if !slices.Equal(encoded.Tensors[0].Data, half.Data) || !slices.Equal(encoded.Tensors[1].Data, brain.Data) {
+		t.Error("encoding the decoded values should restore the data")
+	}
+	if float32ToFloat16(1e6) != 0x7c00 || float32ToFloat16(1+1.0/2048) != 0x3c00 {
+		t.Error("half precision should overflow to infinity and round to even")
+	}
+}
+
+func TestWeightsView(t *testing.T) {
+	// prepare
+	w, err := NewViewWeights(newTestView(t, []float32{1, 2, 3, 4}, []float32{0, 1}), 2)
+	if err != nil {
+		t.Fatal("unable to encode view", err)
+	}
+
+	// run
+	v, err := w.View()
+
+	// verify
+	if err != nil {
+		t.Fatal("unable to decode view", err)
+	}
+	if w.GetAge() != 2 || !slices.Equal(v.Layer("bias").Values, []float32{0, 1}) || len(v.Layer("steps").raw) != 8 {
+		t.Error("weights should keep all tensors")
+	}
+	if _, err = NewFlatWeights([]float32{1}, 1).View(); err == nil {
+		t.Error("flat weights should have no view")
+	}
+}
@@ -1,8 +1,23 @@
 package structs
 
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/vs-ude/btml/internal/secagg"
+	"google.golang.org/protobuf/proto"
+)
+
 type Weights struct {
-	data []byte
-	age  int
+	data    []byte
+	age     int
+	source  string  // Peer that sent the weights, empty for local weights
+	samples int     // Size of the training set of the source, 0 if unknown
+	trust   float32 // Trust in the source between 0 and 1, only set for received weights
+	flat    bool    // data is a little endian float32 vector instead of the backend format
+	masked  *secagg.Update
+	lineage *Lineage // Only set for sent and received weights
 }
 
 func (w *Weights) Get() []byte {
@@ -17,6 +32,87 @@ func (w *Weights) GetAge() int {
 	return w.age
 }
 
+func (w *Weights) SetSource(source string) {
+	w.source = source
+}
+
+func (w *Weights) GetSource() string {
+	return w.source
+}
+
+func (w *Weights) SetSamples(samples int) {
+	w.samples = samples
+}
+
+func (w *Weights) GetSamples() int {
+	return w.samples
+}
+
+func (w *Weights) SetTrust(trust float32) {
+	w.trust = trust
+}
+
+func (w *Weights) GetTrust() float32 {
+	return w.trust
+}
+
+func (w *Weights) IsFlat() bool {
+	return w.flat
+}
+
+// GetMasked returns the masked update for secure aggregation, if the weights
+// are masked.
+func (w *Weights) GetMasked() *secagg.Update {
+	return w.masked
+}
+
+func (w *Weights) SetMasked(u *secagg.Update) {
+	w.masked = u
+}
+
+// Floats decodes flat weights.
+func (w *Weights) Floats() ([]float32, error) {
+	if !w.flat || len(w.data)%4 != 0 {
+		return nil, fmt.Errorf("weights are not a flat vector")
+	}
+	v := make([]float32, len(w.data)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(w.data[i*4:]))
+	}
+	return v, nil
+}
+
+// Tensors decodes and validates the tensors of weights that are not flat.
+func (w *Weights) Tensors() (*TensorMap, error) {
+	if w.flat {
+		return nil, fmt.Errorf("weights are a flat vector")
+	}
+	return DecodeTensorMap(w.data)
+}
+
+// NewTensorWeights encodes the tensors as weights.
+func NewTensorWeights(tm *TensorMap, age int) (*Weights, error) {
+	data, err := proto.Marshal(tm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode tensors: %w", err)
+	}
+	return &Weights{data: data, age: age}, nil
+}
+
+// NewFlatWeights encodes the vector as flat weights.
+func NewFlatWeights(v []float32, age int) *Weights {
+	data := make([]byte, 0, len(v)*4)
+	for _, x := range v {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(x))
+	}
+	return &Weights{data: data, age: age, flat: true}
+}
+
+// NewRawFlatWeights marks already encoded data as flat weights.
+func NewRawFlatWeights(data []byte, age int) *Weights {
+	return &Weights{data: data, age: age, flat: true}
+}
+
 func NewWeights(data []byte, age int) *Weights {
 	return &Weights{data: data, age: age}
 }
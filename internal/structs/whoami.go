@@ -3,15 +3,32 @@ package structs
 import (
 	"time"
 
+	"github.com/vs-ude/btml/internal/privacy"
+	"github.com/vs-ude/btml/internal/secagg"
 	"github.com/vs-ude/btml/internal/telemetry"
 )
 
 type WhoAmI struct {
 	Id                  int
 	Dataset             string
+	DatasetFormat       string
+	Architecture        string
+	MergePolicy         string
 	UpdateFreq          time.Duration
 	PeerSetSize         int
 	PeerSetArchiveAfter time.Duration
+	FreeRiderRatio      float64
+	FreeRiderRounds     int
+	FreeRiderMinTaken   int
+	ReportAfter         int
+	Training            Hyperparams
+	Privacy             privacy.Config
+	SecureAggregation   secagg.Config
+	Sharing             SharingPolicy
+	Pieces              bool
+	Incoming            QueueConfig
+	Send                SendConfig
+	Tuning              Tuning
 	ExtIp               string
 	Telemetry           telemetry.TelemetryConf
 }
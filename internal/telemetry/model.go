@@ -2,6 +2,9 @@ package telemetry
 
 import (
 	"fmt"
+	"maps"
+	"strconv"
+	"strings"
 	"time"
 
 	influxdb3 "github.com/InfluxCommunity/influxdb3-go/v2/influxdb3"
@@ -25,21 +28,57 @@ func (c *Client) RecordTraining(loss float32, age int) {
 	}
 }
 
-func (c *Client) RecordEvaluation(accuracy, loss float32, guesses map[int32]float32, age int) {
-	point := influxdb3.NewPoint(
+// ClassEvaluation holds the evaluation results of a single class.
+type ClassEvaluation struct {
+	Precision float32
+	Recall    float32
+	F1        float32
+	Support   int   // Samples labeled as this class
+	Predicted int   // Samples predicted as this class
+	Confusion []int // Predictions per class for the samples labeled as this class
+}
+
+// RecordEvaluation writes the overall results to the model_evaluation
+// measurement and the results of each class to model_evaluation_class,
+// tagged with the class.
+func (c *Client) RecordEvaluation(accuracy, loss, macroF1, calibrationError float32, classes []ClassEvaluation, age int) {
+	now := time.Now()
+	points := []*influxdb3.Point{influxdb3.NewPoint(
 		fmt.Sprintf("model_evaluation_%s", c.run),
 		c.tags,
 		map[string]any{
-			"accuracy": accuracy,
-			"loss":     loss,
-			"guesses":  guesses,
-			"age":      age,
+			"accuracy":          accuracy,
+			"loss":              loss,
+			"macro_f1":          macroF1,
+			"calibration_error": calibrationError,
+			"age":               age,
 		},
-		time.Now(),
-	)
+		now,
+	)}
+	for k, class := range classes {
+		tags := maps.Clone(c.tags)
+		tags["class"] = strconv.Itoa(k)
+		fields := map[string]any{
+			"precision": class.Precision,
+			"recall":    class.Recall,
+			"f1":        class.F1,
+			"support":   class.Support,
+			"predicted": class.Predicted,
+			"age":       age,
+		}
+		for j, v := range class.Confusion {
+			fields[fmt.Sprintf("predicted_as_%d", j)] = v
+		}
+		points = append(points, influxdb3.NewPoint(
+			fmt.Sprintf("model_evaluation_class_%s", c.run),
+			tags,
+			fields,
+			now,
+		))
+	}
 
 	log("model_evaluation")
-	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	err := c.client.WritePoints(c.ctx, points)
 	if err != nil {
 		log_w(err)
 	}
@@ -63,3 +102,157 @@ func (c *Client) RecordWeightApplication(localAge, remoteAge int, change float32
 		log_w(err)
 	}
 }
+
+func (c *Client) RecordModelRestart(reason string, attempt, age int) {
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("model_restart_%s", c.run),
+		c.tags,
+		map[string]any{
+			"reason":  reason,
+			"attempt": attempt,
+			"age":     age,
+		},
+		time.Now(),
+	)
+
+	log("model_restart")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
+
+// RecordApplyBuffer records a batch of buffered updates with the number of
+// ages each update was behind the model.
+func (c *Client) RecordApplyBuffer(depth int, staleness []int, success bool) {
+	var sum, maxStaleness int
+	for _, s := range staleness {
+		sum += s
+		maxStaleness = max(maxStaleness, s)
+	}
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("apply_buffer_%s", c.run),
+		c.tags,
+		map[string]any{
+			"depth":          depth,
+			"mean_staleness": float64(sum) / float64(max(len(staleness), 1)),
+			"max_staleness":  maxStaleness,
+			"success":        success,
+		},
+		time.Now(),
+	)
+
+	log("apply_buffer")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
+
+// RecordQueueWait records how long a model operation waited in the queue of
+// the scheduler, tagged with the operation, and how many operations were
+// still queued when it started.
+func (c *Client) RecordQueueWait(operation string, wait time.Duration, queued int) {
+	tags := maps.Clone(c.tags)
+	tags["operation"] = operation
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("model_queue_%s", c.run),
+		tags,
+		map[string]any{
+			"wait_ms": float64(wait.Microseconds()) / 1000,
+			"queued":  queued,
+		},
+		time.Now(),
+	)
+
+	log("model_queue")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
+
+// RecordPrivacy records a release of private weights with the epsilon spent
+// so far and the norm of the update before clipping.
+func (c *Client) RecordPrivacy(epsilon, delta float64, norm float32, clipped bool, releases, age int) {
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("privacy_%s", c.run),
+		c.tags,
+		map[string]any{
+			"epsilon":  epsilon,
+			"delta":    delta,
+			"norm":     norm,
+			"clipped":  clipped,
+			"releases": releases,
+			"age":      age,
+		},
+		time.Now(),
+	)
+
+	log("privacy")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
+
+// RecordSecureAggregation records a secure aggregation round with the number
+// of masks that had to be removed because they did not cancel.
+func (c *Client) RecordSecureAggregation(round int64, updates, residuals int, success bool) {
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("secure_aggregation_%s", c.run),
+		c.tags,
+		map[string]any{
+			"round":     round,
+			"updates":   updates,
+			"residuals": residuals,
+			"success":   success,
+		},
+		time.Now(),
+	)
+
+	log("secure_aggregation")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
+
+// RecordLineage writes a node of the provenance DAG to the model_lineage
+// measurement, with the hex encoded hash and the comma separated hashes of
+// its parents. The included training steps of every contributor are written
+// to model_lineage_contribution, tagged with the contributor.
+func (c *Client) RecordLineage(hash string, parents []string, versions map[string]int, age int) {
+	now := time.Now()
+	points := []*influxdb3.Point{influxdb3.NewPoint(
+		fmt.Sprintf("model_lineage_%s", c.run),
+		c.tags,
+		map[string]any{
+			"hash":         hash,
+			"parents":      strings.Join(parents, ","),
+			"contributors": len(versions),
+			"age":          age,
+		},
+		now,
+	)}
+	for contributor, steps := range versions {
+		tags := maps.Clone(c.tags)
+		tags["contributor"] = contributor
+		points = append(points, influxdb3.NewPoint(
+			fmt.Sprintf("model_lineage_contribution_%s", c.run),
+			tags,
+			map[string]any{
+				"hash":  hash,
+				"steps": steps,
+				"age":   age,
+			},
+			now,
+		))
+	}
+
+	log("model_lineage")
+	err := c.client.WritePoints(c.ctx, points)
+	if err != nil {
+		log_w(err)
+	}
+}
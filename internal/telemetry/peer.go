@@ -81,3 +81,97 @@ func (c *Client) RecordScoreChange(peer string, score int) {
 		log_w(err)
 	}
 }
+
+func (c *Client) RecordLedger(peer string, sent, received, useful, bytesSent, bytesReceived int, ratio float64, freeRider bool) {
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("peer_ledger_%s", c.run),
+		c.tags,
+		map[string]any{
+			"id":             c.name,
+			"peer":           peer,
+			"sent":           sent,
+			"received":       received,
+			"useful":         useful,
+			"bytes_sent":     bytesSent,
+			"bytes_received": bytesReceived,
+			"ratio":          ratio,
+			"free_rider":     freeRider,
+		},
+		time.Now(),
+	)
+
+	log("peer_ledger")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
+
+// RecordIncomingDrop records an update that was dropped from the incoming
+// queue, or replaced by a newer update of its source, with the totals so far.
+func (c *Client) RecordIncomingDrop(source string, age int, policy string, replaced bool, depth int, dropped, replacedTotal int64) {
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("peer_incoming_drop_%s", c.run),
+		c.tags,
+		map[string]any{
+			"source":         source,
+			"age":            age,
+			"policy":         policy,
+			"replaced":       replaced,
+			"depth":          depth,
+			"dropped_total":  dropped,
+			"replaced_total": replacedTotal,
+		},
+		time.Now(),
+	)
+
+	log("peer_incoming_drop")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
+
+// RecordSendDecision records whether the send policy sent a change of the
+// model.
+func (c *Client) RecordSendDecision(policy string, sent bool, age int, loss float32, peers int) {
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("peer_send_decision_%s", c.run),
+		c.tags,
+		map[string]any{
+			"policy": policy,
+			"sent":   sent,
+			"age":    age,
+			"loss":   loss,
+			"peers":  peers,
+		},
+		time.Now(),
+	)
+
+	log("peer_send_decision")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
+
+// RecordDuplicate records a suppressed duplicate update with the total number
+// of duplicates suppressed so far.
+func (c *Client) RecordDuplicate(source string, age int, total int64) {
+	point := influxdb3.NewPoint(
+		fmt.Sprintf("peer_duplicate_%s", c.run),
+		c.tags,
+		map[string]any{
+			"source": source,
+			"age":    age,
+			"total":  total,
+		},
+		time.Now(),
+	)
+
+	log("peer_duplicate")
+	err := c.client.WritePoints(c.ctx, []*influxdb3.Point{point})
+	if err != nil {
+		log_w(err)
+	}
+}
@@ -0,0 +1,177 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+const (
+	tokenHeader       = "swarm-token"
+	powNonceHeader    = "pow-nonce"
+	powSolutionHeader = "pow-solution"
+)
+
+var (
+	errInvalidToken = errors.New("invalid swarm token")
+	errRateLimited  = errors.New("too many join attempts")
+	errInvalidPoW   = errors.New("missing or invalid proof of work")
+)
+
+// admission controls who may join the swarm. All checks are optional and
+// disabled by their zero value in the config.
+type admission struct {
+	challenges map[string]time.Time   // nonce -> expiry
+	attempts   map[string][]time.Time // path and IP -> attempts
+	sync.Mutex
+}
+
+func newAdmission() *admission {
+	return &admission{
+		challenges: make(map[string]time.Time),
+		attempts:   make(map[string][]time.Time),
+	}
+}
+
+// challenge hands out a new proof-of-work puzzle. The difficulty is 0 if
+// proof of work is disabled.
+func (t *Tracker) challenge(w http.ResponseWriter, r *http.Request) {
+	if err := t.checkToken(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	c := structs.Challenge{Difficulty: t.conf.Admission.PowDifficulty}
+	if c.Difficulty > 0 {
+		b := make([]byte, 16)
+		rand.Read(b)
+		c.Nonce = hex.EncodeToString(b)
+		t.admission.Lock()
+		t.admission.challenges[c.Nonce] = time.Now().Add(t.conf.Admission.ChallengeTTL)
+		t.admission.Unlock()
+	}
+	buf, _ := json.Marshal(c)
+	w.Write(buf)
+}
+
+// admitted wraps handlers that let new peers into the swarm with the
+// configured admission checks.
+func (t *Tracker) admitted(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var status int
+		err := t.checkToken(r)
+		switch {
+		case err != nil:
+			status = http.StatusUnauthorized
+		case !t.checkRate(r):
+			err, status = errRateLimited, http.StatusTooManyRequests
+		case !t.checkPoW(r):
+			err, status = errInvalidPoW, http.StatusForbidden
+		}
+		if err != nil {
+			slog.Debug("Rejected join attempt", "remote", r.RemoteAddr, "path", r.URL.Path, "error", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authenticated wraps handlers that are only available to swarm members.
+func (t *Tracker) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := t.checkToken(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (t *Tracker) checkToken(r *http.Request) error {
+	if t.conf.Admission.Token == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(tokenHeader)), []byte(t.conf.Admission.Token)) != 1 {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// checkRate records the attempt and tests whether the requesting IP stays
+// within the configured amount of attempts per window. Every path is counted
+// on its own, so a peer asking /whoami before /join is not limited twice.
+func (t *Tracker) checkRate(r *http.Request) bool {
+	if t.conf.Admission.JoinRate < 1 {
+		return true
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	key := r.URL.Path + " " + host
+	now := time.Now()
+	t.admission.Lock()
+	defer t.admission.Unlock()
+	recent := pruneAttempts(t.admission.attempts[key], now.Add(-t.conf.Admission.JoinRateWindow))
+	if len(recent) >= t.conf.Admission.JoinRate {
+		t.admission.attempts[key] = recent
+		return false
+	}
+	t.admission.attempts[key] = append(recent, now)
+	return true
+}
+
+// checkPoW verifies the solution to a previously issued challenge. Every
+// challenge can only be used once.
+func (t *Tracker) checkPoW(r *http.Request) bool {
+	if t.conf.Admission.PowDifficulty < 1 {
+		return true
+	}
+	nonce := r.Header.Get(powNonceHeader)
+	t.admission.Lock()
+	expiry, ok := t.admission.challenges[nonce]
+	delete(t.admission.challenges, nonce)
+	t.admission.Unlock()
+	if !ok || time.Now().After(expiry) {
+		return false
+	}
+	c := structs.Challenge{Nonce: nonce, Difficulty: t.conf.Admission.PowDifficulty}
+	return c.Verify(r.Header.Get(powSolutionHeader))
+}
+
+// pruneAdmission drops expired challenges and old join attempts.
+func (t *Tracker) pruneAdmission() {
+	now := time.Now()
+	t.admission.Lock()
+	defer t.admission.Unlock()
+	for nonce, expiry := range t.admission.challenges {
+		if now.After(expiry) {
+			delete(t.admission.challenges, nonce)
+		}
+	}
+	for key, attempts := range t.admission.attempts {
+		recent := pruneAttempts(attempts, now.Add(-t.conf.Admission.JoinRateWindow))
+		if len(recent) == 0 {
+			delete(t.admission.attempts, key)
+		} else {
+			t.admission.attempts[key] = recent
+		}
+	}
+}
+
+// pruneAttempts removes all attempts before the cutoff. It assumes the
+// attempts to be in chronological order.
+func pruneAttempts(attempts []time.Time, cutoff time.Time) []time.Time {
+	for i, a := range attempts {
+		if a.After(cutoff) {
+			return attempts[i:]
+		}
+	}
+	return attempts[:0]
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/vs-ude/btml/internal/privacy"
+	"github.com/vs-ude/btml/internal/secagg"
+	"github.com/vs-ude/btml/internal/structs"
 	"github.com/vs-ude/btml/internal/telemetry"
 )
 
@@ -13,13 +16,38 @@ type Config struct {
 		MaintainInterval time.Duration `toml:"maintain_interval"`
 		MaxPeers         int           `toml:"max_peers"`
 		MaxReturnPeers   int           `toml:"max_return_peers"`
+		BanThreshold     int           `toml:"ban_threshold"`
+		ReportMaxAge     time.Duration `toml:"report_max_age"`
+		BanDuration      time.Duration `toml:"ban_duration"` // Zero bans forever
 	} `toml:"tracker"`
 	Peer struct {
-		Dataset             string        `toml:"dataset"`
-		UpdateFreq          time.Duration `toml:"update_freq"`
-		PeerSetSize         int           `toml:"peer_set_size"`
-		PeerSetArchiveAfter time.Duration `toml:"peer_set_archive_after"`
+		Dataset             string                `toml:"dataset"`
+		DatasetFormat       string                `toml:"dataset_format"`
+		Architecture        string                `toml:"architecture"`
+		MergePolicy         string                `toml:"merge_policy"`
+		UpdateFreq          time.Duration         `toml:"update_freq"`
+		PeerSetSize         int                   `toml:"peer_set_size"`
+		PeerSetArchiveAfter time.Duration         `toml:"peer_set_archive_after"`
+		FreeRiderRatio      float64               `toml:"free_rider_ratio"`
+		FreeRiderRounds     int                   `toml:"free_rider_rounds"`
+		FreeRiderMinTaken   int                   `toml:"free_rider_min_taken"`
+		ReportAfter         int                   `toml:"report_after"`
+		Pieces              bool                  `toml:"pieces"`
+		Training            structs.Hyperparams   `toml:"training"`
+		Privacy             privacy.Config        `toml:"privacy"`
+		SecureAggregation   secagg.Config         `toml:"secure_aggregation"`
+		Sharing             structs.SharingPolicy `toml:"sharing"`
+		Incoming            structs.QueueConfig   `toml:"incoming"`
+		Send                structs.SendConfig    `toml:"send"`
+		Tuning              structs.Tuning        `toml:"tuning"`
 	} `toml:"peer"`
+	Admission struct {
+		Token          string        `toml:"token" json:"-"`
+		JoinRate       int           `toml:"join_rate"`
+		JoinRateWindow time.Duration `toml:"join_rate_window"`
+		PowDifficulty  int           `toml:"pow_difficulty"`
+		ChallengeTTL   time.Duration `toml:"challenge_ttl"`
+	} `toml:"admission"`
 	TelConf     *telemetry.TelemetryConf `toml:"telemetry"`
 	GrafanaConf *telemetry.GrafanaConf   `toml:"grafana"`
 }
@@ -30,9 +30,24 @@ func (t *Tracker) initPeer(w http.ResponseWriter, r *http.Request) {
 	who := structs.WhoAmI{
 		Id:                  i,
 		Dataset:             t.conf.Peer.Dataset,
+		DatasetFormat:       t.conf.Peer.DatasetFormat,
+		Architecture:        t.conf.Peer.Architecture,
+		MergePolicy:         t.conf.Peer.MergePolicy,
 		UpdateFreq:          t.conf.Peer.UpdateFreq,
 		PeerSetSize:         t.conf.Peer.PeerSetSize,
 		PeerSetArchiveAfter: t.conf.Peer.PeerSetArchiveAfter,
+		FreeRiderRatio:      t.conf.Peer.FreeRiderRatio,
+		FreeRiderRounds:     t.conf.Peer.FreeRiderRounds,
+		FreeRiderMinTaken:   t.conf.Peer.FreeRiderMinTaken,
+		ReportAfter:         t.conf.Peer.ReportAfter,
+		Pieces:              t.conf.Peer.Pieces,
+		Incoming:            t.conf.Peer.Incoming,
+		Send:                t.conf.Peer.Send,
+		Tuning:              t.conf.Peer.Tuning,
+		Training:            t.conf.Peer.Training,
+		Privacy:             t.conf.Peer.Privacy,
+		SecureAggregation:   t.conf.Peer.SecureAggregation,
+		Sharing:             t.conf.Peer.Sharing,
 		ExtIp:               host,
 	}
 	if t.telemetry.enabled {
@@ -28,6 +28,11 @@ func (t *Tracker) join(w http.ResponseWriter, r *http.Request) {
 		slog.Warn("Failed to get peer from request", "error", err)
 		return
 	}
+	if t.isBanned(peer.Name) {
+		http.Error(w, "peer is quarantined", http.StatusForbidden)
+		slog.Debug("Refused join of quarantined peer", "peer", peer)
+		return
+	}
 	peer.LastSeen = time.Now()
 	t.newlist <- peer
 	w.WriteHeader(http.StatusOK)
@@ -70,7 +75,8 @@ func getPeer(r *http.Request) (*structs.Peer, error) {
 // getPeerList returns a list of peers from the peerlist. If less than
 // Tracker.conf.MaxReturnPeers are available, it will return all peers,
 // otherwise it will return a randomized list of peers.
-// The result may include peers that have already left the swarm.
+// The result may include peers that have already left the swarm, but never
+// quarantined ones.
 func (t *Tracker) getPeerList(skipId string) *structs.Peerlist {
 	if t.peers.Len() <= t.conf.Tracker.MaxReturnPeers+1 {
 		t.processAddedPeers()
@@ -85,7 +91,7 @@ func (t *Tracker) getPeerList(skipId string) *structs.Peerlist {
 		if i == 0 {
 			break
 		}
-		if p.Name == skipId {
+		if p.Name == skipId || t.isBanned(p.Name) {
 			continue
 		}
 		// No need to lock as we are the only ones accessing _this_ peerlist.
@@ -14,6 +14,9 @@ func (t *Tracker) MaintenanceLoop() {
 		t.processTouches()
 		t.processRemovedPeers()
 		t.cleanPeers()
+		t.pruneAdmission()
+		t.pruneReports()
+		t.pruneBans()
 		slog.Info("Current peer count", "count", len(t.peers.List))
 	}
 }
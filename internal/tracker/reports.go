@@ -0,0 +1,160 @@
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vs-ude/btml/internal/structs"
+)
+
+// quarantine aggregates misbehavior reports and keeps the list of banned
+// peers.
+type quarantine struct {
+	reports map[string]map[string]time.Time // accused -> reporter -> last report
+	banned  *structs.Peerlist
+	expiry  map[string]time.Time // banned -> end of the ban
+	sync.Mutex
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{
+		reports: make(map[string]map[string]time.Time),
+		banned:  structs.NewPeerList(),
+		expiry:  make(map[string]time.Time),
+	}
+}
+
+// report accepts a signed misbehavior report from a swarm member. Once enough
+// independent peers reported the same peer, it is quarantined.
+func (t *Tracker) report(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rep := new(structs.Report)
+	if err = json.Unmarshal(body, rep); err != nil {
+		http.Error(w, "unable to parse report", http.StatusBadRequest)
+		return
+	}
+	if err = t.checkReport(rep); err != nil {
+		slog.Debug("Rejected misbehavior report", "reporter", rep.Reporter, "accused", rep.Accused, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if t.addReport(rep) {
+		slog.Info("Quarantined peer", "peer", rep.Accused)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// banlist returns all quarantined peers.
+func (t *Tracker) banlist(w http.ResponseWriter, r *http.Request) {
+	data, _ := t.quarantine.banned.Marshal()
+	w.Write(data)
+}
+
+func (t *Tracker) checkReport(rep *structs.Report) error {
+	if t.conf.Tracker.BanThreshold < 1 {
+		return errors.New("reports are disabled")
+	}
+	if rep.Reporter == rep.Accused {
+		return errors.New("peers can not report themselves")
+	}
+	if time.Since(rep.Timestamp).Abs() > t.conf.Tracker.ReportMaxAge {
+		return errors.New("report is too old")
+	}
+	if t.isBanned(rep.Reporter) {
+		return errors.New("reporter is banned")
+	}
+	t.peers.Lock()
+	reporter, ok := t.peers.List[rep.Reporter]
+	var fingerprint string
+	if ok {
+		fingerprint = reporter.Fingerprint
+	}
+	t.peers.Unlock()
+	if !ok {
+		return fmt.Errorf("reporter %s is unknown", rep.Reporter)
+	}
+	return rep.Verify(fingerprint)
+}
+
+// addReport stores the report and quarantines the accused peer if the ban
+// threshold is reached. It returns true if the peer was newly quarantined.
+func (t *Tracker) addReport(rep *structs.Report) bool {
+	t.quarantine.Lock()
+	defer t.quarantine.Unlock()
+	if t.quarantine.banned.Has(rep.Accused) {
+		return false
+	}
+	reporters, ok := t.quarantine.reports[rep.Accused]
+	if !ok {
+		reporters = make(map[string]time.Time)
+		t.quarantine.reports[rep.Accused] = reporters
+	}
+	reporters[rep.Reporter] = rep.Timestamp
+	if len(reporters) < t.conf.Tracker.BanThreshold {
+		return false
+	}
+
+	t.peers.Lock()
+	p, ok := t.peers.List[rep.Accused]
+	if ok {
+		p = p.Copy()
+	} else {
+		p = &structs.Peer{Name: rep.Accused}
+	}
+	t.peers.Unlock()
+	t.quarantine.banned.Add(p)
+	if t.conf.Tracker.BanDuration > 0 {
+		t.quarantine.expiry[rep.Accused] = time.Now().Add(t.conf.Tracker.BanDuration)
+	}
+	delete(t.quarantine.reports, rep.Accused)
+	t.removelist <- rep.Accused
+	return true
+}
+
+func (t *Tracker) isBanned(name string) bool {
+	t.quarantine.Lock()
+	defer t.quarantine.Unlock()
+	return t.quarantine.banned.Has(name)
+}
+
+// pruneReports forgets reports that are older than the maximum report age, so
+// only recent misbehavior leads to a ban.
+func (t *Tracker) pruneReports() {
+	t.quarantine.Lock()
+	defer t.quarantine.Unlock()
+	cutoff := time.Now().Add(-t.conf.Tracker.ReportMaxAge)
+	for accused, reporters := range t.quarantine.reports {
+		for reporter, ts := range reporters {
+			if ts.Before(cutoff) {
+				delete(reporters, reporter)
+			}
+		}
+		if len(reporters) == 0 {
+			delete(t.quarantine.reports, accused)
+		}
+	}
+}
+
+// pruneBans lifts all bans that lasted the configured ban duration.
+func (t *Tracker) pruneBans() {
+	t.quarantine.Lock()
+	defer t.quarantine.Unlock()
+	now := time.Now()
+	for name, expiry := range t.quarantine.expiry {
+		if now.After(expiry) {
+			t.quarantine.banned.Remove(&structs.Peer{Name: name})
+			delete(t.quarantine.expiry, name)
+			slog.Info("Lifted ban of peer", "peer", name)
+		}
+	}
+}
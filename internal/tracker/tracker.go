@@ -28,6 +28,8 @@ type Tracker struct {
 		enabled bool
 		ready   bool
 	}
+	admission  *admission
+	quarantine *quarantine
 	newlist    chan *structs.Peer
 	removelist chan string
 	touchlist  chan touch
@@ -60,6 +62,8 @@ func NewTracker(addr string, conf string) *Tracker {
 			enabled: false,
 			ready:   false,
 		},
+		admission:  newAdmission(),
+		quarantine: newQuarantine(),
 		newlist:    make(chan *structs.Peer, 1000),
 		removelist: make(chan string, 1000),
 		touchlist:  make(chan touch, 10000),
@@ -85,10 +89,13 @@ func (t *Tracker) Serve(done chan int) {
 	slog.Info("Starting tracker", "config", t.conf.String())
 	t.peers = new(structs.Peerlist)
 	t.peers.List = make(map[string]*structs.Peer)
-	http.HandleFunc("/list", t.list)
-	http.HandleFunc("/join", t.join)
-	http.HandleFunc("/leave", t.leave)
-	http.HandleFunc("/whoami", t.initPeer)
+	http.HandleFunc("/list", t.authenticated(t.list))
+	http.HandleFunc("/join", t.admitted(t.join))
+	http.HandleFunc("/leave", t.authenticated(t.leave))
+	http.HandleFunc("/whoami", t.admitted(t.initPeer))
+	http.HandleFunc("/challenge", t.challenge)
+	http.HandleFunc("/report", t.authenticated(t.report))
+	http.HandleFunc("/banlist", t.authenticated(t.banlist))
 	slog.Info("Tracker listening", "addr", "http://"+t.addr)
 	slog.Error("HTTP server terminated", "error", http.ListenAndServe(t.addr, nil))
 	done <- 1
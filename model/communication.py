@@ -1,16 +1,21 @@
+import hashlib
 import logging
 import os
 import socket
+from collections.abc import Iterator
 from concurrent.futures import ThreadPoolExecutor
 from io import BytesIO
 from pathlib import Path
 
 import grpc
-from torch import load, save
-
+from grpc_health.v1 import health, health_pb2, health_pb2_grpc
 from model.lib.ipc import peer_model_pb2 as messages
 from model.lib.ipc import peer_model_pb2_grpc as ipc
-from model.training import Model
+from model.tensors import decode, encode, save_file
+from model.training import Hyperparams, Model, TrainingCancelled
+
+# Chunk size of streamed weights, matches the Go client
+CHUNK_SIZE = 1 << 20
 
 
 class ModelServer:
@@ -24,10 +29,17 @@ class ModelServer:
         if os.path.exists(self.socket_path):
             os.unlink(self.socket_path)
 
-        server = grpc.server(ThreadPoolExecutor(max_workers=1))
+        # The additional workers keep health checks and cancel requests
+        # responsive during long epochs. Model calls are serialized by the peer.
+        server = grpc.server(ThreadPoolExecutor(max_workers=3))
         _ = server.add_insecure_port("unix://" + self.socket_path)
 
+        health_servicer = health.HealthServicer()
+        health_pb2_grpc.add_HealthServicer_to_server(health_servicer, server)  # pyright: ignore[reportUnknownMemberType]
+        health_servicer.set("", health_pb2.HealthCheckResponse.SERVING)
+
         ipc.add_TrainServicer_to_server(TrainService(self.model), server)  # pyright: ignore[reportUnknownMemberType]
+        ipc.add_ControlServicer_to_server(ControlService(self.model), server)  # pyright: ignore[reportUnknownMemberType]
         ipc.add_EvalServicer_to_server(EvalService(self.model), server)  # pyright: ignore[reportUnknownMemberType]
         ipc.add_ImportWeightsServicer_to_server(ImportWeightsService(self.model), server)  # pyright: ignore[reportUnknownMemberType]
         ipc.add_ExportWeightsServicer_to_server(ExportWeightsService(self.model), server)  # pyright: ignore[reportUnknownMemberType]
@@ -50,10 +62,29 @@ class TrainService(ipc.TrainServicer):
 
     def Train(self, request: messages.TrainRequest, context) -> messages.TrainResponse:  # pyright: ignore[reportImplicitOverride]
         response = messages.TrainResponse()
-        response.loss = self.model.train()
-        response.success = True
+        try:
+            hyperparams = Hyperparams.from_request(request)
+            response.loss = self.model.train(hyperparams)
+            response.num_samples = self.model.num_samples()
+            response.success = True
+        except TrainingCancelled as e:
+            response.success = False
+            response.error_message = str(e)
+            logging.info("Training was cancelled")
+        except Exception as e:
+            response.success = False
+            response.error_message = str(e)
+            logging.error(f"Error training model: {e}")
         return response
 
+class ControlService(ipc.ControlServicer):
+    def __init__(self, model: Model) -> None:
+        super().__init__()
+        self.model: Model = model
+
+    def Cancel(self, request: messages.CancelRequest, context) -> messages.CancelResponse:  # pyright: ignore[reportImplicitOverride]
+        return messages.CancelResponse(cancelled=self.model.cancel())
+
 class EvalService(ipc.EvalServicer):
     def __init__(self, model: Model) -> None:
         super().__init__()
@@ -61,15 +92,21 @@ class EvalService(ipc.EvalServicer):
 
     def Eval(self, request: messages.EvalRequest, context) -> messages.EvalResponse:  # pyright: ignore[reportImplicitOverride]
         response = messages.EvalResponse()
-        accuracy, loss, guesses = self.model.test()
-        response.accuracy = accuracy
-        response.loss = loss
-        response.guesses.update(guesses)
+        evaluation = self.model.test()
+        response.accuracy = evaluation.accuracy
+        response.loss = evaluation.loss
+        response.guesses.update(evaluation.guesses)
+        response.num_classes = len(evaluation.confusion)
+        response.confusion.extend(count for row in evaluation.confusion for count in row)
+        response.precision.extend(evaluation.precision)
+        response.recall.extend(evaluation.recall)
+        response.f1.extend(evaluation.f1)
+        response.calibration_error = evaluation.calibration_error
         response.success = True
         if request.path:
-            model_path = f"{request.path}.pt"
+            model_path = f"{request.path}.tensors"
             Path(model_path).parent.mkdir(parents=True, exist_ok=True)
-            save(self.model.export_model_weights(), model_path)
+            save_file(self.model.export_model_weights(), model_path)
             logging.info(f"Saved model checkpoint to {model_path}")
         return response
 
@@ -79,12 +116,37 @@ class ImportWeightsService(ipc.ImportWeightsServicer):
         self.model: Model = model
 
     def ImportWeights(self, request: messages.ImportRequest, context) -> messages.ImportResponse:  # pyright: ignore[reportImplicitOverride]
+        return self._import(request.weights, request.weight_ratio, request.flat, dict(request.layer_ratios))
+
+    def ImportWeightsStream(self, request_iterator: Iterator[messages.WeightsChunk], context) -> messages.ImportResponse:  # pyright: ignore[reportImplicitOverride]
+        buffer = BytesIO()
+        weight_ratio = 0.0
+        flat = False
+        layer_ratios: dict[str, float] = {}
+        checksum = b""
+        for i, chunk in enumerate(request_iterator):
+            if i == 0:
+                weight_ratio = chunk.weight_ratio
+                flat = chunk.flat
+                layer_ratios = dict(chunk.layer_ratios)
+            _ = buffer.write(chunk.data)
+            if chunk.sha256:
+                checksum = chunk.sha256
+        data = buffer.getvalue()
+        if hashlib.sha256(data).digest() != checksum:
+            logging.error(f"Checksum mismatch in weights stream after {len(data)} bytes")
+            return messages.ImportResponse(success=False, error_message="checksum mismatch")
+        return self._import(data, weight_ratio, flat, layer_ratios)
+
+    def _import(self, data: bytes, weight_ratio: float, flat: bool = False,
+                layer_ratios: dict[str, float] | None = None) -> messages.ImportResponse:
         response = messages.ImportResponse()
         try:
-            weights = load(BytesIO(request.weights))
+            weights = self.model.unflatten(data) if flat else decode(data)
             self.model.import_model_weights(
                 weights,
-                request.weight_ratio
+                weight_ratio,
+                layer_ratios
             )
             response.success = True
         except Exception as e:
@@ -101,9 +163,31 @@ class ExportWeightsService(ipc.ExportWeightsServicer):
 
     def ExportWeights(self, request: messages.ExportRequest, context) -> messages.ExportResponse:  # pyright: ignore[reportImplicitOverride]
         response = messages.ExportResponse()
-        weights_buffer = BytesIO()
-        save(self.model.export_model_weights(),
-                    weights_buffer)
+        # Private weights are only released if they are actually returned,
+        # they have the same size as the plain weights
+        weights, _ = self._export(flat=request.flat)
         response.success = True
-        response.weights = weights_buffer.getvalue()
+        response.size = len(weights)
+        if request.max_size and len(weights) > request.max_size:
+            response.too_large = True
+            return response
+        if request.HasField("privacy"):
+            weights, response.update_norm = self._export(request.privacy, request.flat)
+        response.weights = weights
         return response
+
+    def ExportWeightsStream(self, request: messages.ExportRequest, context) -> Iterator[messages.WeightsChunk]:  # pyright: ignore[reportImplicitOverride]
+        weights, norm = self._export(request.privacy if request.HasField("privacy") else None, request.flat)
+        for start in range(0, len(weights), CHUNK_SIZE):
+            yield messages.WeightsChunk(data=weights[start:start + CHUNK_SIZE])
+        yield messages.WeightsChunk(sha256=hashlib.sha256(weights).digest(), update_norm=norm)
+
+    def _export(self, privacy: messages.PrivacyParams | None = None, flat: bool = False) -> tuple[bytes, float]:
+        norm = 0.0
+        if privacy is None:
+            state_dict = self.model.export_model_weights()
+        else:
+            state_dict, norm = self.model.export_private_weights(privacy.clip_norm, privacy.noise_multiplier)
+        if flat:
+            return self.model.flatten(state_dict), norm
+        return encode(state_dict), norm
@@ -11,3 +11,7 @@ DEVICE = (
 BATCH_SIZE = 64
 EPOCHS = 5
 LEARNING_RATE = 0.015
+OPTIMIZER = "sgd"
+CALIBRATION_BINS = 10
+DEFAULT_ARCHITECTURE = "fmnist_cnn"
+DEFAULT_DATASET_FORMAT = "prepared"
@@ -4,6 +4,8 @@ from typing import Any
 import torch
 from torch.utils.data import DataLoader, TensorDataset
 
+from model.config import DEFAULT_DATASET_FORMAT
+
 
 class PreparedFashionMNIST(TensorDataset):
     dataset: TensorDataset | None = None
@@ -21,15 +23,25 @@ class PreparedFashionMNIST(TensorDataset):
         return self.data[idx], self.labels[idx]
 
 
-def create_data_loader(batch_size: int, train_path: str, test_path: str) -> tuple[DataLoader[tuple[Any, ...]]|None, DataLoader[tuple[Any, ...]]]:
-    logging.info(f"Loading data from {train_path} and {test_path}")
+# Loaders selectable by the dataset format
+DATASETS: dict[str, type[TensorDataset]] = {
+    "prepared": PreparedFashionMNIST,
+}
+
+
+def create_data_loader(batch_size: int, train_path: str, test_path: str,
+                       dataset_format: str = DEFAULT_DATASET_FORMAT) -> tuple[DataLoader[tuple[Any, ...]]|None, DataLoader[tuple[Any, ...]]]:
+    if dataset_format not in DATASETS:
+        raise ValueError(f"unknown dataset format {dataset_format}, expected one of {sorted(DATASETS)}")
+    dataset = DATASETS[dataset_format]
+    logging.info(f"Loading {dataset_format} data from {train_path} and {test_path}")
     if train_path:
-        training_data = PreparedFashionMNIST(train_path)
+        training_data = dataset(train_path)
         train_dataloader = DataLoader(
             training_data, batch_size=batch_size, shuffle=True)
     else:
         train_dataloader = None
-    test_data = PreparedFashionMNIST(test_path)
+    test_data = dataset(test_path)
     test_dataloader = DataLoader(
         test_data, batch_size=batch_size, shuffle=True)
     return train_dataloader, test_dataloader
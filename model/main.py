@@ -4,13 +4,12 @@ import argparse
 import logging
 import sys
 
-from torch import load
-
 from model.communication import ModelServer
-from model.config import BATCH_SIZE, DEVICE, EPOCHS
-from model.data import create_data_loader, print_data_shape
+from model.config import BATCH_SIZE, DEFAULT_ARCHITECTURE, DEFAULT_DATASET_FORMAT, DEVICE, EPOCHS
+from model.data import DATASETS, create_data_loader, print_data_shape
 from model.evaluate_imported import evaluate
-from model.training import Model
+from model.tensors import load_file
+from model.training import ARCHITECTURES, Model
 
 
 def _oneshot(model: Model):
@@ -54,11 +53,17 @@ def main():
     _ = parser.add_argument("--log-file", type=str,
                         help="Path to log file (if not specified, logs to stdout only)")
     _ = parser.add_argument("--weights", type=str,
-                        help="Path to the saved model weights file (.pt or .pth)")
+                        help="Path to the saved model weights file (.tensors), e.g. a checkpoint")
     _ = parser.add_argument("--evaluate", action='store_true',
                         help="Evaluate the model and exit")
     _ = parser.add_argument("--limit", type=int, default=20,
                         help="Limit the number of results to display in evaluation mode (default: 20, 0 for all)")
+    _ = parser.add_argument("--architecture", type=str, default=DEFAULT_ARCHITECTURE,
+                        choices=sorted(ARCHITECTURES),
+                        help=f"Model architecture (default: {DEFAULT_ARCHITECTURE})")
+    _ = parser.add_argument("--dataset-format", type=str, default=DEFAULT_DATASET_FORMAT,
+                        choices=sorted(DATASETS),
+                        help=f"Format of the data files (default: {DEFAULT_DATASET_FORMAT})")
     args = parser.parse_args()
 
     if (not args.train_data and not args.evaluate):
@@ -75,12 +80,12 @@ def main():
 
     # Setup data
     train_dataloader, test_dataloader = create_data_loader(
-        BATCH_SIZE, args.train_data, args.test_data)
+        BATCH_SIZE, args.train_data, args.test_data, args.dataset_format)
     print_data_shape(test_dataloader)
 
-    model = Model(train_dataloader, test_dataloader)
+    model = Model(train_dataloader, test_dataloader, args.architecture)
     if args.weights:
-        _ = model.model.load_state_dict(load(args.weights, weights_only=True))
+        _ = model.model.load_state_dict(load_file(args.weights))
     if args.evaluate:
         evaluate(model, args.limit)
         logging.info("Done!")
@@ -0,0 +1,75 @@
+"""
+Conversion of state dicts to and from the TensorMap protobuf format.
+
+Unlike torch.load, decoding a TensorMap never executes code, so it is safe
+for weights of untrusted peers. The data of every tensor is stored in the
+native byte order, which is little endian on all supported platforms.
+"""
+import math
+
+import torch
+from torch.types import Tensor
+
+from model.lib.ipc import tensor_pb2
+
+DTYPES: dict[torch.dtype, int] = {
+    torch.float32: tensor_pb2.FLOAT32,
+    torch.float64: tensor_pb2.FLOAT64,
+    torch.float16: tensor_pb2.FLOAT16,
+    torch.bfloat16: tensor_pb2.BFLOAT16,
+    torch.int64: tensor_pb2.INT64,
+    torch.int32: tensor_pb2.INT32,
+    torch.int16: tensor_pb2.INT16,
+    torch.int8: tensor_pb2.INT8,
+    torch.uint8: tensor_pb2.UINT8,
+    torch.bool: tensor_pb2.BOOL,
+}
+TORCH_DTYPES: dict[int, torch.dtype] = {v: k for k, v in DTYPES.items()}
+
+
+def encode(state_dict: dict[str, Tensor]) -> bytes:
+    """Serialize the state dict as TensorMap."""
+    tensor_map = tensor_pb2.TensorMap()
+    for name, value in state_dict.items():
+        if value.dtype not in DTYPES:
+            raise ValueError(f"tensor {name} has unsupported dtype {value.dtype}")
+        flat = value.detach().to("cpu").contiguous().reshape(-1)
+        _ = tensor_map.tensors.add(
+            name=name,
+            dtype=DTYPES[value.dtype],
+            shape=list(value.shape),
+            data=flat.view(torch.uint8).numpy().tobytes(),
+        )
+    return tensor_map.SerializeToString()
+
+
+def decode(data: bytes) -> dict[str, Tensor]:
+    """Deserialize a TensorMap to a state dict on the CPU."""
+    tensor_map = tensor_pb2.TensorMap()
+    _ = tensor_map.ParseFromString(data)
+    state_dict: dict[str, Tensor] = {}
+    for t in tensor_map.tensors:
+        if t.dtype not in TORCH_DTYPES:
+            raise ValueError(f"tensor {t.name} has unknown dtype {t.dtype}")
+        dtype = TORCH_DTYPES[t.dtype]
+        shape = list(t.shape)
+        size = math.prod(shape) * dtype.itemsize
+        if len(t.data) != size:
+            raise ValueError(f"tensor {t.name} has {len(t.data)} bytes, its shape {shape} needs {size}")
+        if not t.data:
+            state_dict[t.name] = torch.empty(shape, dtype=dtype)
+            continue
+        state_dict[t.name] = torch.frombuffer(bytearray(t.data), dtype=dtype).reshape(shape)
+    return state_dict
+
+
+def load_file(path: str) -> dict[str, Tensor]:
+    """Read a state dict from a TensorMap file, e.g. a checkpoint."""
+    with open(path, "rb") as f:
+        return decode(f.read())
+
+
+def save_file(state_dict: dict[str, Tensor], path: str):
+    """Write the state dict to a TensorMap file."""
+    with open(path, "wb") as f:
+        _ = f.write(encode(state_dict))
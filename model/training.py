@@ -1,4 +1,6 @@
 import logging
+import threading
+from dataclasses import dataclass, replace
 from typing import Any
 
 import torch
@@ -7,7 +9,14 @@ from torch import nn
 from torch.types import Tensor
 from torch.utils.data import DataLoader
 
-from model.config import DEVICE, LEARNING_RATE
+from model.config import (
+    BATCH_SIZE,
+    CALIBRATION_BINS,
+    DEFAULT_ARCHITECTURE,
+    DEVICE,
+    LEARNING_RATE,
+    OPTIMIZER,
+)
 
 
 # Based on https://github.com/Abhi-H/CNN-with-Fashion-MNIST-dataset/
@@ -43,103 +52,370 @@ class NeuralNetwork(nn.Module):
         return out
 
 
+class MLP(nn.Module):
+    def __init__(self, hidden: int = 128):
+        super().__init__() # pyright: ignore[reportUnknownMemberType]
+        self.flatten: nn.Flatten = nn.Flatten()
+        self.fc1: nn.Linear = nn.Linear(28*28, hidden)
+        self.relu: nn.ReLU = nn.ReLU()
+        self.fc2: nn.Linear = nn.Linear(hidden, 10)
+
+    def forward(self, x: Tensor): # pyright: ignore[reportImplicitOverride]
+        return self.fc2(self.relu(self.fc1(self.flatten(x))))
+
+
+# Architectures selectable by ID. All peers of a run have to use the same
+# architecture, because their weights are merged.
+ARCHITECTURES: dict[str, type[nn.Module]] = {
+    "fmnist_cnn": NeuralNetwork,
+    "fmnist_mlp": MLP,
+}
+
+
+class TrainingCancelled(Exception):
+    pass
+
+
+@dataclass(frozen=True)
+class Hyperparams:
+    epochs: int = 1
+    steps: int = 0  # maximum number of batches, 0 means no limit
+    learning_rate: float = LEARNING_RATE
+    batch_size: int = BATCH_SIZE
+    optimizer: str = OPTIMIZER
+    momentum: float = 0.0
+    weight_decay: float = 0.0
+
+    @classmethod
+    def from_request(cls, request: Any) -> "Hyperparams":
+        """
+        Creates hyperparameters from a TrainRequest. Fields that are not set
+        in the request keep their default values.
+        """
+        defaults = cls()
+        return cls(
+            epochs=request.epochs or defaults.epochs,
+            steps=request.steps or defaults.steps,
+            learning_rate=request.learning_rate or defaults.learning_rate,
+            batch_size=request.batch_size or defaults.batch_size,
+            optimizer=request.optimizer or defaults.optimizer,
+            momentum=request.momentum or defaults.momentum,
+            weight_decay=request.weight_decay or defaults.weight_decay,
+        )
+
+
+@dataclass
+class Evaluation:
+    accuracy: float
+    loss: float
+    guesses: dict[int, float]  # the relative prevalence of frequent labels in the predictions
+    confusion: list[list[int]]  # rows are true labels, columns predictions
+    precision: list[float]
+    recall: list[float]
+    f1: list[float]
+    calibration_error: float
+
+    @classmethod
+    def create(cls, accuracy: float, loss: float, guesses: dict[int, float], num_classes: int,
+               labels: Tensor, predictions: Tensor, confidences: Tensor) -> "Evaluation":
+        """
+        Derives the per class results from the true labels, the predictions
+        and the confidence of each prediction.
+        """
+        confusion = torch.bincount(
+            labels * num_classes + predictions, minlength=num_classes * num_classes
+        ).reshape(num_classes, num_classes)
+        true_positives = confusion.diag().float()
+        predicted = confusion.sum(0).float()
+        support = confusion.sum(1).float()
+        precision = torch.where(predicted > 0, true_positives / predicted.clamp(min=1), 0.0)
+        recall = torch.where(support > 0, true_positives / support.clamp(min=1), 0.0)
+        f1 = torch.where(precision + recall > 0,
+                         2 * precision * recall / (precision + recall).clamp(min=1e-12), 0.0)
+        return cls(
+            accuracy=accuracy,
+            loss=loss,
+            guesses=guesses,
+            confusion=confusion.tolist(),
+            precision=precision.tolist(),
+            recall=recall.tolist(),
+            f1=f1.tolist(),
+            calibration_error=calibration_error(confidences, predictions == labels),
+        )
+
+
+def calibration_error(confidences: Tensor, correct: Tensor, bins: int = CALIBRATION_BINS) -> float:
+    """
+    Computes the expected calibration error, i.e. the mean difference between
+    confidence and accuracy over equally wide confidence bins, weighted by the
+    number of predictions in each bin.
+    """
+    if len(confidences) == 0:
+        return 0.0
+    bin_ids = (confidences * bins).long().clamp(max=bins - 1)
+    error = 0.0
+    for b in range(bins):
+        in_bin = bin_ids == b
+        count = int(in_bin.sum().item())
+        if count == 0:
+            continue
+        gap = confidences[in_bin].mean() - correct[in_bin].float().mean()
+        error += count / len(confidences) * abs(gap.item())
+    return error
+
+
 class Model:
-    model: NeuralNetwork
+    model: nn.Module
+    architecture: str
     loss_fn: nn.CrossEntropyLoss
-    optimizer: torch.optim.SGD
+    optimizer: torch.optim.Optimizer
+    hyperparams: Hyperparams
+    training: threading.Event
+    cancelled: threading.Event
+    released: dict[str, Tensor]  # weights of the last private export
     train_dataloader: DataLoader[tuple[Tensor, ...]]|None
     test_dataloader: DataLoader[tuple[Tensor, ...]]
 
-    def __init__(self, train_dataloader: DataLoader[tuple[Any, ...]]|None, test_dataloader: DataLoader[tuple[Any, ...]]):
-        self.model = NeuralNetwork().to(DEVICE)
-        logging.info("Initialized new model")
+    def __init__(self, train_dataloader: DataLoader[tuple[Any, ...]]|None, test_dataloader: DataLoader[tuple[Any, ...]],
+                 architecture: str = DEFAULT_ARCHITECTURE):
+        if architecture not in ARCHITECTURES:
+            raise ValueError(f"unknown architecture {architecture}, expected one of {sorted(ARCHITECTURES)}")
+        self.architecture = architecture
+        self.model = ARCHITECTURES[architecture]().to(DEVICE)
+        # The initial weights do not depend on the data
+        self.released = {k: v.detach().clone() for k, v in self.model.state_dict().items()}
+        logging.info(f"Initialized new {architecture} model")
 
         # Setup training
         self.loss_fn = nn.CrossEntropyLoss()
-        self.optimizer = torch.optim.SGD(
-            self.model.parameters(), lr=LEARNING_RATE)
+        self.hyperparams = Hyperparams()
+        self.training = threading.Event()
+        self.cancelled = threading.Event()
+        self.optimizer = self._create_optimizer(self.hyperparams)
 
         self.train_dataloader = train_dataloader
         self.test_dataloader = test_dataloader
 
-    def train(self) -> float:
+    def _create_optimizer(self, hp: Hyperparams) -> torch.optim.Optimizer:
+        if hp.optimizer == "sgd":
+            return torch.optim.SGD(
+                self.model.parameters(), lr=hp.learning_rate,
+                momentum=hp.momentum, weight_decay=hp.weight_decay)
+        if hp.optimizer == "adam":
+            return torch.optim.Adam(
+                self.model.parameters(), lr=hp.learning_rate,
+                weight_decay=hp.weight_decay)
+        raise ValueError(f"unknown optimizer {hp.optimizer}")
+
+    def _configure(self, hp: Hyperparams):
+        """
+        Applies changed hyperparameters. The optimizer state is only reset if
+        the optimizer settings change.
+        """
+        assert self.train_dataloader is not None, "train_dataloader is None"
+        if hp.epochs < 1 or hp.steps < 0 or hp.batch_size < 1 or hp.learning_rate <= 0:
+            raise ValueError(f"invalid hyperparameters {hp}")
+        optimizer_settings = replace(hp, epochs=0, steps=0, batch_size=0)
+        if optimizer_settings != replace(self.hyperparams, epochs=0, steps=0, batch_size=0):
+            self.optimizer = self._create_optimizer(hp)
+            logging.info(f"Configured {hp.optimizer} optimizer with learning rate {hp.learning_rate}")
+        if hp.batch_size != self.train_dataloader.batch_size:
+            self.train_dataloader = DataLoader(
+                self.train_dataloader.dataset, batch_size=hp.batch_size, shuffle=True)
+            logging.info(f"Configured batch size {hp.batch_size}")
+        self.hyperparams = hp
+
+    def train(self, hyperparams: Hyperparams | None = None) -> float:
         """
-        Trains the model for an epoch.
+        Trains the model for the configured number of epochs, but at most for
+        the configured number of steps.
+
+        Args:
+            hyperparams: The hyperparameters of this run, the defaults are used if None
 
         Returns:
             float: The average loss over all batches
+
+        Raises:
+            TrainingCancelled: cancel was called during the training run
+        """
+        self.cancelled.clear()
+        self.training.set()
+        try:
+            return self._train(hyperparams or Hyperparams())
+        finally:
+            self.training.clear()
+
+    def num_samples(self) -> int:
+        """Returns the size of the local training set."""
+        if self.train_dataloader is None:
+            return 0
+        return len(self.train_dataloader.dataset) # pyright: ignore[reportArgumentType]
+
+    def cancel(self) -> bool:
+        """
+        Stops a running training run after the current batch.
+
+        Returns:
+            bool: whether a training run was running
         """
+        if not self.training.is_set():
+            return False
+        self.cancelled.set()
+        return True
+
+    def _train(self, hyperparams: Hyperparams) -> float:
         assert self.train_dataloader is not None, "train_dataloader is None"
+        self._configure(hyperparams)
+        hp = self.hyperparams
         size = len(self.train_dataloader.dataset) # pyright: ignore[reportArgumentType]
         losses: list[float] = []
+        steps = 0
         _ = self.model.train()
-        for batch, (x, y) in enumerate(self.train_dataloader):
-            x, y = x.to(DEVICE), y.to(DEVICE)
-
-            # Compute prediction error
-            pred = self.model(x)
-            loss: Tensor = self.loss_fn(pred, y)
-
-            # Backpropagation
-            _ = loss.backward() # pyright: ignore[reportUnknownMemberType]
-            _ = self.optimizer.step() # pyright: ignore[reportUnknownMemberType, reportUnknownVariableType]
-            self.optimizer.zero_grad()
-
-            if batch % 100 == 0:
-                loss_val: float = loss.item()
-                current = (batch + 1) * len(x)
-                logging.info(f"loss: {loss_val:>7f}  [{current:>5d}/{size:>5d}]")
-                losses += [loss_val]
+        for _epoch in range(hp.epochs):
+            for batch, (x, y) in enumerate(self.train_dataloader):
+                if hp.steps and steps >= hp.steps:
+                    break
+                if self.cancelled.is_set():
+                    raise TrainingCancelled(f"training cancelled after {steps} steps")
+                x, y = x.to(DEVICE), y.to(DEVICE)
+
+                # Compute prediction error
+                pred = self.model(x)
+                loss: Tensor = self.loss_fn(pred, y)
+
+                # Backpropagation
+                _ = loss.backward() # pyright: ignore[reportUnknownMemberType]
+                _ = self.optimizer.step() # pyright: ignore[reportUnknownMemberType, reportUnknownVariableType]
+                self.optimizer.zero_grad()
+                steps += 1
+
+                if batch % 100 == 0:
+                    loss_val: float = loss.item()
+                    current = (batch + 1) * len(x)
+                    logging.info(f"loss: {loss_val:>7f}  [{current:>5d}/{size:>5d}]")
+                    losses += [loss_val]
         return sum(losses)/len(losses)
 
-    def test(self) -> tuple[float, float, dict[int, float]]:
+    def test(self) -> Evaluation:
         """
         Evaluates the model.
 
         Returns:
-            float: accuracy
-            float: loss
-            dict[int, float]: the relative prevalence of each label in the generated predictions
+            Evaluation: the overall and per class results
         """
         size = len(self.test_dataloader.dataset) # pyright: ignore[reportArgumentType]
         num_batches = len(self.test_dataloader)
         _ = self.model.eval()
         test_loss, correct = 0, 0
         pred_labels = array([], dtype=int)
+        labels: list[Tensor] = []
+        predictions: list[Tensor] = []
+        confidences: list[Tensor] = []
+        num_classes = 0
         with torch.no_grad():
             for x, y in self.test_dataloader:
                 x, y = x.to(DEVICE), y.to(DEVICE)
                 pred = self.model(x)
+                num_classes = pred.shape[1]
                 test_loss += self.loss_fn(pred, y).item()
                 correct += (pred.argmax(1) == y).type(torch.float).sum().item()
-                pred_labels = concatenate((pred_labels, pred.argmax(1).numpy().astype(int)))
+                pred_labels = concatenate((pred_labels, pred.argmax(1).cpu().numpy().astype(int)))
+                confidence, predicted = pred.softmax(1).max(1)
+                labels.append(y.cpu())
+                predictions.append(predicted.cpu())
+                confidences.append(confidence.cpu())
         pred_labels, pred_counts = unique(pred_labels, return_counts=True)
         guesses = {int(label): pred_counts[i]/size for i, label in enumerate(pred_labels) if pred_counts[i] > size/13}
         test_loss /= num_batches
         correct /= size
+        evaluation = Evaluation.create(
+            correct, test_loss, guesses, num_classes,
+            torch.cat(labels), torch.cat(predictions), torch.cat(confidences))
         logging.info(
-            f"Test Error: Accuracy: {correct:>0.4f}, Avg loss: {test_loss:>8f}")
-        return correct, test_loss, guesses
+            f"Test Error: Accuracy: {correct:>0.4f}, Avg loss: {test_loss:>8f}, " +
+            f"Macro F1: {sum(evaluation.f1)/len(evaluation.f1):>0.4f}, " +
+            f"Calibration error: {evaluation.calibration_error:>0.4f}")
+        return evaluation
 
     def export_model_weights(self) -> dict[str, Any]:
         """Export model weights as a state dict."""
         return self.model.state_dict()
 
-    def import_model_weights(self, state_dict: dict[str, Any], weight_ratio: float = 1.0):
+    def flatten(self, state_dict: dict[str, Tensor]) -> bytes:
+        """
+        Concatenates all floating point tensors of the state dict to a little
+        endian float32 vector, as used for secure aggregation.
+        """
+        tensors = [v.detach().flatten().to("cpu", torch.float32)
+                   for v in state_dict.values() if v.is_floating_point()]
+        return torch.cat(tensors).numpy().astype("<f4").tobytes()
+
+    def unflatten(self, data: bytes) -> dict[str, Tensor]:
+        """
+        Converts a vector created by flatten to a state dict. Tensors that are
+        not floating point keep their current values.
+        """
+        vector = torch.frombuffer(bytearray(data), dtype=torch.float32)
+        state_dict: dict[str, Tensor] = {}
+        offset = 0
+        for key, current in self.model.state_dict().items():
+            if current.is_floating_point():
+                n = current.numel()
+                if offset + n > len(vector):
+                    raise ValueError(f"flat weights have {len(vector)} values, expected more")
+                state_dict[key] = vector[offset:offset + n].view_as(current).to(current.device, current.dtype)
+                offset += n
+            else:
+                state_dict[key] = current
+        if offset != len(vector):
+            raise ValueError(f"flat weights have {len(vector)} values, expected {offset}")
+        return state_dict
+
+    def export_private_weights(self, clip_norm: float, noise_multiplier: float) -> tuple[dict[str, Any], float]:
+        """
+        Export the weights of the last private export plus the change since
+        then, clipped to clip_norm and with Gaussian noise, and remember them
+        as released. Tensors that are not floating point are exported as is.
+
+        Args:
+            clip_norm: The L2 norm bound of the change over all tensors
+            noise_multiplier: The standard deviation of the noise relative to clip_norm
+
+        Returns:
+            tuple: The state dict and the L2 norm of the change before clipping
+        """
+        current = self.model.state_dict()
+        keys = [k for k, v in current.items() if v.is_floating_point()]
+        deltas = {k: current[k] - self.released[k] for k in keys}
+        norm = torch.sqrt(sum((d.double() ** 2).sum() for d in deltas.values())).item() if deltas else 0.0
+        scale = min(1.0, clip_norm / norm) if norm > 0 else 1.0
+        sigma = noise_multiplier * clip_norm
+        for k in keys:
+            self.released[k] = self.released[k] + deltas[k] * scale + torch.randn_like(deltas[k]) * sigma
+        exported = {k: self.released[k] if k in deltas else v for k, v in current.items()}
+        return exported, norm
+
+    def import_model_weights(self, state_dict: dict[str, Any], weight_ratio: float = 1.0,
+                             layer_ratios: dict[str, float] | None = None):
         """
         Import model weights from a state dict with weighted averaging.
 
         Args:
-            state_dict: The state dict containing the weights to import
+            state_dict: The state dict containing the weights to import,
+                tensors it lacks keep their current values
             weight_ratio: Float between 0 and 1, where:
                 0 = keep current weights
                 1 = use imported weights completely (default)
                 values between 0-1 = weighted average of current and imported weights
+            layer_ratios: Ratios of single tensors that replace weight_ratio
         """
-        if not 0 <= weight_ratio <= 1:
+        layer_ratios = layer_ratios or {}
+        if not all(0 <= r <= 1 for r in [weight_ratio, *layer_ratios.values()]):
             raise ValueError("weight_ratio must be between 0 and 1")
 
-        if weight_ratio == 1.0:
+        current_keys = self.model.state_dict().keys()
+        if weight_ratio == 1.0 and not layer_ratios and state_dict.keys() == current_keys:
             # If weight_ratio is 1, just load the imported weights directly
             _ = self.model.load_state_dict(state_dict)
         else:
@@ -150,13 +426,14 @@ class Model:
             averaged_state_dict: dict[str, Tensor] = {}
             for key in current_state_dict.keys():
                 if key in state_dict:
+                    ratio = layer_ratios.get(key, weight_ratio)
                     current_weights = current_state_dict[key]
-                    imported_weights = state_dict[key]
+                    imported_weights = state_dict[key].to(current_weights.device)
 
                     # Compute weighted average
                     averaged_weights = (
-                        (1 - weight_ratio) * current_weights +
-                        weight_ratio * imported_weights
+                        (1 - ratio) * current_weights +
+                        ratio * imported_weights
                     )
                     averaged_state_dict[key] = averaged_weights
                 else: